@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+func auditKeygen(args []string) error {
+	flags := flag.NewFlagSet("audit-keygen", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: audit-keygen <key file>")
+		fmt.Fprintln(os.Stderr, "generates the Ed25519 key signing chain checkpoints (PEM), and its public key in <key file>.pub.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one key file expected")
+	}
+	path := flags.Arg(0)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	public, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: private}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644)
+}
+
+// Read the PEM block of a key file.
+func readPEM(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block.Bytes, nil
+}
+
+// Read the private key given by a flag, if any.
+func readAuditKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return privateKey, nil
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	publicKeyFile := flags.String("key", "", "public key checking the checkpoints (none: only check the hash chain)")
+	from := flags.Uint64("from", 0, "only verify the messages from this offset, like the first one appended with a hash chain (default: all)")
+	keyFile := flags.String("keys", "", "key file to decrypt the records with, if any")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: verify [flags] <log dir>")
+		fmt.Fprintln(os.Stderr, "checks the hash chain of the messages of the log, and the checkpoints of its segments.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one log directory expected")
+	}
+	if _, err := os.Stat(flags.Arg(0)); err != nil {
+		return err
+	}
+
+	var publicKey ed25519.PublicKey
+	if *publicKeyFile != "" {
+		data, err := readPEM(*publicKeyFile)
+		if err != nil {
+			return err
+		}
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *publicKeyFile, err)
+		}
+		var ok bool
+		if publicKey, ok = key.(ed25519.PublicKey); !ok {
+			return fmt.Errorf("%s: not an Ed25519 key", *publicKeyFile)
+		}
+	}
+	keys, err := openKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	last, err := log.VerifyChain(openStore(flags.Arg(0), keys, true), publicKey, *from)
+	if err != nil {
+		return err
+	}
+	fmt.Println("verified up to offset", last)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/MikaelCluseau/webaka/pkg/backup"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func backupLog(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	full := flags.Bool("full", false, "copy all the segments, even if a previous backup has them")
+	previous := flags.String("previous", "", "manifest of the previous backup (default: the latest in the backup dir)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: backup [flags] <log dir> <backup dir | archive.tar>")
+		fmt.Fprintln(os.Stderr, "backs up a log that is not being written; sealed segments of the previous backup are not copied again.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("wrong number of arguments")
+	}
+	logDir, target := flags.Arg(0), flags.Arg(1)
+	toTar := strings.HasSuffix(target, ".tar")
+
+	var prev *backup.Manifest
+	var err error
+	if *previous != "" {
+		prev, err = backup.ReadManifest(*previous)
+	} else if !toTar {
+		prev, err = backup.Dir(target).Latest()
+	}
+	if err != nil {
+		return err
+	}
+	if *full {
+		prev = nil
+	}
+
+	store := kafka.OpenReadOnly(logDir, 0)
+	var m *backup.Manifest
+	if toTar {
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archive := backup.NewTar(f)
+		if m, err = backup.Store(store, archive, prev); err != nil {
+			return err
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	} else if m, err = backup.Store(store, backup.Dir(target), prev); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: offsets %d to %d\n", m.FileName(), m.StartOffset, m.EndOffset)
+	return nil
+}
+
+func restoreLog(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	toOffset := flags.Uint64("to-offset", 0, "last offset to restore (0: no limit)")
+	toTime := flags.String("to-time", "", "restore the messages up to the first one after this time")
+	manifest := flags.String("manifest", "", "manifest of the backup to restore (default: the latest)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: restore [flags] <backup dir | archive.tar...> <log dir>")
+		fmt.Fprintln(os.Stderr, "archives of incremental backups are given after the ones they depend on.")
+		fmt.Fprintln(os.Stderr, "times are RFC3339 or raw message timestamps.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return errors.New("wrong number of arguments")
+	}
+	sources, logDir := flags.Args()[:flags.NArg()-1], flags.Arg(flags.NArg()-1)
+
+	options := backup.RestoreOptions{ToOffset: *toOffset}
+	if *toTime != "" {
+		ts, err := parseTimestamp(*toTime)
+		if err != nil {
+			return err
+		}
+		options.ToTimestamp = ts
+	}
+
+	var dir backup.Dir
+	var m *backup.Manifest
+	if len(sources) == 1 && !strings.HasSuffix(sources[0], ".tar") {
+		dir = backup.Dir(sources[0])
+	} else {
+		tmp, err := ioutil.TempDir("", "restore-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = backup.Dir(tmp)
+
+		for _, source := range sources {
+			f, err := os.Open(source)
+			if err != nil {
+				return err
+			}
+			m, err = backup.ExtractTar(f, dir)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
+		}
+	}
+
+	var err error
+	if *manifest != "" {
+		m, err = backup.ReadManifest(*manifest)
+	} else if m == nil {
+		m, err = dir.Latest()
+		if err == nil && m == nil {
+			err = fmt.Errorf("no backup in %s", dir)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	last, err := backup.Restore(m, dir, logDir, options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored offsets %d to %d\n", m.StartOffset, last)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/encrypted"
+)
+
+type consumedRecord struct {
+	Offset    uint64       `json:"offset"`
+	Timestamp uint64       `json:"timestamp"`
+	Key       []byte       `json:"key"`
+	Value     []byte       `json:"value"`
+	Headers   []jsonHeader `json:"headers,omitempty"`
+}
+
+func consume(args []string) error {
+	flags := flag.NewFlagSet("consume", flag.ExitOnError)
+	from := flags.String("from", "latest", "where to start: earliest, latest, an offset, or a time (RFC3339 or @timestamp)")
+	follow := flags.Bool("follow", true, "wait for new messages once the end of the log is reached")
+	pollInterval := flags.Duration("poll", time.Second, "interval between checks for new messages when following (changes are also watched on Linux)")
+	max := flags.Uint64("max", 0, "stop after this many messages (0: no limit)")
+	format := flags.String("format", "text", "output format: text or json")
+	delimiter := flags.String("delimiter", "newline", "record delimiter for text output: newline or length")
+	withKey := flags.Bool("key", false, "print the key before the value (key<TAB>value when newline delimited)")
+	printOffsets := flags.Bool("print-offsets", false, "print the offset before each record in text output")
+	readCommitted := flags.Bool("read-committed", false, "only read messages of committed transactions")
+	keyFile := flags.String("keys", "", "key file to decrypt the records with, if any")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: consume [flags] <log dir>")
+		fmt.Fprintln(os.Stderr, "writes the records of the log to stdout.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one log directory expected")
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var write func(offset uint64, msg *log.Message) error
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(out)
+		write = func(offset uint64, msg *log.Message) error {
+			return enc.Encode(consumedRecord{offset, log.NormalizeTimestamp(msg.Timestamp), msg.Key, msg.Payload, jsonHeaders(msg.Headers)})
+		}
+	case "text":
+		writeRecord, err := newRecordWriter(*delimiter, *withKey, out)
+		if err != nil {
+			return err
+		}
+		write = func(offset uint64, msg *log.Message) error {
+			if *printOffsets {
+				fmt.Fprintf(out, "%d\t", offset)
+			}
+			return writeRecord(msg.Key, msg.Payload)
+		}
+	default:
+		return fmt.Errorf("unknown output format: %q", *format)
+	}
+
+	dir := flags.Arg(0)
+	var options []log.ConsumerOption
+	if *readCommitted {
+		options = append(options, log.ReadCommitted())
+	}
+
+	keys, err := openKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	l, err := openFollowedLog(dir, keys, *readCommitted, *follow, *pollInterval)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	offset, minTimestamp, err := parseFrom(l, *from)
+	if err != nil {
+		return err
+	}
+
+	c, err := l.Consumer(offset, options...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if minTimestamp != 0 {
+		if err := c.SeekToTimestamp(minTimestamp); err != nil {
+			return err
+		}
+		offset = c.Position()
+	}
+
+	var count uint64
+	for *max == 0 || count < *max {
+		if offset >= l.NextOffset() || (*readCommitted && offset >= l.LastStableOffset()) {
+			if !*follow {
+				return nil
+			}
+			out.Flush()
+		}
+
+		// the log follows the messages appended by the writer's process
+		o, msg, err := c.NextTimeout(*pollInterval)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			if err := l.FollowError(); err != nil {
+				return err
+			}
+			continue
+		}
+		offset = o + 1
+
+		if err := write(o, msg); err != nil {
+			return err
+		}
+		count++
+	}
+	return nil
+}
+
+// Open a log written by another process, following its new messages if follow is set.
+func openFollowedLog(dir string, keys *encrypted.KeyFile, transactional, follow bool, interval time.Duration) (*log.Log, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return log.Open(log.Config{
+		MaxSyncLag:     -1,
+		Transactional:  transactional,
+		ReadOnly:       true,
+		Follow:         follow,
+		FollowInterval: interval,
+	}, openStore(dir, keys, true))
+}
+
+// Parse the start position of a consumer.
+// Returns the offset to start from, or the timestamp to seek to if not 0.
+func parseFrom(l *log.Log, from string) (uint64, uint64, error) {
+	switch from {
+	case "earliest":
+		return l.StartOffset(), 0, nil
+	case "latest":
+		return l.NextOffset(), 0, nil
+	}
+
+	if from == "" {
+		return 0, 0, errors.New("empty start position")
+	}
+
+	if from[0] == '@' {
+		ts, err := strconv.ParseUint(from[1:], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid timestamp %q: %v", from, err)
+		}
+		return l.StartOffset(), ts, nil
+	}
+
+	if offset, err := strconv.ParseUint(from, 10, 64); err == nil {
+		if offset < l.StartOffset() {
+			return 0, 0, fmt.Errorf("offset %d is before the start of the log (%d)", offset, l.StartOffset())
+		}
+		return offset, 0, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start position %q", from)
+	}
+	return l.StartOffset(), log.Timestamp(t), nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+type dumpRecord struct {
+	Offset        uint64       `json:"offset"`
+	Position      int64        `json:"position"`
+	Size          int          `json:"size"`
+	CRC           uint32       `json:"crc"`
+	Valid         *bool        `json:"valid,omitempty"`
+	Format        byte         `json:"format"`
+	Codec         string       `json:"codec"`
+	TimestampType string       `json:"timestampType"`
+	Timestamp     uint64       `json:"timestamp"`
+	ProducerID    *uint64      `json:"producerId,omitempty"`
+	Sequence      *uint32      `json:"sequence,omitempty"`
+	Transactional bool         `json:"transactional,omitempty"`
+	Control       string       `json:"control,omitempty"`
+	Key           []byte       `json:"key"`
+	Payload       []byte       `json:"payload"`
+	Headers       []jsonHeader `json:"headers,omitempty"`
+	Error         string       `json:"error,omitempty"`
+}
+
+type dumper struct {
+	out    *bufio.Writer
+	format string
+	deep   bool
+
+	fromOffset, toOffset uint64
+	since, until         uint64
+
+	lastOffset uint64
+	invalid    int
+}
+
+type segmentFile struct {
+	name        string
+	startOffset uint64
+}
+
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := flags.String("format", "text", "output format: text, hex or json")
+	from := flags.Uint64("from", 0, "first offset to print")
+	to := flags.Uint64("to", math.MaxUint64, "last offset to print")
+	since := flags.String("since", "", "only print messages with a timestamp at or after this time")
+	until := flags.String("until", "", "only print messages with a timestamp at or before this time")
+	deep := flags.Bool("deep", false, "re-verify CRCs and report invalid messages instead of trusting them")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dump [flags] <segment file or log dir>...")
+		fmt.Fprintln(os.Stderr, "times are RFC3339 or raw message timestamps.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no segment file or log directory given")
+	}
+
+	switch *format {
+	case "text", "hex", "json":
+	default:
+		return fmt.Errorf("unknown output format: %q", *format)
+	}
+
+	d := &dumper{
+		out:        bufio.NewWriter(os.Stdout),
+		format:     *format,
+		deep:       *deep,
+		fromOffset: *from,
+		toOffset:   *to,
+		until:      math.MaxUint64,
+	}
+	defer d.out.Flush()
+
+	var err error
+	if *since != "" {
+		if d.since, err = parseTimestamp(*since); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if d.until, err = parseTimestamp(*until); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range flags.Args() {
+		files, err := segmentFiles(path)
+		if err != nil {
+			return err
+		}
+		// each log has its own offsets
+		d.lastOffset = 0
+		for i, file := range files {
+			if i+1 < len(files) && files[i+1].startOffset <= d.fromOffset {
+				// all messages of this segment are before the requested range
+				continue
+			}
+			if file.startOffset > d.toOffset {
+				break
+			}
+			if err := d.dumpSegment(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	if d.invalid != 0 {
+		d.out.Flush()
+		return fmt.Errorf("found %d invalid messages", d.invalid)
+	}
+	return nil
+}
+
+// Check if a timestamp is in [since, until], old timestamps in seconds included.
+func (d *dumper) inTimeRange(ts uint64) bool {
+	ts = log.NormalizeTimestamp(ts)
+	return ts >= log.NormalizeTimestamp(d.since) && ts <= log.NormalizeTimestamp(d.until)
+}
+
+// Parse a time given as RFC3339 or as a raw message timestamp.
+func parseTimestamp(s string) (uint64, error) {
+	if ts, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %v", s, err)
+	}
+	return log.Timestamp(t), nil
+}
+
+// List the segment files of a log directory, or the given segment file.
+func segmentFiles(path string) ([]segmentFile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		file := segmentFile{name: path}
+		base := filepath.Base(path)
+		if n, err := strconv.ParseUint(base[:len(base)-len(filepath.Ext(base))], 10, 64); err == nil {
+			file.startOffset = n
+		}
+		return []segmentFile{file}, nil
+	}
+
+	segments, err := kafka.OpenReadOnly(path, 0).Segments()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(log.ByStartOffset(segments))
+
+	files := make([]segmentFile, 0, len(segments))
+	for _, s := range segments {
+		files = append(files, segmentFile{
+			name:        s.(*kafka.Segment).FileName(),
+			startOffset: s.StartOffset(),
+		})
+	}
+	return files, nil
+}
+
+func (d *dumper) dumpSegment(file segmentFile) error {
+	f, err := os.Open(file.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if d.format != "json" {
+		fmt.Fprintf(d.out, "Dumping %s\n", file.name)
+	}
+
+	r := log.NewReader(f, 0, 0)
+	for {
+		position := r.Position()
+		offset, raw, err := r.NextRaw()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			d.invalid++
+			d.printRecord(&dumpRecord{
+				Position: position,
+				Error:    fmt.Sprintf("invalid tail: %v", err),
+			})
+			return nil
+		}
+
+		if offset > d.toOffset {
+			return nil
+		}
+
+		record := d.decode(file, offset, position, raw)
+		if record.Error == "" && (offset < d.fromOffset || !d.inTimeRange(record.Timestamp)) {
+			continue
+		}
+		d.printRecord(record)
+	}
+}
+
+func (d *dumper) decode(file segmentFile, offset uint64, position int64, raw []byte) *dumpRecord {
+	record := &dumpRecord{
+		Offset:   offset,
+		Position: position,
+		Size:     len(raw),
+	}
+
+	invalid := func(format string, args ...interface{}) *dumpRecord {
+		d.invalid++
+		valid := false
+		record.Valid = &valid
+		record.Error = fmt.Sprintf(format, args...)
+		return record
+	}
+
+	buf := bytes.NewReader(raw)
+	msg := &log.Message{}
+	if err := msg.ReadFrom(buf); err != nil {
+		return invalid("failed to decode message: %v", err)
+	}
+
+	record.CRC = msg.CRC
+	record.Format = msg.Format
+	record.Codec = msg.Codec().String()
+	record.TimestampType = msg.TimestampType().String()
+	record.Timestamp = log.NormalizeTimestamp(msg.Timestamp)
+	record.Key = msg.Key
+	record.Payload = msg.Payload
+	record.Headers = jsonHeaders(msg.Headers)
+	if msg.HasProducer() {
+		record.ProducerID = &msg.ProducerID
+		record.Sequence = &msg.Sequence
+	}
+	record.Transactional = msg.IsTransactional()
+	if msg.IsControl() {
+		if controlType, ok := msg.ControlType(); ok {
+			record.Control = controlType.String()
+		} else {
+			record.Control = "invalid"
+		}
+	}
+
+	if buf.Len() != 0 {
+		return invalid("%d trailing bytes after message", buf.Len())
+	}
+
+	if !d.deep {
+		return record
+	}
+
+	defer func() { d.lastOffset = offset }()
+
+	if offset < file.startOffset {
+		return invalid("offset before segment start offset %d", file.startOffset)
+	}
+	if offset <= d.lastOffset {
+		return invalid("offset not after previous offset %d", d.lastOffset)
+	}
+	if crc := crc32.ChecksumIEEE(raw[4:]); crc != msg.CRC {
+		return invalid("bad CRC: stored %08x, computed %08x", msg.CRC, crc)
+	}
+	if crc := msg.ComputeCRC(); crc != msg.CRC {
+		return invalid("bad CRC: stored %08x, re-encoded %08x", msg.CRC, crc)
+	}
+
+	valid := true
+	record.Valid = &valid
+	return record
+}
+
+func (d *dumper) printRecord(record *dumpRecord) {
+	if d.format == "json" {
+		json.NewEncoder(d.out).Encode(record)
+		return
+	}
+
+	if record.Error != "" && record.Size == 0 {
+		fmt.Fprintf(d.out, "position: %d error: %s\n", record.Position, record.Error)
+		return
+	}
+
+	fmt.Fprintf(d.out, "offset: %d position: %d size: %d crc: %08x",
+		record.Offset, record.Position, record.Size, record.CRC)
+	if record.Valid != nil {
+		fmt.Fprintf(d.out, " valid: %t", *record.Valid)
+	}
+	fmt.Fprintf(d.out, " format: %d codec: %s timestampType: %s timestamp: %d",
+		record.Format, record.Codec, record.TimestampType, record.Timestamp)
+	if record.ProducerID != nil {
+		fmt.Fprintf(d.out, " producerId: %d sequence: %d", *record.ProducerID, *record.Sequence)
+	}
+	if record.Transactional {
+		fmt.Fprint(d.out, " transactional: true")
+	}
+	if record.Control != "" {
+		fmt.Fprintf(d.out, " control: %s", record.Control)
+	}
+	if record.Error != "" {
+		fmt.Fprintf(d.out, " error: %s", record.Error)
+	}
+
+	if d.format == "hex" {
+		fmt.Fprintf(d.out, "\nkey: (%d bytes)\n%spayload: (%d bytes)\n%s",
+			len(record.Key), hex.Dump(record.Key), len(record.Payload), hex.Dump(record.Payload))
+		for _, h := range record.Headers {
+			fmt.Fprintf(d.out, "header %q: (%d bytes)\n%s", h.Key, len(h.Value), hex.Dump(h.Value))
+		}
+		return
+	}
+
+	fmt.Fprintf(d.out, " key: %q payload: %q", record.Key, record.Payload)
+	if len(record.Headers) != 0 {
+		headers := make([]log.Header, len(record.Headers))
+		for i, h := range record.Headers {
+			headers[i] = log.Header{Key: h.Key, Value: h.Value}
+		}
+		fmt.Fprintf(d.out, " headers: %s", formatHeaders(headers))
+	}
+	fmt.Fprintln(d.out)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+// Write messages at the given offsets, with their timestamps, in a kafka segment starting at start.
+func writeSegment(t *testing.T, dir string, start uint64, offsets, timestamps []uint64) segmentFile {
+	store := kafka.Open(dir, 0)
+	defer store.Close()
+	segment, err := store.AddSegment(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appender, err := segment.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, offset := range offsets {
+		if _, err := appender.Append(offset, log.NewMessage(timestamps[i], []byte("k"), []byte("v"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appender.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := segmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].startOffset != start {
+		t.Fatalf("unexpected segment files: %v", files)
+	}
+	return files[0]
+}
+
+// Dump a segment in JSON and decode the records printed.
+func dumpJSON(t *testing.T, d *dumper, file segmentFile) []dumpRecord {
+	buf := &bytes.Buffer{}
+	d.out = bufio.NewWriter(buf)
+	d.format = "json"
+	if err := d.dumpSegment(file); err != nil {
+		t.Fatal(err)
+	}
+	d.out.Flush()
+
+	records := []dumpRecord{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		record := dumpRecord{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDumpFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first message was written when timestamps were in seconds
+	file := writeSegment(t, dir, 1, []uint64{1, 2, 3, 4}, []uint64{1500000000, 1500000001000, 1500000002000, 1500000003000})
+
+	for _, c := range []struct {
+		name                 string
+		fromOffset, toOffset uint64
+		since, until         uint64
+		offsets              []uint64
+	}{
+		{"all", 0, math.MaxUint64, 0, math.MaxUint64, []uint64{1, 2, 3, 4}},
+		{"offsets", 2, 3, 0, math.MaxUint64, []uint64{2, 3}},
+		{"times", 0, math.MaxUint64, 1500000001000, 1500000002000, []uint64{2, 3}},
+		{"times in seconds", 0, math.MaxUint64, 1500000001, 1500000002, []uint64{2, 3}},
+		{"legacy message", 0, math.MaxUint64, 1500000000000, 1500000000000, []uint64{1}},
+		{"offsets and times", 3, math.MaxUint64, 0, 1500000003, []uint64{3, 4}},
+	} {
+		d := &dumper{fromOffset: c.fromOffset, toOffset: c.toOffset, since: c.since, until: c.until}
+		offsets := []uint64{}
+		for _, record := range dumpJSON(t, d, file) {
+			offsets = append(offsets, record.Offset)
+			if record.Timestamp < 1500000000000 {
+				t.Errorf("%s: timestamp not in milliseconds: %d", c.name, record.Timestamp)
+			}
+			if record.Valid != nil {
+				t.Errorf("%s: offset %d verified without deep", c.name, record.Offset)
+			}
+		}
+		if !reflect.DeepEqual(offsets, c.offsets) {
+			t.Errorf("%s: expected offsets %v, got %v", c.name, c.offsets, offsets)
+		}
+	}
+}
+
+func TestDumpDeep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the second message repeats the offset of the first one, the third is before the segment
+	file := writeSegment(t, dir, 10, []uint64{10, 10, 9, 11}, []uint64{1, 2, 3, 4})
+
+	// alter the payload of the last message, its CRC doesn't match anymore
+	data, err := ioutil.ReadFile(file.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] = 'x'
+	if err := ioutil.WriteFile(file.name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dumper{toOffset: math.MaxUint64, until: math.MaxUint64}
+	if records := dumpJSON(t, d, file); len(records) != 4 || d.invalid != 0 {
+		t.Errorf("messages verified without deep: %d invalid in %+v", d.invalid, records)
+	}
+
+	d = &dumper{toOffset: math.MaxUint64, until: math.MaxUint64, deep: true}
+	records := dumpJSON(t, d, file)
+	if len(records) != 4 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	for i, expected := range []string{
+		"",
+		"offset not after previous offset 10",
+		"offset before segment start offset 10",
+		"bad CRC",
+	} {
+		record := records[i]
+		if record.Valid == nil || *record.Valid != (expected == "") || !strings.HasPrefix(record.Error, expected) {
+			t.Errorf("offset %d: expected error %q, got %q", record.Offset, expected, record.Error)
+		}
+	}
+	if d.invalid != 3 {
+		t.Error("unexpected invalid messages: ", d.invalid)
+	}
+}
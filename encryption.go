@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/encrypted"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+// The store of a log directory, encrypted with the keys of keys if it's not nil.
+// A read-only store doesn't lock the directory, so another process can write to it.
+func openStore(dir string, keys *encrypted.KeyFile, readOnly bool) log.Store {
+	store := kafka.Open(dir, 0)
+	if readOnly {
+		store = kafka.OpenReadOnly(dir, 0)
+	}
+	return encryptStore(store, keys)
+}
+
+// Encrypt the messages of a store with the given keys, if any.
+func encryptStore(store log.Store, keys *encrypted.KeyFile) log.Store {
+	if keys == nil {
+		return store
+	}
+	return encrypted.New(store, keys)
+}
+
+// Open the key file given by a flag, if any.
+func openKeyFile(path string) (*encrypted.KeyFile, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return encrypted.OpenKeyFile(path)
+}
+
+func rotateKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rotate-key <key file>")
+		fmt.Fprintln(os.Stderr, "adds a new active key to the key file, creating it if needed. Previous keys are kept to read old messages.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one key file expected")
+	}
+	id, err := encrypted.RotateKeyFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println("active key:", id)
+	return nil
+}
+
+func reencrypt(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	keyFile := flags.String("keys", "", "key file (required)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: reencrypt -keys <key file> <log dir>")
+		fmt.Fprintln(os.Stderr, "rewrites the sealed segments of the log with the active key.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *keyFile == "" {
+		flags.Usage()
+		return errors.New("a key file and exactly one log directory expected")
+	}
+	keys, err := encrypted.OpenKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	n, err := encrypted.New(kafka.Open(flags.Arg(0), 0), keys).Reencrypt()
+	if err != nil {
+		return err
+	}
+	fmt.Println("rewritten segments:", n)
+	return nil
+}
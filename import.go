@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	golog "log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func importLog(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	segmentSize := flags.Int64("segment-size", 100<<20, "maximum size of a segment")
+	offsetHeader := flags.String("offset-header", "", "record the Kafka offset of each record in this header, like kafka-offset (default: none)")
+	keyFile := flags.String("keys", "", "key file to encrypt the log with, if any")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: import [flags] <kafka partition dir> <log dir>")
+		fmt.Fprintln(os.Stderr, "copies the records of an Apache Kafka partition directory (like /var/lib/kafka/topic-0) into a new log.")
+		fmt.Fprintln(os.Stderr, "a record at Kafka offset N is at offset N+1 in the log, unless the partition was compacted.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("wrong number of arguments")
+	}
+
+	source := kafka.OpenNative(flags.Arg(0), 0)
+	segments, err := source.Segments()
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return fmt.Errorf("%s: no Kafka segments", flags.Arg(0))
+	}
+	sort.Sort(log.ByStartOffset(segments))
+
+	keys, err := openKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	store := openStore(flags.Arg(1), keys, false)
+	if existing, err := store.Segments(); err != nil {
+		return err
+	} else if len(existing) != 0 {
+		return fmt.Errorf("%s: the log already exists", flags.Arg(1))
+	}
+	// the log starts where the partition does, to keep the offsets
+	if _, err := store.AddSegment(segments[0].StartOffset()); err != nil {
+		return err
+	}
+	dest, err := log.Open(log.Config{MaxSegmentSize: *segmentSize, MaxSyncLag: -1}, store)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	var count, renumbered uint64
+	for i, segment := range segments {
+		name := segment.(*kafka.NativeSegment).FileName()
+		reader, err := segment.Reader()
+		if err != nil {
+			return err
+		}
+		for {
+			offset, msg, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err == log.UnexpectedEOF && i == len(segments)-1 {
+				// the broker is still writing to the partition
+				golog.Print("ignoring the incomplete batch at the end of ", name)
+				break
+			} else if err != nil {
+				reader.Close()
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			if *offsetHeader != "" {
+				if msg.Format < 2 {
+					msg.Format = 2
+				}
+				msg.Headers = append(msg.Headers, log.Header{
+					Key:   *offsetHeader,
+					Value: []byte(strconv.FormatUint(offset-1, 10)),
+				})
+				msg.UpdateCRC()
+			}
+
+			destOffset, err := dest.Append(msg)
+			if err != nil {
+				reader.Close()
+				return err
+			}
+			if destOffset != offset {
+				renumbered++
+			}
+			count++
+		}
+		reader.Close()
+	}
+
+	fmt.Println("imported records:", count)
+	if renumbered != 0 {
+		fmt.Println("records with a new offset (compacted partition):", renumbered)
+	}
+	return nil
+}
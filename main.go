@@ -1,114 +1,58 @@
 package main
 
 import (
-	"crypto/rand"
+	"fmt"
 	golog "log"
 	"os"
-	"runtime/pprof"
-	"time"
-
-	"github.com/MikaelCluseau/webaka/pkg/log"
-	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
 )
 
-var count int = 5e4
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
 
-func main() {
-	golog.Print("opening store...")
-	store := kafka.Open("/tmp/test-log", 8<<10)
+var commands = []command{
+	{"audit-keygen", "generate the key signing the checkpoints of hash chained logs", auditKeygen},
+	{"backup", "back up a log to a directory or a tar archive", backupLog},
+	{"bench", "run the append/consume benchmark", bench},
+	{"consume", "write the messages of a log to stdout", consume},
+	{"dump", "print the messages of segments or logs", dump},
+	{"import", "copy an Apache Kafka partition directory into a new log", importLog},
+	{"mirror", "copy a log into another one, continuously", mirrorLog},
+	{"produce", "append records read from stdin to a log", produce},
+	{"reencrypt", "rewrite the segments of a log with the active key", reencrypt},
+	{"restore", "restore a log from a backup", restoreLog},
+	{"rotate-key", "add a new active key to a key file", rotateKey},
+	{"serve", "serve logs over HTTP", serve},
+	{"verify", "check the hash chain of a log", verify},
+}
 
-	golog.Print("opening log...")
-	l, err := log.Open(log.Config{
-		MaxSegmentSize: 100 << 20,
-		MaxSyncLag:     -1,
-	}, store)
-	if err != nil {
-		golog.Fatal(err)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
 	}
 
-	golog.Print("log opened, next offset: ", l.NextOffset())
-	if l.NextOffset() > uint64(count) {
-		golog.Print("Topic has many messages, just consumming...")
-		c, err := l.Consumer(1)
-		if err != nil {
-			golog.Fatal(err)
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
 		}
-		golog.Print("consuming...")
-		lastOffset := l.NextOffset() - 1
-		cnt := 0
-		t0 := time.Now()
-		for {
-			o, _, err := c.Next()
-			if err != nil {
-				golog.Fatal(err)
-			}
-			cnt++
-			if o == lastOffset {
-				// finished
-				break
-			}
+		if err := cmd.run(os.Args[2:]); err != nil {
+			golog.Fatal(name, ": ", err)
 		}
-		dur := time.Since(t0)
-		golog.Print("reading ", cnt, " messages took ", dur)
-		golog.Printf("-> %.2f msg/s", float64(cnt)/float64(dur.Seconds()))
-		golog.Print("consume finished")
 		return
 	}
 
-	consumeOk := make(chan bool, 1)
-	go func() {
-		consume(l)
-		close(consumeOk)
-	}()
-
-	data := make([]byte, 4096)
-	rand.Read(data)
-	msg := log.NewMessage(log.Timestamp(time.Now()), nil, data)
-
-	if true {
-		f, err := os.Create("/tmp/cpu.2.prof")
-		if err != nil {
-			golog.Fatal(err)
-		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
-	}
-
-	golog.Printf("appending %d messages...", count)
-	t0 := time.Now()
-	for i := 0; i < count; i++ {
-		if _, err := l.Append(msg); err != nil {
-			golog.Fatal("failed to append message: ", err)
-		}
-	}
-	golog.Print("time taken (pre-sync):  ", time.Since(t0))
-	l.Sync()
-	golog.Print("time taken (post-sync): ", time.Since(t0))
-
-	<-consumeOk
-
-	golog.Print("close")
-	l.Close()
-
-	golog.Print("done")
+	fmt.Fprintf(os.Stderr, "unknown command: %q\n", name)
+	usage()
+	os.Exit(2)
 }
 
-func consume(l *log.Log) {
-	golog.Print("Consuming...")
-	c, err := l.Consumer(1)
-	if err != nil {
-		golog.Fatal("failed to open consumer: ", err)
-	}
-	t0 := time.Now()
-	for i := 1; i <= count; i++ {
-		offset, msg, err := c.Next()
-		if err != nil {
-			golog.Fatal("consume ", i, " failed: ", err)
-		}
-		_ = offset
-		_ = msg
-		//golog.Printf("%d/%d -> offset: %d; len: %d", i, count, offset, msg.Len())
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [arguments]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
 	}
-	golog.Print("time taken (read):    ", time.Since(t0))
-	c.Close()
 }
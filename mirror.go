@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	golog "log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/mirror"
+	"github.com/MikaelCluseau/webaka/pkg/rpc"
+)
+
+func mirrorLog(args []string) error {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	name := flags.String("name", "", "name of the mirror, for its checkpoint")
+	preserve := flags.Bool("preserve-offsets", false, "keep the source offsets (the destination must only be written by the mirror)")
+	from := flags.Uint64("from", 0, "first source offset to copy when there's no checkpoint (0: the start of the source)")
+	remote := flags.String("grpc", "", "read the source from this gRPC server, the source being a log name")
+	segmentSize := flags.Int64("segment-size", 100<<20, "maximum size of a destination segment")
+	keyFile := flags.String("keys", "", "key file to decrypt the source with, if any (required to translate the offsets of encrypted messages)")
+	destKeyFile := flags.String("dest-keys", "", "key file to encrypt the destination with, if any")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mirror [flags] <source log dir | log name> <destination log dir>")
+		fmt.Fprintln(os.Stderr, "copies a log into another one until interrupted, resuming from its checkpoint.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("wrong number of arguments")
+	}
+
+	keys, err := openKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	destKeys, err := openKeyFile(*destKeyFile)
+	if err != nil {
+		return err
+	}
+
+	var source mirror.Source
+	if *remote != "" {
+		conn, err := grpc.NewClient(*remote, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		source = mirror.RemoteSource(rpc.NewClient(conn), flags.Arg(0))
+	} else {
+		// the source may be written by another process
+		l, err := openFollowedLog(flags.Arg(0), keys, false, true, 0)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		source = mirror.LogSource(l)
+	}
+
+	destStore := openStore(flags.Arg(1), destKeys, false)
+	dest, err := log.Open(log.Config{MaxSegmentSize: *segmentSize, MaxSyncLag: -1}, destStore)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	m, err := mirror.New(source, dest, destStore.(log.SnapshotStore), mirror.Config{
+		Name:            *name,
+		PreserveOffsets: *preserve,
+		StartOffset:     *from,
+	})
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		golog.Print("stopping on ", <-signals)
+		close(stop)
+	}()
+
+	golog.Print("mirroring from offset ", m.Position())
+	if err := m.Run(stop); err != nil {
+		return err
+	}
+	golog.Print("stopped at offset ", m.Position())
+	return nil
+}
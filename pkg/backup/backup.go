@@ -0,0 +1,237 @@
+// Package backup copies logs to backups and restores them.
+//
+// A backup is a manifest listing segment files. The files of sealed segments are reused by the
+// next incremental backups, so a backup can need the files of the previous ones: in the same
+// directory, or in the previous tar archives.
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+var (
+	Corrupted = errors.New("corrupted backup")
+)
+
+const manifestTimeFormat = "20060102T150405.000000000Z"
+
+// The description of a backup.
+type Manifest struct {
+	Time time.Time `json:"time"`
+	// The first and last offsets in the backup.
+	StartOffset uint64 `json:"startOffset"`
+	EndOffset   uint64 `json:"endOffset"`
+
+	Segments []SegmentManifest `json:"segments"`
+}
+
+type SegmentManifest struct {
+	File string `json:"file"`
+	// The first offset of the segment, and the last offset of the segment in the backup
+	// (StartOffset - 1 if none).
+	StartOffset uint64 `json:"startOffset"`
+	EndOffset   uint64 `json:"endOffset"`
+	// Whether the segment was sealed when backed up. Sealed segments don't change anymore.
+	Sealed bool `json:"sealed"`
+	// Bounds of the timestamps of the messages (zero if none).
+	MinTimestamp uint64 `json:"minTimestamp,omitempty"`
+	MaxTimestamp uint64 `json:"maxTimestamp,omitempty"`
+
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// The name of a manifest file, sorted like the backup times.
+func (m *Manifest) FileName() string {
+	return "manifest-" + m.Time.UTC().Format(manifestTimeFormat) + ".json"
+}
+
+// Where backups are written.
+type Destination interface {
+	// Create a file of the backup. The file is complete when closed without error.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// Backup the synced messages of a log, while it's being written. Sealed segments already in the
+// previous backup, if given, are not copied again.
+func Log(l *log.Log, dest Destination, previous *Manifest) (*Manifest, error) {
+	segments, syncOffset := l.SyncedSegments()
+	return backup(segments, syncOffset, dest, previous)
+}
+
+// Backup the messages of a store, that must not be written.
+func Store(s log.Store, dest Destination, previous *Manifest) (*Manifest, error) {
+	segments, err := s.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("no segments in the store")
+	}
+	return backup(segments, math.MaxUint64, dest, previous)
+}
+
+func backup(segments []log.Segment, syncOffset uint64, dest Destination, previous *Manifest) (*Manifest, error) {
+	segments = append([]log.Segment{}, segments...)
+	sort.Sort(log.ByStartOffset(segments))
+
+	m := &Manifest{
+		Time:        time.Now().UTC(),
+		StartOffset: segments[0].StartOffset(),
+	}
+	m.EndOffset = m.StartOffset - 1
+
+	for i, segment := range segments {
+		sealed := i < len(segments)-1
+		endOffset := syncOffset
+		if sealed {
+			// sealed segments are synced (see log.SyncedSegments), even if the log's sync offset doesn't tell it
+			endOffset = segments[i+1].StartOffset() - 1
+		}
+
+		if sealed && previous != nil {
+			if sm := previous.sealedSegment(segment.StartOffset(), endOffset); sm != nil {
+				m.Segments = append(m.Segments, *sm)
+				m.EndOffset = sm.EndOffset
+				continue
+			}
+		}
+
+		// named after the backup as the active segment can be copied again by the next ones
+		name := fmt.Sprintf("%020d-%s.log", segment.StartOffset(), m.Time.Format(manifestTimeFormat))
+		sm, err := copySegment(segment, endOffset, sealed, name, dest)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %v", segment.StartOffset(), err)
+		}
+		m.Segments = append(m.Segments, *sm)
+		if sm.EndOffset >= sm.StartOffset {
+			m.EndOffset = sm.EndOffset
+		}
+	}
+
+	if err := writeManifest(m, dest); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) sealedSegment(startOffset, endOffset uint64) *SegmentManifest {
+	for i := range m.Segments {
+		sm := &m.Segments[i]
+		if sm.Sealed && sm.StartOffset == startOffset && sm.EndOffset == endOffset {
+			return sm
+		}
+	}
+	return nil
+}
+
+// Counts and hashes what's written.
+type hashWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (w *hashWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.hash.Write(b[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// A log.WriterBackend of a hashWriter, as the messages are only appended.
+type appendOnly struct {
+	*hashWriter
+}
+
+func (appendOnly) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("seek on a backup file")
+}
+
+func (appendOnly) Sync() error {
+	return nil
+}
+
+func (appendOnly) Close() error {
+	return nil
+}
+
+func copySegment(segment log.Segment, endOffset uint64, sealed bool, name string, dest Destination) (*SegmentManifest, error) {
+	reader, err := segment.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	sm := &SegmentManifest{
+		File:        name,
+		StartOffset: segment.StartOffset(),
+		EndOffset:   segment.StartOffset() - 1,
+		Sealed:      sealed,
+	}
+	f, err := dest.Create(sm.File)
+	if err != nil {
+		return nil, err
+	}
+	w := &hashWriter{w: f, hash: sha256.New()}
+	writer := log.NewWriter(appendOnly{w}, 0, 0)
+
+	for {
+		offset, msg, err := reader.Next()
+		if err == io.EOF || (!sealed && (err == log.UnexpectedEOF || err == log.BadCRC)) {
+			// the end of the active segment can be partially written
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if offset > endOffset {
+			break
+		}
+		if _, err := writer.Append(offset, msg); err != nil {
+			f.Close()
+			return nil, err
+		}
+		sm.EndOffset = offset
+		if sm.MinTimestamp == 0 || msg.Timestamp < sm.MinTimestamp {
+			sm.MinTimestamp = msg.Timestamp
+		}
+		if msg.Timestamp > sm.MaxTimestamp {
+			sm.MaxTimestamp = msg.Timestamp
+		}
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	sm.Size = w.size
+	sm.SHA256 = hex.EncodeToString(w.hash.Sum(nil))
+	return sm, nil
+}
+
+func writeManifest(m *Manifest, dest Destination) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := dest.Create(m.FileName())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func appendMessages(t *testing.T, l *log.Log, from, to int) {
+	for i := from; i <= to; i++ {
+		// the timestamp of a message is 1000 + its offset
+		msg := log.NewMessage(uint64(1000+i), nil, []byte(fmt.Sprint("message ", i)))
+		if _, err := l.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkRestored(t *testing.T, storeDir string, lastOffset uint64) {
+	l, err := log.Open(log.Config{MaxSegmentSize: 1 << 20}, kafka.Open(storeDir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if next := l.NextOffset(); next != lastOffset+1 {
+		t.Fatalf("expected next offset %d, got %d", lastOffset+1, next)
+	}
+	c, err := l.Consumer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for expected := uint64(1); expected <= lastOffset; expected++ {
+		offset, msg, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != expected || string(msg.Payload) != fmt.Sprint("message ", offset) {
+			t.Fatalf("bad message at %d: %d %q", expected, offset, msg.Payload)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	msgSize := int64(8 + 4 + log.NewMessage(0, nil, []byte("message 10")).Len())
+	l, err := log.Open(log.Config{MaxSegmentSize: 5 * msgSize, MaxSyncLag: 0}, kafka.Open(filepath.Join(dir, "log"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendMessages(t, l, 1, 12)
+
+	backups := Dir(filepath.Join(dir, "backups"))
+	first, err := Log(l, backups, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.StartOffset != 1 || first.EndOffset != 12 || len(first.Segments) != 3 {
+		t.Fatalf("bad manifest: %+v", first)
+	}
+
+	appendMessages(t, l, 13, 20)
+	second, err := Log(l, backups, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.EndOffset != 20 {
+		t.Fatalf("bad manifest: %+v", second)
+	}
+	// the first two segments were sealed, the third one is copied again
+	for i, sm := range second.Segments {
+		reused := i < len(first.Segments) && sm.File == first.Segments[i].File
+		if reused != (i < 2) {
+			t.Errorf("segment %d reused: %v", i, reused)
+		}
+	}
+	if latest, err := backups.Latest(); err != nil || latest.FileName() != second.FileName() {
+		t.Fatal("bad latest manifest: ", latest, err)
+	}
+
+	for _, test := range []struct {
+		options    RestoreOptions
+		lastOffset uint64
+	}{
+		{RestoreOptions{}, 20},
+		{RestoreOptions{ToOffset: 7}, 7},
+		{RestoreOptions{ToOffset: 10}, 10},
+		{RestoreOptions{ToTimestamp: 1000 + 13}, 13},
+	} {
+		storeDir := filepath.Join(dir, fmt.Sprintf("restored-%d-%d", test.options.ToOffset, test.options.ToTimestamp))
+		last, err := Restore(second, backups, storeDir, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != test.lastOffset {
+			t.Errorf("%+v: restored up to %d, expected %d", test.options, last, test.lastOffset)
+		}
+		checkRestored(t, storeDir, test.lastOffset)
+	}
+
+	// corrupted backup
+	os.Truncate(filepath.Join(string(backups), first.Segments[0].File), 10)
+	if _, err := Restore(second, backups, filepath.Join(dir, "restored-corrupted"), RestoreOptions{}); err == nil {
+		t.Error("restored a corrupted backup")
+	}
+}
+
+func TestTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := log.Open(log.Config{MaxSegmentSize: 100, MaxSyncLag: 0}, kafka.Open(filepath.Join(dir, "log"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendMessages(t, l, 1, 5)
+
+	archives := make([]*bytes.Buffer, 2)
+	var previous *Manifest
+	for i := range archives {
+		if i != 0 {
+			appendMessages(t, l, 6, 10)
+		}
+		archives[i] = &bytes.Buffer{}
+		tar := NewTar(archives[i])
+		if previous, err = Log(l, tar, previous); err != nil {
+			t.Fatal(err)
+		}
+		if err := tar.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	extracted := Dir(filepath.Join(dir, "extracted"))
+	var m *Manifest
+	for _, archive := range archives {
+		if m, err = ExtractTar(archive, extracted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.FileName() != previous.FileName() {
+		t.Fatal("not the last manifest: ", m.FileName())
+	}
+
+	storeDir := filepath.Join(dir, "restored")
+	if _, err := Restore(m, extracted, storeDir, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkRestored(t, storeDir, 10)
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup directory, holding the files of successive backups.
+type Dir string
+
+var _ = Destination(Dir(""))
+
+func (d Dir) Create(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(string(d), name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{f, path}, nil
+}
+
+// A file renamed when closed, so incomplete files are never seen.
+type dirFile struct {
+	*os.File
+	path string
+}
+
+func (f *dirFile) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.File.Name(), f.path)
+}
+
+// The manifests of the backups in the directory, oldest first.
+func (d Dir) Manifests() ([]*Manifest, error) {
+	names, err := filepath.Glob(filepath.Join(string(d), "manifest-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	manifests := make([]*Manifest, 0, len(names))
+	for _, name := range names {
+		m, err := ReadManifest(name)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+// The manifest of the latest backup in the directory, nil if none.
+func (d Dir) Latest() (*Manifest, error) {
+	manifests, err := d.Manifests()
+	if err != nil || len(manifests) == 0 {
+		return nil, err
+	}
+	return manifests[len(manifests)-1], nil
+}
+
+func ReadManifest(fileName string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return m, nil
+}
+
+// A tar archive of a backup.
+type Tar struct {
+	w *tar.Writer
+}
+
+var _ = Destination(&Tar{})
+
+// Write a backup as a tar archive. The archive is complete when closed.
+func NewTar(w io.Writer) *Tar {
+	return &Tar{tar.NewWriter(w)}
+}
+
+func (t *Tar) Create(name string) (io.WriteCloser, error) {
+	// tar headers give the size of files, so they're written to a temporary file first
+	f, err := ioutil.TempFile("", "backup-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return &tarFile{f, t, name}, nil
+}
+
+func (t *Tar) Close() error {
+	return t.w.Close()
+}
+
+type tarFile struct {
+	*os.File
+	tar  *Tar
+	name string
+}
+
+func (f *tarFile) Close() error {
+	defer f.File.Close()
+
+	size, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.tar.w.WriteHeader(&tar.Header{
+		Name:    f.name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(f.tar.w, f.File)
+	return err
+}
+
+// Extract the files of backup archives in a directory, returning the manifest of the last one.
+// Incremental backups are restored by extracting their archive after the previous ones.
+func ExtractTar(r io.Reader, dir Dir) (*Manifest, error) {
+	if err := os.MkdirAll(string(dir), 0755); err != nil {
+		return nil, err
+	}
+
+	var manifest string
+	t := tar.NewReader(r)
+	for {
+		header, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := header.Name
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return nil, fmt.Errorf("%v: unexpected file %q", Corrupted, name)
+		}
+
+		f, err := dir.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(f, t); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, "manifest-") {
+			manifest = name
+		}
+	}
+
+	if manifest == "" {
+		return nil, fmt.Errorf("%v: no manifest in the archive", Corrupted)
+	}
+	return ReadManifest(filepath.Join(string(dir), manifest))
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+// Where a restore stops. Zero values don't limit the restore.
+type RestoreOptions struct {
+	// The last offset restored.
+	ToOffset uint64
+	// Restore the messages up to the first one after this timestamp.
+	ToTimestamp uint64
+}
+
+// Restore a backup in a new kafka store directory, returning the last offset restored.
+func Restore(m *Manifest, backupDir Dir, storeDir string, options RestoreOptions) (uint64, error) {
+	store := kafka.Open(storeDir, 0)
+	defer store.Close()
+	if segments, err := store.Segments(); err != nil {
+		return 0, err
+	} else if len(segments) != 0 {
+		return 0, fmt.Errorf("%s is not empty", storeDir)
+	}
+
+	lastOffset := m.StartOffset - 1
+	for _, sm := range m.Segments {
+		if options.ToTimestamp != 0 && log.NormalizeTimestamp(sm.MinTimestamp) > log.NormalizeTimestamp(options.ToTimestamp) {
+			break
+		}
+		if options.ToOffset != 0 && sm.StartOffset > options.ToOffset {
+			break
+		}
+
+		segment, err := store.AddSegment(sm.StartOffset)
+		if err != nil {
+			return lastOffset, err
+		}
+		last, done, err := restoreSegment(sm, filepath.Join(string(backupDir), sm.File), segment, options)
+		if err != nil {
+			return lastOffset, fmt.Errorf("segment %d: %v", sm.StartOffset, err)
+		}
+		if last != 0 {
+			lastOffset = last
+		}
+		if done {
+			break
+		}
+	}
+	return lastOffset, nil
+}
+
+// Copy a segment from a backup, returning the last offset copied (0 if none) and whether the
+// restore reached its end.
+func restoreSegment(sm SegmentManifest, fileName string, segment log.Segment, options RestoreOptions) (uint64, bool, error) {
+	if err := checkFile(sm, fileName); err != nil {
+		return 0, false, err
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, false, err
+	}
+	reader := log.NewReader(f, 0, 0)
+	defer reader.Close()
+
+	appender, err := segment.Appender()
+	if err != nil {
+		return 0, false, err
+	}
+
+	lastOffset := uint64(0)
+	done := false
+	for {
+		offset, msg, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			appender.Close()
+			return lastOffset, false, err
+		}
+		if (options.ToOffset != 0 && offset > options.ToOffset) ||
+			(options.ToTimestamp != 0 && log.NormalizeTimestamp(msg.Timestamp) > log.NormalizeTimestamp(options.ToTimestamp)) {
+			done = true
+			break
+		}
+		if _, err := appender.Append(offset, msg); err != nil {
+			appender.Close()
+			return lastOffset, false, err
+		}
+		lastOffset = offset
+	}
+
+	if err := appender.Sync(); err != nil {
+		appender.Close()
+		return lastOffset, false, err
+	}
+	return lastOffset, done, appender.Close()
+}
+
+// Check the size and hash of a backup file.
+func checkFile(sm SegmentManifest, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if size != sm.Size || hex.EncodeToString(hash.Sum(nil)) != sm.SHA256 {
+		return fmt.Errorf("%v: %s doesn't match the manifest", Corrupted, sm.File)
+	}
+	return nil
+}
@@ -38,10 +38,13 @@ func (br *BinaryReader) read(b []byte) bool {
 	if br.err != nil {
 		return false
 	}
-	if _, err := br.Read(b[:]); err != nil {
+	if _, err := io.ReadFull(br.Reader, b); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = UnexpectedEOF
+		}
 		br.err = err
 		return false
-    }
+	}
 	return true
 }
 
@@ -124,3 +127,52 @@ func (bw *BinaryWriter) WriteBytes(b []byte) {
 	}
 	_, bw.err = bw.Write(b)
 }
+
+// Performs reads from a byte slice, unless an error occur.
+// Read bytes are not copied: they share the memory of the slice.
+type sliceReader struct {
+	data []byte
+	err  error
+}
+
+func (sr *sliceReader) next(n int) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	if n > len(sr.data) {
+		sr.err = UnexpectedEOF
+		return nil
+	}
+	b := sr.data[:n:n]
+	sr.data = sr.data[n:]
+	return b
+}
+
+func (sr *sliceReader) readByte() byte {
+	if b := sr.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (sr *sliceReader) readUint32() uint32 {
+	if b := sr.next(4); b != nil {
+		return byteOrder.Uint32(b)
+	}
+	return 0
+}
+
+func (sr *sliceReader) readUint64() uint64 {
+	if b := sr.next(8); b != nil {
+		return byteOrder.Uint64(b)
+	}
+	return 0
+}
+
+func (sr *sliceReader) readBytes() []byte {
+	size := sr.readUint32()
+	if sr.err != nil || size == nilBytesSize {
+		return nil
+	}
+	return sr.next(int(size))
+}
@@ -0,0 +1,288 @@
+package log
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	golog "log"
+	"sort"
+)
+
+// The header holding the hash chaining a message to the previous one (see Config.HashChain).
+//
+// The hash is the SHA-256 of the previous message's hash (zeros if it has none), the offset of
+// the message and the message without this header, as written after its CRC.
+const ChainHeader = "chain-hash"
+
+var (
+	BrokenChain       = errors.New("broken hash chain")
+	BadCheckpoint     = errors.New("invalid chain checkpoint")
+	MissingCheckpoint = errors.New("missing chain checkpoint")
+)
+
+var zeroHash = make([]byte, sha256.Size)
+
+// The hash of a message chained to the previous one. The message must not have its chain header.
+func chainHash(previous []byte, offset uint64, msg *Message) []byte {
+	if previous == nil {
+		previous = zeroHash
+	}
+	h := sha256.New()
+	h.Write(previous)
+	w := NewBinaryWriter(h)
+	w.WriteUint64(offset)
+	msg.writePostCRCTo(w)
+	return h.Sum(nil)
+}
+
+// The hash of the last appended message, if it has one.
+type hashChain struct {
+	offset uint64
+	last   []byte
+}
+
+// A copy of the message with the chain header. The given message is left untouched.
+func (c *hashChain) link(offset uint64, msg *Message) *Message {
+	chained := *msg
+	if chained.Format < 2 {
+		chained.Format = 2
+	}
+	hash := chainHash(c.last, offset, &chained)
+	chained.Headers = make([]Header, len(msg.Headers), len(msg.Headers)+1)
+	copy(chained.Headers, msg.Headers)
+	chained.Headers = append(chained.Headers, Header{ChainHeader, hash})
+	chained.UpdateCRC()
+	return &chained
+}
+
+func (c *hashChain) snapshotName() string {
+	return "chain"
+}
+
+func (c *hashChain) snapshot(nextOffset uint64) []byte {
+	buf := &bytes.Buffer{}
+	w := NewBinaryWriter(buf)
+	w.WriteByte(0)
+	w.WriteUint64(nextOffset)
+	w.WriteUint64(c.offset)
+	w.WriteBytes(c.last)
+	return buf.Bytes()
+}
+
+func (c *hashChain) loadSnapshot(data []byte) (uint64, error) {
+	r := &BinaryReader{bytes.NewReader(data), nil}
+	if version := r.ReadByte(); r.err == nil && version != 0 {
+		return 0, errors.New("unknown chain snapshot version")
+	}
+	nextOffset := r.ReadUint64()
+	c.offset = r.ReadUint64()
+	c.last = r.ReadBytes()
+	return nextOffset, r.err
+}
+
+func (c *hashChain) apply(offset uint64, msg *Message) {
+	c.offset, c.last = offset, msg.Header(ChainHeader)
+}
+
+func (c *hashChain) reset() {
+	c.offset, c.last = 0, nil
+}
+
+// A signed statement of the hash of a segment's message, written as a snapshot of the store.
+//
+// Format:
+//
+//	offset    : 8 bytes
+//	hash      : 32 bytes
+//	signature : 64 bytes (Ed25519, of the segment's start offset followed by the above)
+type checkpoint struct {
+	segmentStart uint64
+	offset       uint64
+	hash         []byte
+	signature    []byte
+}
+
+func checkpointName(segmentStart uint64) string {
+	return fmt.Sprintf("checkpoint-%020d", segmentStart)
+}
+
+func (c *checkpoint) signedData() []byte {
+	buf := &bytes.Buffer{}
+	w := NewBinaryWriter(buf)
+	w.WriteUint64(c.segmentStart)
+	w.WriteUint64(c.offset)
+	buf.Write(c.hash)
+	return buf.Bytes()
+}
+
+func (c *checkpoint) encode() []byte {
+	buf := &bytes.Buffer{}
+	w := NewBinaryWriter(buf)
+	w.WriteUint64(c.offset)
+	buf.Write(c.hash)
+	buf.Write(c.signature)
+	return buf.Bytes()
+}
+
+func decodeCheckpoint(segmentStart uint64, data []byte) (*checkpoint, error) {
+	if len(data) != 8+sha256.Size+ed25519.SignatureSize {
+		return nil, BadCheckpoint
+	}
+	return &checkpoint{
+		segmentStart: segmentStart,
+		offset:       byteOrder.Uint64(data),
+		hash:         data[8 : 8+sha256.Size],
+		signature:    data[8+sha256.Size:],
+	}, nil
+}
+
+// The checkpoint of the active segment, or nil if there's nothing to sign.
+// Called with the write mutex held.
+func (l *Log) activeCheckpoint() *checkpoint {
+	if l.chain == nil || l.config.CheckpointKey == nil || l.chain.last == nil {
+		return nil
+	}
+	start := l.segments[len(l.segments)-1].StartOffset()
+	if l.chain.offset < start {
+		return nil
+	}
+	c := &checkpoint{segmentStart: start, offset: l.chain.offset, hash: l.chain.last}
+	c.signature = ed25519.Sign(l.config.CheckpointKey, c.signedData())
+	return c
+}
+
+// Write a checkpoint, once its messages are synced. Does nothing if c is nil.
+func (l *Log) writeCheckpoint(c *checkpoint) error {
+	snapshots, ok := l.store.(SnapshotStore)
+	if c == nil || !ok {
+		return nil
+	}
+	return snapshots.WriteSnapshot(checkpointName(c.segmentStart), c.encode())
+}
+
+// Report a checkpoint that couldn't be written, when the error can't be returned.
+func (l *Log) checkpointFailed(err error) {
+	l.metrics.checkpointFailures.Add(1)
+	golog.Print("failed to write a chain checkpoint: ", err)
+}
+
+// Check if a periodic checkpoint of the active segment is due after appending offset.
+func (l *Log) checkpointDue(offset uint64) bool {
+	n := uint64(l.config.CheckpointInterval)
+	if l.chain == nil || l.config.CheckpointKey == nil || n == 0 {
+		return false
+	}
+	return (offset-l.segments[len(l.segments)-1].StartOffset()+1)%n == 0
+}
+
+// Verify the hash chain of the messages of a store, and the checkpoints of its segments if
+// publicKey is not nil. Messages before the from offset are not verified, for instance the ones
+// appended before the log was chained, but all the following ones must be chained. With a
+// public key, every segment but the last one must have a checkpoint of its last message, unless
+// it ends before from, and the checkpoint of the last segment, if any, must match one of its
+// messages.
+//
+// Returns the last offset of the log.
+func VerifyChain(store Store, publicKey ed25519.PublicKey, from uint64) (uint64, error) {
+	segments, err := store.Segments()
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(ByStartOffset(segments))
+	snapshots, _ := store.(SnapshotStore)
+	if publicKey != nil && snapshots == nil {
+		return 0, fmt.Errorf("%v: the store has no snapshots", MissingCheckpoint)
+	}
+
+	var previous []byte
+	var lastOffset uint64
+	for i, segment := range segments {
+		start := segment.StartOffset()
+		sealed := i < len(segments)-1
+		if lastOffset != 0 && start != lastOffset+1 {
+			return lastOffset, fmt.Errorf("%v: segment %d doesn't follow offset %d", BrokenChain, start, lastOffset)
+		}
+
+		var c *checkpoint
+		if publicKey != nil {
+			data, err := snapshots.ReadSnapshot(checkpointName(start))
+			if err != nil {
+				return lastOffset, err
+			}
+			if data != nil {
+				if c, err = decodeCheckpoint(start, data); err != nil {
+					return lastOffset, fmt.Errorf("segment %d: %v", start, err)
+				}
+				if !ed25519.Verify(publicKey, c.signedData(), c.signature) {
+					return lastOffset, fmt.Errorf("segment %d: %v: bad signature", start, BadCheckpoint)
+				}
+			}
+		}
+
+		checkpointOffset := uint64(0)
+		if c != nil {
+			checkpointOffset = c.offset
+		}
+		hash, err := verifySegment(segment, &previous, &lastOffset, sealed, from, checkpointOffset)
+		if err != nil {
+			return lastOffset, err
+		}
+
+		switch {
+		case c != nil && !bytes.Equal(hash, c.hash):
+			return lastOffset, fmt.Errorf("segment %d: %v: offset %d doesn't match", start, BadCheckpoint, c.offset)
+		case c != nil && sealed && c.offset != lastOffset:
+			return lastOffset, fmt.Errorf("segment %d: %v: ends at offset %d instead of %d", start, BadCheckpoint, c.offset, lastOffset)
+		case c == nil && sealed && lastOffset >= from && publicKey != nil:
+			return lastOffset, fmt.Errorf("%v: segment %d", MissingCheckpoint, start)
+		}
+	}
+	return lastOffset, nil
+}
+
+// Verify the chain of the messages of a segment from the given offset, returning the hash of the
+// message at the given offset, if any.
+func verifySegment(segment Segment, previous *[]byte, lastOffset *uint64, sealed bool, from, at uint64) ([]byte, error) {
+	reader, err := segment.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var hashAt []byte
+	for {
+		offset, msg, err := reader.Next()
+		if err == io.EOF || (!sealed && err == UnexpectedEOF) {
+			// the torn tail of the active segment is overwritten by the next append
+			return hashAt, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("offset %d: %v", *lastOffset+1, err)
+		}
+		if *lastOffset != 0 && offset != *lastOffset+1 {
+			return nil, fmt.Errorf("%v: offset %d follows offset %d", BrokenChain, offset, *lastOffset)
+		}
+		*lastOffset = offset
+
+		n := len(msg.Headers) - 1
+		if n < 0 || msg.Headers[n].Key != ChainHeader {
+			if offset >= from {
+				return nil, fmt.Errorf("%v: offset %d is not chained", BrokenChain, offset)
+			}
+			*previous = nil
+			continue
+		}
+		hash := msg.Headers[n].Value
+		msg.Headers = msg.Headers[:n]
+		// messages before from are not verified, but the next ones are chained to them
+		if offset >= from && !bytes.Equal(hash, chainHash(*previous, offset, msg)) {
+			return nil, fmt.Errorf("%v: bad hash at offset %d", BrokenChain, offset)
+		}
+		*previous = hash
+		if offset == at {
+			hashAt = hash
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package log
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A test store keeping snapshots in memory.
+type snapshotTestStore struct {
+	*testStore
+	snapshots map[string][]byte
+}
+
+func (s *snapshotTestStore) WriteSnapshot(name string, data []byte) error {
+	s.snapshots[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *snapshotTestStore) ReadSnapshot(name string) ([]byte, error) {
+	return s.snapshots[name], nil
+}
+
+// Rewrite the messages of a segment, dropping the ones for which edit returns nil.
+func editSegment(t *testing.T, segment Segment, edit func(offset uint64, msg *Message) *Message) {
+	fileName := segment.(*testSegment).fileName
+	r, err := segment.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		offset uint64
+		msg    *Message
+	}
+	entries := []entry{}
+	for {
+		offset, msg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if msg = edit(offset, msg); msg != nil {
+			entries = append(entries, entry{offset, msg})
+		}
+	}
+	r.Close()
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, 0, 0)
+	for _, e := range entries {
+		if _, err := w.Append(e.offset, e.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+}
+
+func TestHashChain(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+
+	newStore := func() *snapshotTestStore {
+		return &snapshotTestStore{newTestStore(t), map[string][]byte{}}
+	}
+	fill := func(store Store, from, to int) {
+		l, err := Open(Config{MaxSegmentSize: 200, MaxSyncLag: -1, HashChain: true, CheckpointKey: privateKey, CheckpointInterval: 2}, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		for i := from; i <= to; i++ {
+			if _, err := l.Append(NewMessage(uint64(i), nil, []byte(fmt.Sprint("message ", i)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	segments := func(store Store) []Segment {
+		segments, err := store.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) < 3 {
+			t.Fatal("expected several segments, got ", len(segments))
+		}
+		return segments
+	}
+	expectError := func(store Store, key ed25519.PublicKey, from uint64, expected error) {
+		_, err := VerifyChain(store, key, from)
+		if err == nil || !strings.Contains(err.Error(), expected.Error()) {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+
+	// plain messages followed by chained ones, across reopenings
+	store := newStore()
+	defer store.Remove()
+	l, _ := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, store)
+	l.Append(NewMessage(0, nil, []byte("not chained")))
+	l.Close()
+	fill(store, 2, 10)
+	fill(store, 11, 20)
+
+	last, err := VerifyChain(store, publicKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 20 {
+		t.Error("unexpected last offset: ", last)
+	}
+	expectError(store, otherKey, 2, BadCheckpoint)
+	expectError(store, publicKey, 0, BrokenChain)
+
+	// altered message
+	editSegment(t, segments(store)[1], func(offset uint64, msg *Message) *Message {
+		if offset == segments(store)[1].StartOffset() {
+			msg.Payload = []byte("altered")
+			msg.UpdateCRC()
+		}
+		return msg
+	})
+	expectError(store, nil, 0, BrokenChain)
+
+	// removed message
+	store = newStore()
+	defer store.Remove()
+	fill(store, 1, 20)
+	editSegment(t, segments(store)[1], func(offset uint64, msg *Message) *Message {
+		if offset == segments(store)[1].StartOffset()+1 {
+			return nil
+		}
+		return msg
+	})
+	expectError(store, nil, 0, BrokenChain)
+
+	// removed tail of a sealed segment, with the chain following it
+	store = newStore()
+	defer store.Remove()
+	fill(store, 1, 20)
+	all := segments(store)
+	lastOfFirst := all[1].StartOffset() - 1
+	editSegment(t, all[0], func(offset uint64, msg *Message) *Message {
+		if offset == lastOfFirst {
+			return nil
+		}
+		return msg
+	})
+	store.snapshots[checkpointName(all[0].StartOffset())] = nil
+	expectError(store, publicKey, 0, MissingCheckpoint)
+
+	// removed tail of the active segment
+	store = newStore()
+	defer store.Remove()
+	fill(store, 1, 20)
+	all = segments(store)
+	editSegment(t, all[len(all)-1], func(offset uint64, msg *Message) *Message {
+		if offset == 20 {
+			return nil
+		}
+		return msg
+	})
+	if _, err := VerifyChain(store, nil, 0); err != nil {
+		t.Error("the chain itself can't tell: ", err)
+	}
+	expectError(store, publicKey, 0, BadCheckpoint)
+
+	// torn and corrupted tails of the active segment
+	store = newStore()
+	defer store.Remove()
+	fill(store, 1, 20)
+	all = segments(store)
+	fileName := all[len(all)-1].(*testSegment).fileName
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyChain(store, nil, 0); err != nil {
+		t.Error("torn tail not ignored: ", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectError(store, nil, 0, BadCRC)
+
+	// messages rewritten without their chain, and the checkpoints removed
+	store = newStore()
+	defer store.Remove()
+	fill(store, 1, 20)
+	for _, segment := range segments(store) {
+		editSegment(t, segment, func(offset uint64, msg *Message) *Message {
+			msg.Headers = msg.Headers[:len(msg.Headers)-1]
+			msg.UpdateCRC()
+			return msg
+		})
+	}
+	store.snapshots = map[string][]byte{}
+	expectError(store, nil, 0, BrokenChain)
+	expectError(store, publicKey, 0, BrokenChain)
+
+	// only the checkpoints removed
+	store = newStore()
+	defer store.Remove()
+	fill(store, 1, 20)
+	store.snapshots = map[string][]byte{}
+	if _, err := VerifyChain(store, nil, 0); err != nil {
+		t.Error("the chain itself can't tell: ", err)
+	}
+	expectError(store, publicKey, 0, MissingCheckpoint)
+}
+
+// A test store failing to write checkpoints.
+type failingSnapshotTestStore struct {
+	*snapshotTestStore
+}
+
+func (s failingSnapshotTestStore) WriteSnapshot(name string, data []byte) error {
+	if strings.HasPrefix(name, "checkpoint-") {
+		return errors.New("no space left")
+	}
+	return s.snapshotTestStore.WriteSnapshot(name, data)
+}
+
+func TestCheckpointFailure(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := failingSnapshotTestStore{&snapshotTestStore{newTestStore(t), map[string][]byte{}}}
+	defer store.Remove()
+
+	m := NewMessage(1, nil, []byte("data"))
+	l, err := Open(Config{MaxSegmentSize: int64(8+4+m.Len()) - 1, MaxSyncLag: -1, HashChain: true, CheckpointKey: privateKey}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is stored, but its segment can't be sealed without its checkpoint
+	if offset, err := l.Append(m); err != nil || offset != 1 {
+		t.Fatal("unexpected append: ", offset, err)
+	}
+	if n := len(l.Segments()); n != 1 {
+		t.Error("sealed without a checkpoint, segments: ", n)
+	}
+	if err := l.Close(); err == nil {
+		t.Error("closed without a checkpoint")
+	}
+}
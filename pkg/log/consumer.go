@@ -1,37 +1,275 @@
 package log
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
+var OffsetOutOfRange = errors.New("offset out of range")
+
+// Reads the messages of a log in order. A consumer must not be used concurrently.
 type Consumer struct {
 	log    *Log
 	offset uint64
 	reader SegmentReader
+
+	readCommitted   bool
+	controlMessages bool
+	filter          *Filter
+
+	// the name of the consumer in the metrics, and its gauges
+	name   string
+	gauges *consumerGauges
+
+	// read ahead by a goroutine, when prefetching
+	prefetch   int
+	prefetcher *prefetcher
+	// set under the log's offsetCond lock to stop the prefetcher waiting for new messages
+	stopping bool
+	// when set, stop waiting for new messages at this time
+	deadline time.Time
+	// the delay after each message read, and when the next one can be read
+	throttle       func(size int) time.Duration
+	throttledUntil time.Time
+	// the reader of the segment after the current one, when prefetching
+	nextReader      SegmentReader
+	nextReaderStart uint64
 }
 
+// An option of a consumer, given to Log.Consumer.
+type ConsumerOption func(c *Consumer) error
+
+// Only read messages of committed transactions: messages after the log's last stable offset are
+// held back and messages of aborted transactions are skipped. The log must be transactional.
+func ReadCommitted() ConsumerOption {
+	return func(c *Consumer) error {
+		if c.log.transactions == nil {
+			return NotTransactional
+		}
+		c.readCommitted = true
+		return nil
+	}
+}
+
+// Also read the control messages (transaction markers), for instance to copy the log with its
+// transactions.
+func ControlMessages() ConsumerOption {
+	return func(c *Consumer) error {
+		c.controlMessages = true
+		return nil
+	}
+}
+
+// Name the consumer, or its group, in the metrics: the offset and lag of the last consumer of the
+// name to read are reported by gauges with a consumer label, until they're all closed.
+func ConsumerName(name string) ConsumerOption {
+	return func(c *Consumer) error {
+		c.name = name
+		return nil
+	}
+}
+
+// Limit the rate of the consumer: throttle is given the size of each message read (as written
+// in a segment), and returns how long to wait before reading the next one.
+func Throttle(throttle func(size int) time.Duration) ConsumerOption {
+	return func(c *Consumer) error {
+		c.throttle = throttle
+		return nil
+	}
+}
+
+// Read the next message, waiting for it to be appended if needed.
 func (c *Consumer) Next() (uint64, *Message, error) {
-	c.log.WaitOffset(c.offset)
-	// From here, we know we have this offset in this reader or one of the next
+	c.waitThrottle(-1)
+	if c.prefetch > 0 {
+		return c.throttled(c.nextPrefetched(-1))
+	}
+	return c.throttled(c.read(nil))
+}
+
+// Read the next message like Next, but waiting at most timeout for it to be appended.
+// Returns a nil message if there's none yet.
+func (c *Consumer) NextTimeout(timeout time.Duration) (uint64, *Message, error) {
+	deadline := time.Now().Add(timeout)
+	if !c.waitThrottle(timeout) {
+		return 0, nil, nil
+	}
+	timeout = time.Until(deadline)
+	if timeout < 0 {
+		timeout = 0
+	}
+
+	if c.prefetch > 0 {
+		return c.throttled(c.nextPrefetched(timeout))
+	}
+
+	c.deadline = deadline
+	defer func() { c.deadline = time.Time{} }()
+
+	offset, msg, err := c.read(nil)
+	if err == notReady {
+		return 0, nil, nil
+	}
+	return c.throttled(offset, msg, err)
+}
+
+// Read the next message into msg, like Next, reusing the memory of msg when the segments allow it.
+// The key, payload and header values of msg are only valid until the next call.
+func (c *Consumer) NextInto(msg *Message) (uint64, error) {
+	c.waitThrottle(-1)
+	if c.prefetch > 0 {
+		offset, m, err := c.throttled(c.nextPrefetched(-1))
+		if err != nil {
+			return 0, err
+		}
+		*msg = *m
+		return offset, nil
+	}
+	offset, _, err := c.throttled(c.read(msg))
+	return offset, err
+}
+
+// Wait until the consumer is not throttled anymore, at most timeout if it's not negative.
+// Returns false if it's still throttled.
+func (c *Consumer) waitThrottle(timeout time.Duration) bool {
+	delay := time.Until(c.throttledUntil)
+	if delay <= 0 {
+		return true
+	}
+	if timeout >= 0 && delay > timeout {
+		time.Sleep(timeout)
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// Throttle the consumer after reading a message, if it has a throttle.
+func (c *Consumer) throttled(offset uint64, msg *Message, err error) (uint64, *Message, error) {
+	if c.throttle != nil && msg != nil {
+		c.throttledUntil = time.Now().Add(c.throttle(int(8 + 4 + msg.Len())))
+	}
+	return offset, msg, err
+}
+
+// Read the next message, into the given one if not nil.
+func (c *Consumer) read(into *Message) (uint64, *Message, error) {
 	for {
-		offset, msg, err := c.reader.Next()
+		if !c.wait(c.offset) {
+			return 0, nil, notReady
+		}
+
+		// From here, we know we have this offset in this reader or one of the next
+		offset, msg, err := c.next(into)
 		if err == io.EOF {
 			// it's in the next segment
-			if err := c.setReader(); err != nil {
+			c.log.segmentSwitchMutex.Lock()
+			err := c.setReader()
+			c.log.segmentSwitchMutex.Unlock()
+			if err != nil {
 				return 0, nil, err
 			}
 			continue
 		} else if err != nil {
+			if err == BadCRC {
+				c.log.metrics.crcFailures.Add(1)
+			}
 			return 0, nil, err
 		}
-		if offset >= c.offset {
-			c.offset = offset + 1 // next wait will be for the next offset
-			return offset, msg, nil
+		if offset < c.offset {
+			continue
+		}
+
+		c.offset = offset + 1 // next wait will be for the next offset
+
+		if msg == nil {
+			// rejected by the filter
+			c.log.metrics.filtered.Add(1)
+			continue
 		}
+		if msg.IsControl() && !c.controlMessages {
+			// control messages are for the log, not its consumers
+			continue
+		}
+		if c.readCommitted && msg.IsTransactional() && c.log.transactions.isAborted(msg.ProducerID, offset) {
+			continue
+		}
+
+		c.log.metrics.consumed.Add(1)
+		c.log.metrics.consumedBytes.Add(float64(8 + 4 + msg.Len()))
+		lag := float64(c.log.NextOffset() - c.offset)
+		c.log.metrics.consumerLag.Observe(lag)
+		if c.gauges != nil {
+			c.gauges.offset.Set(float64(c.offset))
+			c.gauges.lag.Set(lag)
+		}
+		return offset, msg, nil
 	}
 }
 
+// Wait for a message at offset to be readable. Returns false if the prefetcher was stopped or
+// the deadline of the consumer is reached.
+func (c *Consumer) wait(offset uint64) bool {
+	ready := func() bool {
+		if c.readCommitted {
+			return c.log.LastStableOffset() > offset
+		}
+		return c.log.NextOffset() > offset
+	}
+	if ready() {
+		return true
+	}
+
+	c.log.offsetCond.L.Lock()
+	defer c.log.offsetCond.L.Unlock()
+
+	timedOut := false
+	if !c.deadline.IsZero() {
+		timeout := time.Until(c.deadline)
+		if timeout <= 0 {
+			return false
+		}
+		timer := time.AfterFunc(timeout, func() {
+			c.log.offsetCond.L.Lock()
+			timedOut = true
+			c.log.offsetCond.Broadcast()
+			c.log.offsetCond.L.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for !ready() {
+		if c.stopping || timedOut {
+			return false
+		}
+		c.log.offsetCond.Wait()
+	}
+	return true
+}
+
+// Read the next message from the current reader, applying the filter if any.
+func (c *Consumer) next(into *Message) (uint64, *Message, error) {
+	if r, ok := c.reader.(ReusingSegmentReader); ok && into != nil && c.filter == nil {
+		offset, err := r.NextInto(into)
+		return offset, into, err
+	}
+	var offset uint64
+	var msg *Message
+	var err error
+	if c.filter != nil {
+		offset, msg, err = nextFiltered(c.reader, c.filter)
+	} else {
+		offset, msg, err = c.reader.Next()
+	}
+	if msg != nil && into != nil {
+		*into = *msg
+		msg = into
+	}
+	return offset, msg, err
+}
+
 func (c *Consumer) setReader() error {
 	if c.reader != nil {
 		c.reader.Close()
@@ -39,19 +277,96 @@ func (c *Consumer) setReader() error {
 	}
 
 	// switch to next segment
-	s := c.log.segmentForOffset(c.offset)
+	s, next := c.log.segmentForOffset(c.offset), c.log.segmentAfter(c.offset)
 	if s == nil {
 		// setReader called on an invalid offset is a hard failure
 		panic(fmt.Errorf("No segment for offset %d", c.offset))
 	}
-	reader, err := s.Reader()
+	for c.filter != nil && next != nil && !c.filter.acceptsSegment(s) {
+		// no message of this segment can be accepted
+		c.offset = next.StartOffset()
+		s, next = next, c.log.segmentAfter(c.offset)
+	}
+	reader, err := c.segmentReader(s)
 	if err != nil {
 		return err
 	}
+	if c.prefetch > 0 && next != nil {
+		// open the next segment before this one is exhausted
+		if c.nextReader, err = c.segmentReader(next); err != nil {
+			reader.Close()
+			return err
+		}
+		c.nextReaderStart = next.StartOffset()
+	}
+	if c.offset > s.StartOffset() {
+		// the offset may not be written yet, Next will wait for it
+		if err := reader.SeekToOffset(c.offset); err != nil && err != io.EOF && err != UnexpectedEOF {
+			reader.Close()
+			return err
+		}
+	}
 	c.reader = reader
 	return nil
 }
 
+// The offset of the next message read by this consumer.
+func (c *Consumer) Position() uint64 {
+	if c.prefetcher != nil {
+		return c.prefetcher.position
+	}
+	return c.offset
+}
+
+// Move this consumer to an offset. The offset must be in the log, or be its next offset.
+func (c *Consumer) Seek(offset uint64) error {
+	if offset < c.log.StartOffset() || offset > c.log.NextOffset() {
+		return OffsetOutOfRange
+	}
+
+	c.stopPrefetch()
+
+	c.log.segmentSwitchMutex.Lock()
+	defer c.log.segmentSwitchMutex.Unlock()
+
+	c.offset = offset
+	return c.setReader()
+}
+
+// Move this consumer to the first message of the log.
+func (c *Consumer) SeekToBeginning() error {
+	return c.Seek(c.log.StartOffset())
+}
+
+// Move this consumer to the end of the log, to only read new messages.
+func (c *Consumer) SeekToEnd() error {
+	return c.Seek(c.log.NextOffset())
+}
+
+// Move this consumer to the first message with a time at or after t.
+// See SeekToTimestamp.
+func (c *Consumer) SeekToTime(t time.Time) error {
+	return c.SeekToTimestamp(Timestamp(t))
+}
+
+// Move this consumer to the first message with a timestamp at or after ts, or to the end of
+// the log if there's none. Segments known to have older messages only are not read.
+func (c *Consumer) SeekToTimestamp(ts uint64) error {
+	offset, err := c.log.offsetForTimestamp(ts, c.log.NextOffset())
+	if err != nil {
+		return err
+	}
+	return c.Seek(offset)
+}
+
 func (c *Consumer) Close() {
+	c.stopPrefetch()
 	c.reader.Close()
+	if c.nextReader != nil {
+		c.nextReader.Close()
+	}
+	c.log.metrics.consumers.Add(-1)
+	if c.gauges != nil {
+		c.log.metrics.closeConsumer(c.name)
+	}
 }
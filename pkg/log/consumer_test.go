@@ -0,0 +1,133 @@
+package log
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
+)
+
+func TestConsumerSeek(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	m := NewMessage(0, nil, []byte("value"))
+	// two messages per segment
+	l, err := Open(Config{MaxSegmentSize: int64(2*(8+4+m.Len()) - 1), MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for ts := uint64(10); ts <= 60; ts += 10 {
+		l.Append(NewMessage(ts, nil, []byte("value")))
+	}
+
+	c, err := l.Consumer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(expected uint64) {
+		if p := c.Position(); p != expected {
+			t.Errorf("bad position: %d != %d", p, expected)
+		}
+		offset, _, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != expected {
+			t.Errorf("bad offset: %d != %d", offset, expected)
+		}
+	}
+
+	expect(1)
+	if err := c.Seek(4); err != nil {
+		t.Fatal(err)
+	}
+	expect(4)
+	expect(5)
+	if err := c.Seek(2); err != nil {
+		t.Fatal(err)
+	}
+	expect(2)
+	if err := c.SeekToTimestamp(35); err != nil {
+		t.Fatal(err)
+	}
+	expect(4)
+	if err := c.SeekToBeginning(); err != nil {
+		t.Fatal(err)
+	}
+	expect(1)
+
+	if err := c.SeekToTimestamp(100); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.Position(); p != l.NextOffset() {
+		t.Errorf("bad position after the last timestamp: %d", p)
+	}
+	if err := c.SeekToEnd(); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.Position(); p != l.NextOffset() {
+		t.Errorf("bad position at the end: %d", p)
+	}
+
+	if err := c.Seek(0); err != OffsetOutOfRange {
+		t.Error("expected OffsetOutOfRange, got ", err)
+	}
+	if err := c.Seek(l.NextOffset() + 1); err != OffsetOutOfRange {
+		t.Error("expected OffsetOutOfRange, got ", err)
+	}
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	registry := metrics.NewPrometheus()
+	l, err := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1, Metrics: registry, MetricsLabels: metrics.Labels{"log": "test"}}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		l.Append(NewMessage(0, nil, []byte("value")))
+	}
+
+	exposition := func() string {
+		w := httptest.NewRecorder()
+		registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	c1, err := l.Consumer(1, ConsumerName("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Consumer(1, ConsumerName("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c1.Next(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`cebaka_log_consumer_offset{consumer="group",log="test"} 2`,
+		`cebaka_log_consumer_lag{consumer="group",log="test"} 2`,
+	} {
+		if body := exposition(); !strings.Contains(body, expected) {
+			t.Errorf("no %q in the metrics:\n%s", expected, body)
+		}
+	}
+
+	c1.Close()
+	if !strings.Contains(exposition(), `consumer="group"`) {
+		t.Error("gauges removed while a consumer of the name is open")
+	}
+	c2.Close()
+	if body := exposition(); strings.Contains(body, `consumer="group"`) {
+		t.Errorf("gauges not removed:\n%s", body)
+	}
+}
@@ -0,0 +1,124 @@
+package log
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// Selects the messages read by a consumer.
+//
+// The key, timestamp and attributes conditions are checked before the payload is read, so
+// rejected messages don't allocate it. The headers and the predicate need the whole message.
+// Zero values mean no condition.
+type Filter struct {
+	// The key must start with this prefix.
+	KeyPrefix []byte
+	// The key must match this expression.
+	KeyRegexp *regexp.Regexp
+	// The timestamp must be in [MinTimestamp, MaxTimestamp].
+	MinTimestamp uint64
+	MaxTimestamp uint64
+	// The attributes bits in AttributesMask must equal the ones of Attributes.
+	AttributesMask byte
+	Attributes     byte
+	// The message must have these headers (with any value when the header's value is nil).
+	Headers []Header
+	// The message must be accepted by this function.
+	Predicate func(msg *Message) bool
+}
+
+// Only read messages accepted by the filter. Rejected messages are skipped while decoding them
+// and, when the segments know their timestamp bounds, segments out of the filter's time range
+// are skipped.
+func WithFilter(filter *Filter) ConsumerOption {
+	return func(c *Consumer) error {
+		c.filter = filter
+		return nil
+	}
+}
+
+// Optionally implemented by segment readers able to filter messages while decoding them.
+type FilteringSegmentReader interface {
+	// Read the next message, returning a nil message if it's rejected by the filter.
+	NextFiltered(filter *Filter) (uint64, *Message, error)
+}
+
+// Optionally implemented by segments knowing the bounds of their messages' timestamps.
+type TimeIndexedSegment interface {
+	// The lowest and highest timestamps of the segment's messages.
+	// Returns false if they're not known, for instance if the segment is still appended to.
+	TimestampBounds() (min, max uint64, ok bool)
+}
+
+// Check if a segment may have messages accepted by the filter.
+func (f *Filter) acceptsSegment(s Segment) bool {
+	if f.MinTimestamp == 0 && f.MaxTimestamp == 0 {
+		return true
+	}
+	indexed, ok := s.(TimeIndexedSegment)
+	if !ok {
+		return true
+	}
+	min, max, ok := indexed.TimestampBounds()
+	return !ok || f.acceptsTimestamps(min, max)
+}
+
+// Read the next message of a segment, returning a nil message if it's rejected by the filter.
+func nextFiltered(reader SegmentReader, filter *Filter) (uint64, *Message, error) {
+	if r, ok := reader.(FilteringSegmentReader); ok {
+		return r.NextFiltered(filter)
+	}
+	offset, msg, err := reader.Next()
+	if err == nil && !filter.Accepts(msg) {
+		msg = nil
+	}
+	return offset, msg, err
+}
+
+// Check the fields read before the payload.
+func (f *Filter) acceptsHead(msg *Message) bool {
+	if f.KeyPrefix != nil && !bytes.HasPrefix(msg.Key, f.KeyPrefix) {
+		return false
+	}
+	if f.KeyRegexp != nil && !f.KeyRegexp.Match(msg.Key) {
+		return false
+	}
+	if !f.acceptsTimestamps(msg.Timestamp, msg.Timestamp) {
+		return false
+	}
+	return msg.Attributes&f.AttributesMask == f.Attributes&f.AttributesMask
+}
+
+// Check if a message with a timestamp in [min, max] may be accepted.
+// Timestamps in seconds of older messages are compared as milliseconds.
+func (f *Filter) acceptsTimestamps(min, max uint64) bool {
+	if NormalizeTimestamp(max) < NormalizeTimestamp(f.MinTimestamp) {
+		return false
+	}
+	if f.MaxTimestamp != 0 && NormalizeTimestamp(min) > NormalizeTimestamp(f.MaxTimestamp) {
+		return false
+	}
+	return true
+}
+
+// Check the fields read after the payload.
+func (f *Filter) acceptsBody(msg *Message) bool {
+	for _, h := range f.Headers {
+		found := false
+		for _, mh := range msg.Headers {
+			if mh.Key == h.Key && (h.Value == nil || bytes.Equal(mh.Value, h.Value)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.Predicate == nil || f.Predicate(msg)
+}
+
+// Check if the filter accepts a message.
+func (f *Filter) Accepts(msg *Message) bool {
+	return f.acceptsHead(msg) && f.acceptsBody(msg)
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestConsumerFilter(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	l, err := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Append(NewMessage(10, []byte("a-1"), []byte("v1")))
+	l.Append(NewMessage(20, []byte("b-1"), []byte("v2")))
+	l.Append(NewMessageWithHeaders(30, []byte("a-2"), []byte("v3"), []Header{{"type", []byte("x")}}))
+	l.Append(NewMessageWithHeaders(40, []byte("a-3"), []byte("v4"), []Header{{"type", []byte("y")}}))
+	l.Append(NewMessageWithHeaders(50, []byte("a-4"), []byte("v5"), []Header{{"type", []byte("y")}}))
+
+	for _, test := range []struct {
+		filter  Filter
+		offsets []uint64
+	}{
+		{Filter{KeyPrefix: []byte("a")}, []uint64{1, 3, 4, 5}},
+		{Filter{KeyRegexp: regexp.MustCompile("-[13]$")}, []uint64{1, 2, 4}},
+		{Filter{MinTimestamp: 20, MaxTimestamp: 40}, []uint64{2, 3, 4}},
+		{Filter{Headers: []Header{{"type", nil}}}, []uint64{3, 4, 5}},
+		{Filter{Headers: []Header{{"type", []byte("y")}}}, []uint64{4, 5}},
+		{Filter{Predicate: func(m *Message) bool { return string(m.Payload) == "v5" }}, []uint64{5}},
+	} {
+		c, err := l.Consumer(1, WithFilter(&test.filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range test.offsets {
+			offset, msg, err := c.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != expected || msg == nil {
+				t.Errorf("%+v: expected offset %d, got %d", test.filter, expected, offset)
+			}
+		}
+		c.Close()
+	}
+}
+
+// A segment with known timestamp bounds, counting its readers.
+type boundedSegment struct {
+	Segment
+	min, max uint64
+	readers  *int
+}
+
+func (s boundedSegment) TimestampBounds() (uint64, uint64, bool) {
+	return s.min, s.max, true
+}
+
+func (s boundedSegment) Reader() (SegmentReader, error) {
+	*s.readers++
+	return s.Segment.Reader()
+}
+
+type boundedStore struct {
+	*testStore
+	readers map[uint64]*int
+}
+
+func (s boundedStore) Segments() ([]Segment, error) {
+	segments, err := s.testStore.Segments()
+	for i, segment := range segments {
+		segments[i] = s.bounded(segment)
+	}
+	return segments, err
+}
+
+func (s boundedStore) AddSegment(startOffset uint64) (Segment, error) {
+	segment, err := s.testStore.AddSegment(startOffset)
+	if err != nil {
+		return nil, err
+	}
+	return s.bounded(segment), nil
+}
+
+// Each message is in its own segment, with the offset as timestamp.
+func (s boundedStore) bounded(segment Segment) Segment {
+	offset := segment.StartOffset()
+	s.readers[offset] = new(int)
+	return boundedSegment{segment, offset, offset, s.readers[offset]}
+}
+
+func TestFilterSkipsSegments(t *testing.T) {
+	store := boundedStore{newTestStore(t), map[uint64]*int{}}
+	defer store.Remove()
+
+	l, err := Open(Config{MaxSegmentSize: 1, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for ts := uint64(1); ts <= 5; ts++ {
+		l.Append(NewMessage(ts, nil, []byte("value")))
+	}
+	for _, n := range store.readers {
+		*n = 0 // opening the log reads the last segment
+	}
+
+	c, err := l.Consumer(1, WithFilter(&Filter{MinTimestamp: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	offset, _, err := c.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 4 {
+		t.Error("unexpected offset: ", offset)
+	}
+	for o := uint64(1); o < 4; o++ {
+		if n := *store.readers[o]; n != 0 {
+			t.Errorf("segment %d read %d times", o, n)
+		}
+	}
+}
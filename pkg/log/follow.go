@@ -0,0 +1,211 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Interval at which a following log checks its store when the config doesn't give one.
+const defaultFollowInterval = time.Second
+
+// Reads the messages appended to the store of a following log by another process.
+type follower struct {
+	segment Segment
+	reader  SegmentReader
+	// the last error reading the store, if any
+	err error
+
+	changed chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Start following the store from the last segment, whose messages before the log's next offset are known.
+func (l *Log) startFollowing(segment Segment) error {
+	reader, err := segment.Reader()
+	if err != nil {
+		return err
+	}
+	if err := reader.SeekToOffset(l.nextOffset); err != nil && err != io.EOF && err != UnexpectedEOF && err != BadCRC {
+		reader.Close()
+		return err
+	}
+
+	f := &follower{
+		segment: segment,
+		reader:  reader,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if watching, ok := l.store.(WatchingStore); ok {
+		// without notifications, the store is only polled
+		watching.Watch(f.notify, f.stop)
+	}
+	l.follower = f
+	go l.follow(f)
+	return nil
+}
+
+func (f *follower) notify() {
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Log) follow(f *follower) {
+	defer close(f.done)
+
+	interval := l.config.FollowInterval
+	if interval <= 0 {
+		interval = defaultFollowInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-f.changed:
+		case <-ticker.C:
+		}
+		fatal, err := l.catchUp(f)
+
+		l.writeMutex.Lock()
+		f.err = err
+		l.writeMutex.Unlock()
+		if fatal {
+			// the segment can't be read further, following it would skip messages
+			return
+		}
+	}
+}
+
+// Read the messages appended to the store since the last call, moving to the next segments
+// once the current one is complete. Errors reading the messages are fatal, the others are retried.
+func (l *Log) catchUp(f *follower) (bool, error) {
+	for {
+		if err := l.readFollowed(f); err != nil {
+			return true, err
+		}
+
+		segments, err := l.store.Segments()
+		if err != nil {
+			return false, err
+		}
+		if len(segments) == 0 {
+			// removed, or being replaced
+			return false, nil
+		}
+		sort.Sort(ByStartOffset(segments))
+
+		l.segmentSwitchMutex.Lock()
+		lastStart := l.segments[len(l.segments)-1].StartOffset()
+		l.segments = segments
+		l.segmentSwitchMutex.Unlock()
+		l.metrics.segments.Set(float64(len(segments)))
+		for _, segment := range segments {
+			if segment.StartOffset() > lastStart {
+				l.observers.push(event{kind: segmentCreatedEvent, segment: segment})
+			}
+		}
+
+		var next Segment
+		for _, segment := range segments {
+			if segment.StartOffset() > f.segment.StartOffset() {
+				next = segment
+				break
+			}
+		}
+		// the writer starts a segment after the last message of the previous one
+		if next == nil || l.nextOffset < next.StartOffset() {
+			return false, nil
+		}
+
+		reader, err := next.Reader()
+		if err != nil {
+			return false, err
+		}
+		f.reader.Close()
+		l.observers.push(event{kind: segmentSealedEvent, segment: f.segment})
+		f.segment, f.reader = next, reader
+
+		l.writeMutex.Lock()
+		l.sealedBytes += l.activeBytes
+		l.activeBytes = 0
+		l.expireStates()
+		l.writeMutex.Unlock()
+	}
+}
+
+// Read the complete and valid messages of the current segment, and make them visible to the consumers.
+func (l *Log) readFollowed(f *follower) error {
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+
+	nextOffset := l.nextOffset
+	defer func() {
+		if nextOffset == l.nextOffset {
+			return
+		}
+		l.activeBytes = f.reader.Position()
+		l.metrics.activeBytes.Set(float64(l.activeBytes))
+		l.metrics.bytes.Set(float64(l.sealedBytes + l.activeBytes))
+
+		l.offsetCond.L.Lock()
+		atomic.StoreUint64(&l.nextOffset, nextOffset)
+		l.offsetCond.Broadcast()
+		l.offsetCond.L.Unlock()
+
+		// the messages are written, even if the writer didn't sync them yet
+		l.syncOffsetCond.L.Lock()
+		l.syncOffset = nextOffset - 1
+		l.syncOffsetCond.Broadcast()
+		l.syncOffsetCond.L.Unlock()
+
+		l.metrics.offsets(l.nextOffset, l.syncOffset)
+	}()
+
+	for {
+		offset, msg, err := f.reader.Next()
+		if err == io.EOF || err == UnexpectedEOF || err == BadCRC {
+			// the end of the segment, or a message still being written
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if offset < nextOffset {
+			// offsets only increase, with gaps in compacted Kafka partitions (see kafka.NativeStore)
+			return fmt.Errorf("%d: unexpected offset in segment %d, expected %d or more", offset, f.segment.StartOffset(), nextOffset)
+		}
+		for _, state := range l.states {
+			state.apply(offset, msg)
+		}
+		nextOffset = offset + 1
+		l.observers.push(event{kind: appendedEvent, first: offset, last: offset})
+	}
+}
+
+// Stop following the store.
+func (l *Log) stopFollowing() {
+	f := l.follower
+	close(f.stop)
+	<-f.done
+	f.reader.Close()
+}
+
+// The last error of a following log reading its store, or nil if the last read succeeded.
+// Errors reading the store are retried, but invalid messages stop the log from following it.
+func (l *Log) FollowError() error {
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+	if l.follower == nil {
+		return nil
+	}
+	return l.follower.err
+}
@@ -0,0 +1,170 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitNextOffset(t *testing.T, l *Log, offset uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for l.NextOffset() != offset {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected next offset %d, got %d", offset, l.NextOffset())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	w, err := Open(Config{MaxSegmentSize: 100, MaxSyncLag: 0}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Append(NewMessage(1, nil, []byte("a")))
+
+	r, err := Open(Config{ReadOnly: true, Follow: true, FollowInterval: 10 * time.Millisecond}, readOnlyTestStore{store, t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	c, err := r.Consumer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// appends by the writer wake the follower's consumers, across segments
+	go func() {
+		for i := 0; i < 20; i++ {
+			w.Append(NewMessage(uint64(2+i), nil, bytes.Repeat([]byte("b"), 20)))
+		}
+	}()
+	for expected := uint64(2); expected <= 21; expected++ {
+		offset, msg, err := c.NextTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil {
+			t.Fatalf("no message at offset %d", expected)
+		}
+		if offset != expected || msg.Timestamp != offset {
+			t.Fatalf("unexpected message at offset %d: %d %v", expected, offset, msg)
+		}
+	}
+	waitSegments(t, r, len(w.Segments()))
+	if err := r.FollowError(); err != nil {
+		t.Error(err)
+	}
+
+	// messages being written are not visible until they're complete
+	segment := writeTestSegment(t, NewMessage(22, nil, []byte("c")))
+	raw, err := ioutil.ReadAll(segment)
+	segment.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byteOrder.PutUint64(raw, 22)
+
+	segments := w.Segments()
+	w.Close()
+	name := segments[len(segments)-1].(*testSegment).fileName
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(raw[:len(raw)-1])
+	time.Sleep(50 * time.Millisecond)
+	if r.NextOffset() != 22 {
+		t.Error("incomplete message followed, next offset: ", r.NextOffset())
+	}
+	f.Write(raw[len(raw)-1:])
+	waitNextOffset(t, r, 23)
+	if _, msg, err := c.Next(); err != nil || string(msg.Payload) != "c" {
+		t.Error("unexpected message: ", msg, err)
+	}
+}
+
+// A store notifying the changes made with its log.
+type watchingTestStore struct {
+	*testStore
+	changed chan func()
+}
+
+func (s watchingTestStore) Watch(changed func(), stop <-chan struct{}) error {
+	s.changed <- changed
+	return nil
+}
+
+func TestFollowWatch(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	w, err := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: 0}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	watching := watchingTestStore{store, make(chan func(), 1)}
+	r, err := Open(Config{ReadOnly: true, Follow: true, FollowInterval: time.Hour}, watching)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	changed := <-watching.changed
+
+	w.Append(NewMessage(1, nil, []byte("a")))
+	time.Sleep(20 * time.Millisecond)
+	if r.NextOffset() != 1 {
+		t.Error("followed without a change, next offset: ", r.NextOffset())
+	}
+	changed()
+	waitNextOffset(t, r, 2)
+}
+
+func TestFollowInvalidOffset(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	w, err := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: 0}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(NewMessage(1, nil, []byte("a")))
+	w.Close()
+
+	r, err := Open(Config{ReadOnly: true, Follow: true, FollowInterval: 10 * time.Millisecond}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// a message with an offset already read stops the follower
+	segments := r.Segments()
+	name := segments[0].(*testSegment).fileName
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, append(data, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.FollowError() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no follow error")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.NextOffset() != 2 {
+		t.Error("unexpected next offset: ", r.NextOffset())
+	}
+}
@@ -1,13 +1,85 @@
 package log
 
 import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	golog "log"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
+)
+
+var (
+	ReadOnly   = errors.New("read-only log")
+	NoSegments = errors.New("no segments in the store")
+
+	TimestampOutOfRange = errors.New("message timestamp too far from the log's time")
 )
 
 type Config struct {
 	MaxSegmentSize int64
 	MaxSyncLag     int
+
+	// Where to report metrics, and the labels identifying the log (only used by Open).
+	Metrics       metrics.Registry
+	MetricsLabels metrics.Labels
+
+	// Observers registered when opening the log (only used by Open).
+	Observers []Observer
+
+	// Deduplicate appends of messages having a producer id and sequence (only used by Open).
+	Idempotent bool
+	// Number of recent segments scanned to rebuild the producers table when there's no snapshot (0: all).
+	ProducerStateSegments int
+	// Forget the producers whose last message is older than this (0: never), by the timestamps of
+	// their messages. Producers and aborted transactions before the start of the log are always
+	// forgotten, when opening it and when rolling a segment.
+	ProducerExpiry time.Duration
+
+	// Track the transactions of producers, for the last stable offset and read committed consumers (only used by Open).
+	Transactional bool
+
+	// Called before appending a message (but not control messages). An error rejects the append.
+	Validate func(message *Message) error
+
+	// Roll the active segment once it's older than this (0: no limit), on the next append or from a
+	// timer. The age of a segment starts with its first message.
+	MaxSegmentAge time.Duration
+	// Roll segments up to this much earlier, randomly, so logs opened together don't roll together.
+	MaxSegmentAgeJitter time.Duration
+
+	// Preallocate MaxSegmentSize bytes for the segments created in advance (see PreparingStore).
+	PreallocateSegments bool
+
+	// Chain each appended message to the previous one with a hash (see ChainHeader), so altered or
+	// removed messages are detected by VerifyChain (only used by Open).
+	HashChain bool
+	// Sign checkpoints of the hash chain of each segment with this key, when it's sealed, when
+	// the log is closed, and every CheckpointInterval messages (0: only then). Checkpoints are
+	// written as snapshots, so the store must be a SnapshotStore.
+	CheckpointKey      ed25519.PrivateKey
+	CheckpointInterval int
+
+	// Open the log without writing to the store, for instance to read a log written by another
+	// process: Append returns ReadOnly and the segments' appenders are never used (only used by Open).
+	ReadOnly bool
+	// With ReadOnly, follow the messages appended to the store by another process: the store is
+	// watched when it's a WatchingStore, and checked every FollowInterval (default: 1s) anyway.
+	// Only complete and valid messages are made visible to the consumers (only used by Open).
+	Follow         bool
+	FollowInterval time.Duration
+
+	// The timestamp of the appended messages: the one given by their producer (CreateTime), or
+	// the time they're appended at from Clock (LogAppendTime, default: the system's clock).
+	TimestampType TimestampType
+	Clock         Clock
+	// With CreateTime, reject the messages with a timestamp further than this from the time of
+	// Clock (0: no limit). Messages without a timestamp are accepted.
+	MaxTimestampDelta time.Duration
 }
 
 type Log struct {
@@ -16,10 +88,40 @@ type Log struct {
 	store    Store
 	segments []Segment
 	appender SegmentAppender
+	readOnly bool
 
 	nextOffset uint64
 	syncOffset uint64
 
+	// bytes in the segments before the active one, and in the active one
+	sealedBytes int64
+	activeBytes int64
+	metrics     *logMetrics
+	observers   *observers
+
+	// recent appends by producer id, when idempotent
+	producers producers
+	// open and aborted transactions, when transactional
+	transactions *transactions
+	// hash of the last message, when chained
+	chain *hashChain
+	// reads the messages appended by another process, when following
+	follower *follower
+	// states derived from messages (producers, transactions)
+	states []logState
+
+	// when the active segment got its first message, and when it must be rolled (zero if not)
+	segmentStart time.Time
+	rollAt       time.Time
+	rollTimer    *time.Timer
+	closed       bool
+
+	// the next segment, prepared in the background when the store supports it
+	preparing        chan preparedSegment
+	preparingPending bool
+	// closed when the segments being sealed in the background are
+	sealed chan struct{}
+
 	writeMutex         sync.Mutex
 	segmentSwitchMutex sync.Mutex
 
@@ -33,14 +135,19 @@ func Open(config Config, store Store) (*Log, error) {
 	if err != nil {
 		return nil, err
 	}
+	observers := newObservers(config.Observers)
+
 	var nextOffset uint64 = 1
-	if len(segments) == 0 {
+	if len(segments) == 0 && config.ReadOnly {
+		return nil, NoSegments
+	} else if len(segments) == 0 {
 		// new store
 		segment, err := store.AddSegment(1)
 		if err != nil {
 			return nil, err
 		}
 		segments = append(segments, segment)
+		observers.push(event{kind: segmentCreatedEvent, segment: segment})
 	}
 
 	sort.Sort(ByStartOffset(segments))
@@ -52,13 +159,25 @@ func Open(config Config, store Store) (*Log, error) {
 	}
 	defer reader.Close()
 	lastOffset, err := reader.SeekToEnd()
-	if err != nil {
+	if err == UnexpectedEOF || err == BadCRC {
+		// the appender will write over the invalid tail, or the writer is appending it
+		if !config.ReadOnly {
+			observers.push(event{kind: tailRecoveredEvent, segment: segment, last: lastOffset, position: reader.Position()})
+		}
+	} else if err != nil {
 		return nil, err
 	}
-	nextOffset = lastOffset + 1
-	appender, err := segment.Appender()
-	if err != nil {
-		return nil, err
+	if lastOffset == 0 {
+		// empty segment
+		nextOffset = segment.StartOffset()
+	} else {
+		nextOffset = lastOffset + 1
+	}
+	var appender SegmentAppender
+	if !config.ReadOnly {
+		if appender, err = segment.Appender(); err != nil {
+			return nil, err
+		}
 	}
 
 	l := &Log{
@@ -70,16 +189,134 @@ func Open(config Config, store Store) (*Log, error) {
 		store:    store,
 		segments: segments,
 		appender: appender,
+		readOnly: config.ReadOnly,
 
 		offsetCond:     sync.NewCond(&sync.Mutex{}),
 		syncOffsetCond: sync.NewCond(&sync.Mutex{}),
+
+		metrics:   newLogMetrics(config.Metrics, config.MetricsLabels),
+		observers: observers,
+
+		preparing: make(chan preparedSegment, 1),
 	}
 
+	for i, s := range segments {
+		sized, ok := s.(SizedSegment)
+		if !ok {
+			continue
+		}
+		size, err := sized.Size()
+		if err != nil {
+			continue
+		}
+		if i == len(segments)-1 {
+			l.activeBytes = size
+		} else {
+			l.sealedBytes += size
+		}
+	}
+	l.metrics.segments.Set(float64(len(segments)))
+	l.metrics.activeBytes.Set(float64(l.activeBytes))
+	l.metrics.bytes.Set(float64(l.sealedBytes + l.activeBytes))
+	l.metrics.offsets(l.nextOffset, l.syncOffset)
+
+	scanFrom := make([]uint64, 0, 2)
+	if config.Idempotent {
+		l.producers = producers{}
+		l.states = append(l.states, l.producers)
+		from := segments[0].StartOffset()
+		if n := config.ProducerStateSegments; n > 0 && n < len(segments) {
+			from = segments[len(segments)-n].StartOffset()
+		}
+		scanFrom = append(scanFrom, from)
+	}
+	if config.Transactional {
+		l.transactions = newTransactions()
+		l.states = append(l.states, l.transactions)
+		scanFrom = append(scanFrom, segments[0].StartOffset())
+	}
+	if config.HashChain {
+		l.chain = &hashChain{}
+		l.states = append(l.states, l.chain)
+		// the last segment may be empty, the previous one has the last hash then
+		from := segments[0].StartOffset()
+		if len(segments) > 1 {
+			from = segments[len(segments)-2].StartOffset()
+		}
+		scanFrom = append(scanFrom, from)
+	}
+	if len(l.states) != 0 {
+		if err := l.loadStates(l.states, scanFrom); err != nil {
+			if appender != nil {
+				appender.Close()
+			}
+			return nil, err
+		}
+		l.expireStates()
+	}
+
+	if config.ReadOnly {
+		if config.Follow {
+			if err := l.startFollowing(segment); err != nil {
+				return nil, err
+			}
+		}
+		observers.start()
+		return l, nil
+	}
+	if nextOffset > segment.StartOffset() {
+		l.startSegmentAge(firstMessageTime(segment))
+	}
+	l.prepareSegment()
+	observers.start()
 	return l, nil
 }
 
 func (l *Log) NextOffset() uint64 {
-	return l.nextOffset
+	return atomic.LoadUint64(&l.nextOffset)
+}
+
+// The last offset synced by this log.
+func (l *Log) SyncOffset() uint64 {
+	l.syncOffsetCond.L.Lock()
+	defer l.syncOffsetCond.L.Unlock()
+	return l.syncOffset
+}
+
+// The current segments of this log, oldest first.
+func (l *Log) Segments() []Segment {
+	l.segmentSwitchMutex.Lock()
+	defer l.segmentSwitchMutex.Unlock()
+	return append([]Segment{}, l.segments...)
+}
+
+// The current segments of this log and its last synced offset, read together: the synced messages
+// are in these segments, even if a new one is being added. The segments before the last one are
+// synced, waiting for the ones being sealed in the background if needed.
+func (l *Log) SyncedSegments() ([]Segment, uint64) {
+	for {
+		l.segmentSwitchMutex.Lock()
+		if sealed := l.sealed; sealed != nil {
+			select {
+			case <-sealed:
+			default:
+				l.segmentSwitchMutex.Unlock()
+				<-sealed
+				continue
+			}
+		}
+		segments := append([]Segment{}, l.segments...)
+		syncOffset := l.SyncOffset()
+		l.segmentSwitchMutex.Unlock()
+		return segments, syncOffset
+	}
+}
+
+// The first offset available in this log.
+func (l *Log) StartOffset() uint64 {
+	l.segmentSwitchMutex.Lock()
+	defer l.segmentSwitchMutex.Unlock()
+	return l.segments[0].StartOffset()
 }
 
 // Wait for this log to reach an offset of at least minOffset.
@@ -95,12 +332,34 @@ func (l *Log) WaitOffset(minOffset uint64) {
 	// also, since offsets are integers
 	// (2) <=> nextOffset > minOffset
 
-	if l.nextOffset > minOffset {
+	if l.NextOffset() > minOffset {
 		return
 	}
 
 	l.offsetCond.L.Lock()
-	for l.nextOffset < minOffset+1 {
+	for l.NextOffset() < minOffset+1 {
+		l.offsetCond.Wait()
+	}
+	l.offsetCond.L.Unlock()
+}
+
+// The offset of the first message of the oldest open transaction, or the next offset if there's none.
+// Read committed consumers only read messages before this offset.
+func (l *Log) LastStableOffset() uint64 {
+	if l.transactions == nil {
+		return l.NextOffset()
+	}
+	return l.transactions.stableOffset(l.NextOffset())
+}
+
+// Wait for this log's last stable offset to be after minOffset.
+func (l *Log) WaitStableOffset(minOffset uint64) {
+	if l.LastStableOffset() > minOffset {
+		return
+	}
+
+	l.offsetCond.L.Lock()
+	for l.LastStableOffset() <= minOffset {
 		l.offsetCond.Wait()
 	}
 	l.offsetCond.L.Unlock()
@@ -119,34 +378,108 @@ func (l *Log) WaitSyncOffset(minOffset uint64) {
 	}
 }
 
-// Append a message to this log
+// Append a message to this log.
+//
+// When the log is idempotent and the message has a producer, a message already appended by
+// this producer returns the offset of the original message without being appended again.
 func (l *Log) Append(message *Message) (uint64, error) {
+	t0 := time.Now()
+	defer metrics.ObserveSince(l.metrics.appendLatency, t0)
+
 	l.writeMutex.Lock()
 	defer l.writeMutex.Unlock()
 
-	offset := l.nextOffset
-	sizeAfterAppend, err := l.appender.Append(offset, message)
+	if l.readOnly {
+		return 0, ReadOnly
+	}
+	if l.config.Validate != nil && !message.IsControl() {
+		if err := l.config.Validate(message); err != nil {
+			l.metrics.rejected.Add(1)
+			return 0, err
+		}
+	}
+	message, err := l.timestamp(message)
 	if err != nil {
+		l.metrics.rejected.Add(1)
 		return 0, err
 	}
 
-	if sizeAfterAppend > l.config.MaxSegmentSize {
-		if err := l.switchSegment(); err != nil {
+	if l.producers != nil && message.HasProducer() && !message.IsControl() {
+		originalOffset, duplicate, err := l.producers.check(message)
+		if err != nil {
 			return 0, err
 		}
+		if duplicate {
+			l.metrics.duplicates.Add(1)
+			return originalOffset, nil
+		}
 	}
 
+	if l.appender == nil || l.segmentTooOld() {
+		// no appender when the last roll sealed the active segment but failed to add the next one
+		if err := l.rollSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	offset := l.nextOffset
+	if l.chain != nil {
+		message = l.chain.link(offset, message)
+	}
+	sizeAfterAppend, err := l.appender.Append(offset, message)
+	if err != nil {
+		return 0, err
+	}
+	// update the states before the offset is visible to consumers
+	for _, state := range l.states {
+		state.apply(offset, message)
+	}
+
+	l.metrics.appends.Add(1)
+	l.metrics.appendedBytes.Add(float64(8 + 4 + message.Len()))
+	l.activeBytes = sizeAfterAppend
+	l.metrics.activeBytes.Set(float64(sizeAfterAppend))
+	l.metrics.bytes.Set(float64(l.sealedBytes + sizeAfterAppend))
+
 	l.offsetCond.L.Lock()
-	l.nextOffset++
+	atomic.AddUint64(&l.nextOffset, 1)
 	l.offsetCond.Broadcast()
 	l.offsetCond.L.Unlock()
+	l.observers.push(event{kind: appendedEvent, first: offset, last: offset})
 	//log.Printf("l.nextOffset is now %d", l.nextOffset)
 
+	if l.checkpointDue(offset) {
+		// a checkpoint must not claim messages that could be lost
+		l.Sync()
+		if err := l.writeCheckpoint(l.activeCheckpoint()); err != nil {
+			// the message is stored
+			l.checkpointFailed(err)
+		}
+	}
+
+	// the new segment starts after the message we just appended
+	if sizeAfterAppend > l.config.MaxSegmentSize {
+		if err := l.rollSegment(); err != nil {
+			// the message is stored, the next append rolls the segment again
+			l.metrics.rollFailures.Add(1)
+			golog.Print("failed to roll the segment: ", err)
+		}
+	} else if l.segmentStart.IsZero() {
+		// first message of the segment
+		l.startSegmentAge(time.Now())
+	}
+
 	// TODO more async "sync" support?
 	if l.config.MaxSyncLag >= 0 && (offset-l.syncOffset) > uint64(l.config.MaxSyncLag) {
 		l.Sync()
 	}
 
+	l.metrics.offsets(l.nextOffset, l.syncOffset)
+	if l.transactions != nil {
+		l.metrics.stableOffset.Set(float64(l.LastStableOffset()))
+		l.metrics.openTransactions.Set(float64(l.transactions.openCount()))
+	}
+
 	return offset, nil
 }
 
@@ -154,38 +487,85 @@ func (l *Log) switchSegment() error {
 	l.segmentSwitchMutex.Lock()
 	defer l.segmentSwitchMutex.Unlock()
 
+	prepared := l.takePreparedSegment()
 	if l.appender != nil {
-		l.appender.Sync()
-		l.appender.Close()
+		checkpoint := l.activeCheckpoint()
+		if prepared != nil {
+			// the store doesn't block the roll, the previous segment doesn't either
+			l.sealInBackground(l.appender, l.segments[len(l.segments)-1], checkpoint)
+		} else {
+			l.appender.Sync()
+			if err := l.writeCheckpoint(checkpoint); err != nil {
+				// the segment stays active, its checkpoint is written again by the next roll
+				return err
+			}
+			l.appender.Close()
+			l.observers.push(event{kind: segmentSealedEvent, segment: l.segments[len(l.segments)-1]})
+		}
 		l.appender = nil
 	}
 
-	segment, err := l.store.AddSegment(l.nextOffset)
+	var segment Segment
+	var appender SegmentAppender
+	var err error
+	if prepared != nil {
+		if segment, appender, err = prepared.Add(l.nextOffset); err != nil {
+			// the store adds the segment instead
+			prepared.Discard()
+			prepared = nil
+		}
+	}
+	if prepared == nil {
+		segment, err = l.store.AddSegment(l.nextOffset)
+	}
 	if err != nil {
 		return err
 	}
+	if appender == nil {
+		if appender, err = segment.Appender(); err != nil {
+			return err
+		}
+	}
 	l.segments = append(l.segments, segment)
+	l.observers.push(event{kind: segmentCreatedEvent, segment: segment})
+
+	// snapshots are only an optimization, the segments will be scanned if they're not written
+	l.expireStates()
+	l.snapshotStates()
+	l.metrics.segmentRolls.Add(1)
+	l.metrics.segments.Set(float64(len(l.segments)))
 
-	appender, err := segment.Appender()
-	if err != nil {
-		return err
-	}
 	l.appender = appender
+	l.prepareSegment()
 	return nil
 }
 
 func (l *Log) Sync() {
-	if l.appender == nil {
+	// the messages up to offset are in the appender or in segments being sealed
+	l.segmentSwitchMutex.Lock()
+	appender, sealed, offset := l.appender, l.sealed, l.NextOffset()-1
+	l.segmentSwitchMutex.Unlock()
+	if appender == nil {
 		return
 	}
 
 	l.syncOffsetCond.L.Lock()
 	defer l.syncOffsetCond.L.Unlock()
 
-	offset := l.nextOffset - 1
-	l.appender.Sync()
-	l.syncOffset = offset
+	t0 := time.Now()
+	if sealed != nil {
+		<-sealed
+	}
+	appender.Sync()
+	if offset > l.syncOffset {
+		l.syncOffset = offset
+	}
 	l.syncOffsetCond.Broadcast()
+	l.observers.push(event{kind: syncedEvent, last: offset})
+
+	l.metrics.syncs.Add(1)
+	metrics.ObserveSince(l.metrics.syncLatency, t0)
+	l.metrics.offsets(l.nextOffset, l.syncOffset)
 }
 
 // Change the configuration
@@ -193,33 +573,84 @@ func (l *Log) SetConfig(config Config) {
 	// not sure sync is needed... but config changes are not frequent
 	l.writeMutex.Lock()
 	l.config = config
+	if !l.segmentStart.IsZero() {
+		l.startSegmentAge(l.segmentStart)
+	}
 	l.writeMutex.Unlock()
 }
 
-func (l *Log) Close() {
+// Register an observer of this log's events.
+func (l *Log) AddObserver(observer Observer) {
+	l.observers.add(observer)
+}
+
+// Unregister an observer. It may still receive events already queued. Observers are compared
+// with ==, so one whose type isn't comparable is only removed if it was registered by pointer.
+func (l *Log) RemoveObserver(observer Observer) {
+	l.observers.remove(observer)
+}
+
+// Close the log. Waits for the observers to receive the pending events,
+// so it must not be called from an observer. Returns the error of the last checkpoint, if any.
+func (l *Log) Close() error {
+	if l.follower != nil {
+		l.stopFollowing()
+	}
+	l.writeMutex.Lock()
+	l.closed = true
+	if l.rollTimer != nil {
+		l.rollTimer.Stop()
+	}
+	checkpoint := l.activeCheckpoint()
+	l.writeMutex.Unlock()
+
+	var err error
 	if l.appender != nil {
-		l.appender.Sync()
+		l.Sync()
+		err = l.writeCheckpoint(checkpoint)
 		l.appender.Close()
 	}
+	l.discardPreparedSegment()
+	if !l.readOnly {
+		l.snapshotStates()
+	}
+	l.observers.close()
+
+	// releases what the store holds, like the lock of its directory
+	if closer, ok := l.store.(io.Closer); ok {
+		closer.Close()
+	}
+	return err
 }
 
 // Creates a new consumer starting at startOffset.
 // If startOffset == 0, starts at the end of the log.
-func (l *Log) Consumer(startOffset uint64) (*Consumer, error) {
+func (l *Log) Consumer(startOffset uint64, options ...ConsumerOption) (*Consumer, error) {
 	l.segmentSwitchMutex.Lock()
 	defer l.segmentSwitchMutex.Unlock()
 
 	if startOffset == 0 {
-		startOffset = l.nextOffset
+		startOffset = l.NextOffset()
 	}
 
 	c := &Consumer{
 		log:    l,
 		offset: startOffset,
 	}
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
 	if err := c.setReader(); err != nil {
 		return nil, err
 	}
+	l.metrics.consumers.Add(1)
+	if c.name != "" {
+		c.gauges = l.metrics.openConsumer(c.name)
+		c.gauges.offset.Set(float64(c.offset))
+		c.gauges.lag.Set(float64(l.NextOffset() - c.offset))
+	}
 	return c, nil
 }
 
@@ -233,3 +664,60 @@ func (l *Log) segmentForOffset(offset uint64) Segment {
 	}
 	return segment
 }
+
+// The segment following the one holding offset, or nil if it's in the last segment.
+func (l *Log) segmentAfter(offset uint64) Segment {
+	for _, s := range l.segments {
+		if s.StartOffset() > offset {
+			return s
+		}
+	}
+	return nil
+}
+
+// The offset of the first message before endOffset with a timestamp at or after ts, or endOffset if there's none.
+func (l *Log) offsetForTimestamp(ts, endOffset uint64) (uint64, error) {
+	l.segmentSwitchMutex.Lock()
+	segments := append([]Segment{}, l.segments...)
+	l.segmentSwitchMutex.Unlock()
+
+	filter := &Filter{MinTimestamp: ts}
+	for _, segment := range segments {
+		if segment.StartOffset() >= endOffset {
+			break
+		}
+		if !filter.acceptsSegment(segment) {
+			continue
+		}
+		offset, found, err := firstAccepted(segment, filter, endOffset)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return offset, nil
+		}
+	}
+	return endOffset, nil
+}
+
+// The offset of the first message of a segment accepted by the filter, reading up to endOffset.
+func firstAccepted(segment Segment, filter *Filter, endOffset uint64) (uint64, bool, error) {
+	reader, err := segment.Reader()
+	if err != nil {
+		return 0, false, err
+	}
+	defer reader.Close()
+
+	for {
+		offset, msg, err := nextFiltered(reader, filter)
+		if err == io.EOF || err == UnexpectedEOF || (err == nil && offset >= endOffset) {
+			// end of the segment, or messages appended after endOffset
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		if msg != nil {
+			return offset, true, nil
+		}
+	}
+}
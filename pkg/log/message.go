@@ -4,27 +4,42 @@ package log
 // See http://kafka.apache.org/documentation.html#messageformat.
 
 import (
+	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"time"
 )
 
+// The latest message format
+const MaxFormat byte = 2
+
+var UnsupportedFormat = errors.New("unsupported message format")
+
 // On-disk format of a message
 //
 // offset         : 8 bytes
-// message length : 4 bytes (value: 4 + 1 + 1 + 8(if magic value > 0) + 4 + K + 4 + V)
+// message length : 4 bytes (value: 4 + 1 + 1 + 8(if magic value > 0) + 12(if producer) + 4 + K + 4 + V + 4 + H(if magic value > 1))
 // crc            : 4 bytes
 // magic value    : 1 byte
 // attributes     : 1 byte
 // timestamp      : 8 bytes (Only exists when magic value is greater than zero)
+// producer id    : 8 bytes (Only exists when magic value is greater than one and attributes bit 4 is set)
+// sequence       : 4 bytes (Only exists when magic value is greater than one and attributes bit 4 is set)
 // key length     : 4 bytes
 // key            : K bytes
 // value length   : 4 bytes
 // value          : V bytes
+// header count   : 4 bytes (Only exists when magic value is greater than one)
+// headers        : H bytes, for each header:
+//   key length   : 4 bytes
+//   key          : HK bytes
+//   value length : 4 bytes
+//   value        : HV bytes
 type Message struct {
 	// 4 byte CRC32 of the message
 	CRC uint32
-	// 1 byte "magic" identifier to allow format changes, value is 0 or 1
+	// 1 byte "magic" identifier to allow format changes, value is 0, 1 or 2
 	Format byte
 	// 1 byte "attributes" identifier to allow annotations on the message independent
 	//   bit 0 ~ 2 : Compression codec.
@@ -35,19 +50,100 @@ type Message struct {
 	//    bit 3 : Timestamp type
 	//      0 : create time
 	//      1 : log append time
-	//    bit 4 ~ 7 : reserved
+	//    bit 4 : Producer (only if "magic" identifier is greater than 1)
+	//      0 : no producer id nor sequence
+	//      1 : producer id and sequence are present
+	//    bit 5 : Transactional (only if "magic" identifier is greater than 1 and bit 4 is set)
+	//      0 : not part of a transaction
+	//      1 : part of the transaction of the producer
+	//    bit 6 : Control (only if "magic" identifier is greater than 1 and bit 4 is set)
+	//      0 : data message
+	//      1 : control message, the key holds the control type
+	//    bit 7 : Encrypted (only if "magic" identifier is greater than 1)
+	//      0 : plain key and payload
+	//      1 : the key and payload are encrypted, a header gives the key id
 	Attributes byte
 	// (Optional) 8 byte timestamp only if "magic" identifier is greater than 0
 	Timestamp uint64
+	// (Optional) 8 byte id of the producer, only if attributes bit 4 is set
+	ProducerID uint64
+	// (Optional) 4 byte sequence of the message for its producer, only if attributes bit 4 is set
+	Sequence uint32
 	// K byte key
 	Key []byte
 	// V byte payload
 	Payload []byte
+	// (Optional) ordered headers only if "magic" identifier is greater than 1
+	Headers []Header
+}
+
+// A message header, like Kafka's record headers.
+// Keys are not unique.
+type Header struct {
+	Key   string
+	Value []byte
 }
 
+// Compression codec of a message (attributes bits 0 ~ 2)
+type Codec byte
+
+const (
+	NoCompression Codec = iota
+	Gzip
+	Snappy
+	LZ4
+)
+
+func (c Codec) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Snappy:
+		return "snappy"
+	case LZ4:
+		return "lz4"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// Timestamp type of a message (attributes bit 3)
+type TimestampType byte
+
+const (
+	CreateTime TimestampType = iota
+	LogAppendTime
+)
+
+func (t TimestampType) String() string {
+	if t == LogAppendTime {
+		return "LogAppendTime"
+	}
+	return "CreateTime"
+}
+
+// The timestamp of a time, in milliseconds since the Unix epoch like Kafka's.
 func Timestamp(t time.Time) uint64 {
-	// FIXME is it Unix, UnixNano, something else?
-	return uint64(t.Unix())
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// Timestamps below this are in seconds, as written before they were in milliseconds
+// (it's March 1973 in milliseconds, and year 5138 in seconds).
+const legacyTimestampLimit = 100000000000
+
+// The time of a timestamp (the inverse of Timestamp), old timestamps in seconds included.
+func TimeOf(timestamp uint64) time.Time {
+	timestamp = NormalizeTimestamp(timestamp)
+	return time.Unix(int64(timestamp/1000), int64(timestamp%1000)*int64(time.Millisecond))
+}
+
+// The timestamp in milliseconds, converting old timestamps in seconds. No timestamp (0) stays 0.
+func NormalizeTimestamp(timestamp uint64) uint64 {
+	if timestamp < legacyTimestampLimit {
+		return timestamp * 1000
+	}
+	return timestamp
 }
 
 func NewMessage(timestamp uint64, key, data []byte) *Message {
@@ -62,11 +158,153 @@ func NewMessage(timestamp uint64, key, data []byte) *Message {
 	return l
 }
 
+// Create a message with headers.
+func NewMessageWithHeaders(timestamp uint64, key, data []byte, headers []Header) *Message {
+	l := &Message{
+		Format:     2,
+		Attributes: 0,
+		Timestamp:  timestamp,
+		Key:        key,
+		Payload:    data,
+		Headers:    headers,
+	}
+	l.UpdateCRC()
+	return l
+}
+
+// The value of the last header with the given key, or nil if there's none.
+func (l *Message) Header(key string) []byte {
+	for i := len(l.Headers) - 1; i >= 0; i-- {
+		if l.Headers[i].Key == key {
+			return l.Headers[i].Value
+		}
+	}
+	return nil
+}
+
+const (
+	logAppendTimeAttribute byte = 1 << 3
+	producerAttribute      byte = 1 << 4
+	transactionalAttribute byte = 1 << 5
+	controlAttribute       byte = 1 << 6
+)
+
+// Attribute of messages with an encrypted key and payload (see stores/encrypted).
+const EncryptedAttribute byte = 1 << 7
+
+// Type of a control message
+type ControlType uint16
+
+const (
+	AbortMarker ControlType = iota
+	CommitMarker
+	BeginMarker
+)
+
+func (t ControlType) String() string {
+	switch t {
+	case AbortMarker:
+		return "abort"
+	case CommitMarker:
+		return "commit"
+	case BeginMarker:
+		return "begin"
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(t))
+}
+
+// Create a control message of a producer's transaction.
+// The key is the control version (2 bytes, 0) followed by the control type (2 bytes).
+func NewControlMessage(timestamp uint64, producerID uint64, controlType ControlType) *Message {
+	key := make([]byte, 4)
+	byteOrder.PutUint16(key[2:], uint16(controlType))
+	l := &Message{
+		Format:     2,
+		Attributes: producerAttribute | transactionalAttribute | controlAttribute,
+		Timestamp:  timestamp,
+		ProducerID: producerID,
+		Key:        key,
+	}
+	l.UpdateCRC()
+	return l
+}
+
+// Set the producer id and sequence of this message, used to deduplicate appends.
+// This updates the CRC.
+func (l *Message) SetProducer(producerID uint64, sequence uint32) {
+	if l.Format < 2 {
+		l.Format = 2
+	}
+	l.Attributes |= producerAttribute
+	l.ProducerID = producerID
+	l.Sequence = sequence
+	l.UpdateCRC()
+}
+
+func (l *Message) HasProducer() bool {
+	return l.Format > 1 && l.Attributes&producerAttribute != 0
+}
+
+// Mark this message as part of its producer's transaction.
+// This updates the CRC.
+func (l *Message) SetTransactional(producerID uint64, sequence uint32) {
+	l.Attributes |= transactionalAttribute
+	l.SetProducer(producerID, sequence)
+}
+
+func (l *Message) IsTransactional() bool {
+	return l.HasProducer() && l.Attributes&transactionalAttribute != 0
+}
+
+func (l *Message) IsControl() bool {
+	return l.HasProducer() && l.Attributes&controlAttribute != 0
+}
+
+// The type of a control message. Returns false if the message isn't a valid control message.
+func (l *Message) ControlType() (ControlType, bool) {
+	if !l.IsControl() || len(l.Key) != 4 {
+		return 0, false
+	}
+	return ControlType(byteOrder.Uint16(l.Key[2:])), true
+}
+
+func (l *Message) IsEncrypted() bool {
+	return l.Format > 1 && l.Attributes&EncryptedAttribute != 0
+}
+
+func (l *Message) Codec() Codec {
+	return Codec(l.Attributes & 0x07)
+}
+
+func (l *Message) TimestampType() TimestampType {
+	return TimestampType(l.Attributes >> 3 & 0x01)
+}
+
+// Set the timestamp of this message to the time it's appended to a log.
+// This updates the CRC.
+func (l *Message) SetLogAppendTime(timestamp uint64) {
+	if l.Format < 1 {
+		l.Format = 1
+	}
+	l.Attributes |= logAppendTimeAttribute
+	l.Timestamp = timestamp
+	l.UpdateCRC()
+}
+
 func (l *Message) Len() uint32 {
 	x := uint32(4 + 1 + 1 + 4 + 4 + len(l.Key) + len(l.Payload))
 	if l.Format > 0 {
 		x += 8
 	}
+	if l.HasProducer() {
+		x += 8 + 4
+	}
+	if l.Format > 1 {
+		x += 4
+		for _, h := range l.Headers {
+			x += uint32(4 + len(h.Key) + 4 + len(h.Value))
+		}
+	}
 	return x
 }
 
@@ -83,13 +321,88 @@ func (l *Message) ComputeCRC() uint32 {
 func (l *Message) ReadFrom(reader io.Reader) error {
 	r := BinaryReader{reader, nil}
 	l.CRC = r.ReadUint32()
+	if err := l.readHead(&r); err != nil {
+		return err
+	}
+	l.readBody(&r)
+	return r.err
+}
+
+// Read the fields after the CRC and before the payload.
+func (l *Message) readHead(r *BinaryReader) error {
     l.Format = r.ReadByte()
     l.Attributes = r.ReadByte()
+	if r.err == nil && l.Format > MaxFormat {
+		return UnsupportedFormat
+	}
 	if l.Format > 0 {
         l.Timestamp = r.ReadUint64()
+	} else {
+		l.Timestamp = 0
+	}
+	if l.HasProducer() {
+		l.ProducerID = r.ReadUint64()
+		l.Sequence = r.ReadUint32()
+	} else {
+		l.ProducerID, l.Sequence = 0, 0
 	}
     l.Key = r.ReadBytes()
+	return r.err
+}
+
+// Read the payload and the fields after it.
+func (l *Message) readBody(r *BinaryReader) {
     l.Payload = r.ReadBytes()
+	l.Headers = nil
+	if l.Format > 1 {
+		count := r.ReadUint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			key := r.ReadBytes()
+			l.Headers = append(l.Headers, Header{string(key), r.ReadBytes()})
+		}
+	}
+}
+
+// Decode a message from its raw bytes, starting with the CRC, without checking the CRC.
+// The key, payload and header values share the memory of data, and the headers slice of the
+// message is reused.
+func (l *Message) decode(data []byte) error {
+	r := sliceReader{data: data}
+	l.CRC = r.readUint32()
+	l.Format = r.readByte()
+	l.Attributes = r.readByte()
+	if r.err == nil && l.Format > MaxFormat {
+		return UnsupportedFormat
+	}
+	l.Timestamp = 0
+	if l.Format > 0 {
+		l.Timestamp = r.readUint64()
+	}
+	l.ProducerID, l.Sequence = 0, 0
+	if l.HasProducer() {
+		l.ProducerID = r.readUint64()
+		l.Sequence = r.readUint32()
+	}
+	l.Key = r.readBytes()
+	l.Payload = r.readBytes()
+
+	previous := l.Headers[:cap(l.Headers)]
+	headers := l.Headers[:0]
+	if l.Format > 1 {
+		count := r.readUint32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			key := r.readBytes()
+			h := Header{Value: r.readBytes()}
+			if int(i) < len(previous) && previous[i].Key == string(key) {
+				// same key as the previous message, don't allocate it again
+				h.Key = previous[i].Key
+			} else {
+				h.Key = string(key)
+			}
+			headers = append(headers, h)
+		}
+	}
+	l.Headers = headers
 	return r.err
 }
 
@@ -104,6 +417,17 @@ func (l *Message) writePostCRCTo(w *BinaryWriter) {
 	if l.Format > 0 {
 		w.WriteUint64(l.Timestamp)
 	}
+	if l.HasProducer() {
+		w.WriteUint64(l.ProducerID)
+		w.WriteUint32(l.Sequence)
+	}
 	w.WriteBytes(l.Key)
 	w.WriteBytes(l.Payload)
+	if l.Format > 1 {
+		w.WriteUint32(uint32(len(l.Headers)))
+		for _, h := range l.Headers {
+			w.WriteBytes([]byte(h.Key))
+			w.WriteBytes(h.Value)
+		}
+	}
 }
@@ -84,3 +84,48 @@ func TestWriteRead(t *testing.T) {
 		t.Errorf("payload differs: %q != %q", string(m.Payload), string(m2.Payload))
 	}
 }
+
+func TestMessageHeadersWriteRead(t *testing.T) {
+	m := NewMessageWithHeaders(1469067554, []byte("key"), []byte("data"), []Header{
+		{"trace", []byte("abc")},
+		{"empty", nil},
+		{"trace", []byte("def")},
+	})
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(NewBinaryWriter(buf))
+
+	if buf.Len() != int(m.Len()) {
+		t.Error("bad length: ", m.Len(), " != ", buf.Len())
+	}
+
+	m2 := &Message{}
+	if err := m2.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if m2.ComputeCRC() != m.CRC {
+		t.Error("bad CRC")
+	}
+	if len(m2.Headers) != 3 || m2.Headers[1].Key != "empty" || m2.Headers[1].Value != nil {
+		t.Errorf("bad headers: %q", m2.Headers)
+	}
+	if v := m2.Header("trace"); string(v) != "def" {
+		t.Errorf("bad trace header: %q", v)
+	}
+}
+
+func TestMessageFormat1HasNoHeaders(t *testing.T) {
+	m := NewMessage(1469067554, []byte("key"), []byte("data"))
+	m.Headers = []Header{{"ignored", []byte("x")}}
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(NewBinaryWriter(buf))
+
+	m2 := &Message{}
+	if err := m2.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if m2.Headers != nil || buf.Len() != 0 {
+		t.Error("format 1 message must not have headers")
+	}
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	"sync"
+
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
+)
+
+// Optionally implemented by segments to report their size in bytes.
+type SizedSegment interface {
+	Size() (int64, error)
+}
+
+type logMetrics struct {
+	appends       metrics.Counter
+	appendedBytes metrics.Counter
+	appendLatency metrics.Histogram
+
+	syncs       metrics.Counter
+	syncLatency metrics.Histogram
+
+	segmentRolls       metrics.Counter
+	rollFailures       metrics.Counter
+	checkpointFailures metrics.Counter
+	segments           metrics.Gauge
+	bytes              metrics.Gauge
+	activeBytes        metrics.Gauge
+	nextOffset         metrics.Gauge
+	syncOffset         metrics.Gauge
+	syncLag            metrics.Gauge
+	stableOffset       metrics.Gauge
+	openTransactions   metrics.Gauge
+	crcFailures        metrics.Counter
+	duplicates         metrics.Counter
+	rejected           metrics.Counter
+	consumers          metrics.Gauge
+	consumed           metrics.Counter
+	consumedBytes      metrics.Counter
+	filtered           metrics.Counter
+	consumerLag        metrics.Histogram
+
+	// the gauges of named consumers
+	registry       metrics.Registry
+	labels         metrics.Labels
+	consumerMutex  sync.Mutex
+	consumerGauges map[string]*consumerGauges
+}
+
+// The position and lag of the consumers of a name, reported while at least one of them is open.
+type consumerGauges struct {
+	offset metrics.Gauge
+	lag    metrics.Gauge
+	open   int
+}
+
+func newLogMetrics(r metrics.Registry, labels metrics.Labels) *logMetrics {
+	if r == nil {
+		r = metrics.Discard
+	}
+	return &logMetrics{
+		appends:       r.Counter("cebaka_log_appends_total", "Messages appended to the log.", labels),
+		appendedBytes: r.Counter("cebaka_log_appended_bytes_total", "Bytes appended to the log.", labels),
+		appendLatency: r.Histogram("cebaka_log_append_duration_seconds", "Latency of appends to the log.", metrics.LatencyBuckets, labels),
+
+		syncs:       r.Counter("cebaka_log_syncs_total", "Syncs of the log.", labels),
+		syncLatency: r.Histogram("cebaka_log_sync_duration_seconds", "Latency of syncs of the log.", metrics.LatencyBuckets, labels),
+
+		segmentRolls:       r.Counter("cebaka_log_segment_rolls_total", "Segments rolled by the log.", labels),
+		rollFailures:       r.Counter("cebaka_log_segment_roll_failures_total", "Segment rolls that failed, tried again on the next append.", labels),
+		checkpointFailures: r.Counter("cebaka_log_checkpoint_failures_total", "Chain checkpoints that couldn't be written.", labels),
+		segments:           r.Gauge("cebaka_log_segments", "Segments in the log.", labels),
+		bytes:              r.Gauge("cebaka_log_bytes", "Size of the log.", labels),
+		activeBytes:        r.Gauge("cebaka_log_active_segment_bytes", "Size of the active segment of the log.", labels),
+		nextOffset:         r.Gauge("cebaka_log_next_offset", "Offset of the next message appended to the log.", labels),
+		syncOffset:         r.Gauge("cebaka_log_sync_offset", "Last offset synced by the log.", labels),
+		syncLag:            r.Gauge("cebaka_log_sync_lag_messages", "Messages appended but not synced yet.", labels),
+		stableOffset:       r.Gauge("cebaka_log_last_stable_offset", "First offset of the oldest open transaction.", labels),
+		openTransactions:   r.Gauge("cebaka_log_open_transactions", "Open transactions in the log.", labels),
+		crcFailures:        r.Counter("cebaka_log_crc_failures_total", "Messages read with a bad CRC.", labels),
+		duplicates:         r.Counter("cebaka_log_duplicates_total", "Appends ignored because their producer sequence was already appended.", labels),
+		rejected:           r.Counter("cebaka_log_rejected_total", "Appends rejected by the validation of the log.", labels),
+		consumers:          r.Gauge("cebaka_log_consumers", "Open consumers of the log.", labels),
+		consumed:           r.Counter("cebaka_log_consumed_total", "Messages read by consumers.", labels),
+		consumedBytes:      r.Counter("cebaka_log_consumed_bytes_total", "Bytes read by consumers.", labels),
+		filtered:           r.Counter("cebaka_log_filtered_total", "Messages rejected by the filters of consumers.", labels),
+		consumerLag:        r.Histogram("cebaka_log_consumer_lag_messages", "Messages between a consumer's position and the end of the log.", metrics.CountBuckets, labels),
+
+		registry:       r,
+		labels:         labels,
+		consumerGauges: map[string]*consumerGauges{},
+	}
+}
+
+const (
+	consumerOffsetMetric = "cebaka_log_consumer_offset"
+	consumerLagMetric    = "cebaka_log_consumer_lag"
+)
+
+// Get the gauges of the consumers of a name, until released.
+func (m *logMetrics) openConsumer(name string) *consumerGauges {
+	m.consumerMutex.Lock()
+	defer m.consumerMutex.Unlock()
+
+	g := m.consumerGauges[name]
+	if g == nil {
+		labels := m.labels.With("consumer", name)
+		g = &consumerGauges{
+			offset: m.registry.Gauge(consumerOffsetMetric, "Offset of the next message read by the consumers of a name.", labels),
+			lag:    m.registry.Gauge(consumerLagMetric, "Messages between the position of the consumers of a name and the end of the log.", labels),
+		}
+		m.consumerGauges[name] = g
+	}
+	g.open++
+	return g
+}
+
+// Release the gauges of a consumer, removing them from the registry after the last consumer of
+// the name, when the registry allows it.
+func (m *logMetrics) closeConsumer(name string) {
+	m.consumerMutex.Lock()
+	defer m.consumerMutex.Unlock()
+
+	g := m.consumerGauges[name]
+	if g.open--; g.open > 0 {
+		return
+	}
+	delete(m.consumerGauges, name)
+	if remover, ok := m.registry.(metrics.Remover); ok {
+		labels := m.labels.With("consumer", name)
+		remover.Remove(consumerOffsetMetric, labels)
+		remover.Remove(consumerLagMetric, labels)
+	}
+}
+
+func (m *logMetrics) offsets(nextOffset, syncOffset uint64) {
+	m.nextOffset.Set(float64(nextOffset))
+	m.syncOffset.Set(float64(syncOffset))
+	m.syncLag.Set(float64(nextOffset - 1 - syncOffset))
+}
@@ -0,0 +1,198 @@
+package log
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Receives the lifecycle events of a log.
+//
+// Callbacks are invoked in order from a dedicated goroutine, outside of the log's locks,
+// so an observer may use the log (even Append to it) but should not block for too long
+// as events are queued until delivered.
+type Observer interface {
+	// A segment was added to the log.
+	SegmentCreated(segment Segment)
+	// A segment was synced and will not receive more messages.
+	SegmentSealed(segment Segment)
+	// Messages up to offset (included) are synced.
+	Synced(offset uint64)
+	// Messages from firstOffset to lastOffset (included) were appended.
+	Appended(firstOffset, lastOffset uint64)
+	// An invalid tail was found after lastOffset, at position in the segment, when opening the log.
+	TailRecovered(segment Segment, lastOffset uint64, position int64)
+	// The log was closed.
+	Closed()
+}
+
+// An observer ignoring all events, to embed in observers only interested in some of them.
+type NopObserver struct{}
+
+var _ = Observer(NopObserver{})
+
+func (NopObserver) SegmentCreated(segment Segment)                                   {}
+func (NopObserver) SegmentSealed(segment Segment)                                    {}
+func (NopObserver) Synced(offset uint64)                                             {}
+func (NopObserver) Appended(firstOffset, lastOffset uint64)                          {}
+func (NopObserver) TailRecovered(segment Segment, lastOffset uint64, position int64) {}
+func (NopObserver) Closed()                                                          {}
+
+type eventKind int
+
+const (
+	segmentCreatedEvent eventKind = iota
+	segmentSealedEvent
+	syncedEvent
+	appendedEvent
+	tailRecoveredEvent
+	closedEvent
+)
+
+type event struct {
+	kind     eventKind
+	segment  Segment
+	first    uint64
+	last     uint64
+	position int64
+}
+
+// Queues events and delivers them to observers.
+type observers struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	list    []Observer
+	queue   []event
+	started bool
+	running bool
+	closed  bool
+	done    chan struct{}
+}
+
+func newObservers(list []Observer) *observers {
+	o := &observers{done: make(chan struct{})}
+	o.cond = sync.NewCond(&o.mutex)
+	for _, observer := range list {
+		o.add(observer)
+	}
+	return o
+}
+
+func (o *observers) add(observer Observer) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.list = append(o.list, observer)
+	o.startRunning()
+}
+
+// Start delivering the events, once the log is open. The events before are queued.
+func (o *observers) start() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.started = true
+	o.startRunning()
+}
+
+// Start the delivery goroutine if needed. Called with the mutex held.
+func (o *observers) startRunning() {
+	if o.started && !o.running && !o.closed && len(o.list) != 0 {
+		o.running = true
+		go o.run()
+	}
+}
+
+func (o *observers) remove(observer Observer) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	list := make([]Observer, 0, len(o.list))
+	for _, x := range o.list {
+		if !sameObserver(x, observer) {
+			list = append(list, x)
+		}
+	}
+	o.list = list
+}
+
+// Compare observers without panicking on the types that aren't comparable, which never match.
+func sameObserver(a, b Observer) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && (t == nil || t.Comparable()) && a == b
+}
+
+func (o *observers) push(e event) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.list) == 0 || o.closed {
+		return
+	}
+	o.queue = append(o.queue, e)
+	o.cond.Signal()
+}
+
+// Deliver the closed event and wait for all events to be delivered.
+func (o *observers) close() {
+	o.push(event{kind: closedEvent})
+
+	o.mutex.Lock()
+	o.closed = true
+	running := o.running
+	o.cond.Signal()
+	o.mutex.Unlock()
+
+	if running {
+		<-o.done
+	}
+}
+
+func (o *observers) run() {
+	defer close(o.done)
+
+	for {
+		o.mutex.Lock()
+		for len(o.queue) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		queue, list := o.queue, o.list
+		o.queue = nil
+		o.mutex.Unlock()
+
+		if len(queue) == 0 {
+			// closed and nothing left to deliver
+			return
+		}
+
+		for i := 0; i < len(queue); i++ {
+			e := queue[i]
+			if e.kind == appendedEvent {
+				// merge consecutive appends in a single range
+				for i+1 < len(queue) && queue[i+1].kind == appendedEvent && queue[i+1].first == e.last+1 {
+					i++
+					e.last = queue[i].last
+				}
+			}
+			for _, observer := range list {
+				e.deliver(observer)
+			}
+		}
+	}
+}
+
+func (e event) deliver(observer Observer) {
+	switch e.kind {
+	case segmentCreatedEvent:
+		observer.SegmentCreated(e.segment)
+	case segmentSealedEvent:
+		observer.SegmentSealed(e.segment)
+	case syncedEvent:
+		observer.Synced(e.last)
+	case appendedEvent:
+		observer.Appended(e.first, e.last)
+	case tailRecoveredEvent:
+		observer.TailRecovered(e.segment, e.last, e.position)
+	case closedEvent:
+		observer.Closed()
+	}
+}
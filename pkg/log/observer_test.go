@@ -0,0 +1,83 @@
+package log
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type recordingObserver struct {
+	NopObserver
+	mutex  sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.mutex.Lock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+	o.mutex.Unlock()
+}
+
+func (o *recordingObserver) SegmentCreated(s Segment) { o.record("created %d", s.StartOffset()) }
+func (o *recordingObserver) SegmentSealed(s Segment)  { o.record("sealed %d", s.StartOffset()) }
+func (o *recordingObserver) Appended(first, last uint64) {
+	// ranges depend on the delivery timing
+	for offset := first; offset <= last; offset++ {
+		o.record("appended %d", offset)
+	}
+}
+func (o *recordingObserver) Closed() { o.record("closed") }
+
+func TestObserver(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	o := &recordingObserver{}
+	m := NewMessage(1469067554, []byte("key"), []byte("data"))
+
+	l, err := Open(Config{
+		MaxSegmentSize: 2*int64(8+4+m.Len()) - 1,
+		MaxSyncLag:     -1,
+		Observers:      []Observer{o},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := l.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	expected := []string{"created 1", "appended 1", "appended 2", "sealed 1", "created 3", "appended 3", "closed"}
+	if !reflect.DeepEqual(o.events, expected) {
+		t.Errorf("unexpected events: %q", o.events)
+	}
+}
+
+// An observer whose type isn't comparable.
+type funcObserver struct {
+	NopObserver
+	closed func()
+}
+
+func (o funcObserver) Closed() { o.closed() }
+
+func TestObserverRemove(t *testing.T) {
+	recording := &recordingObserver{}
+	closed := 0
+	o := newObservers([]Observer{recording, funcObserver{closed: func() { closed++ }}})
+	if o.running {
+		t.Error("delivering events before the log is open")
+	}
+	o.start()
+
+	o.remove(funcObserver{})
+	o.remove(recording)
+	o.close()
+	if len(recording.events) != 0 || closed != 1 {
+		t.Errorf("unexpected events: %q, %d closed", recording.events, closed)
+	}
+}
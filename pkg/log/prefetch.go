@@ -0,0 +1,146 @@
+package log
+
+import (
+	"errors"
+	"time"
+)
+
+// Size of the read buffer of prefetching consumers.
+const prefetchBufferSize = 1 << 20
+
+// Returned internally when a consumer stops waiting for a message.
+var notReady = errors.New("no message ready")
+
+// Optionally implemented by segment readers with a configurable read buffer.
+type BufferedSegmentReader interface {
+	SetBufferSize(size int) error
+}
+
+// Read ahead up to depth messages in a background goroutine, with large reads of the segments.
+// This is meant for consumers replaying a log sequentially.
+func Prefetch(depth int) ConsumerOption {
+	return func(c *Consumer) error {
+		if depth <= 0 {
+			return errors.New("prefetch depth must be positive")
+		}
+		c.prefetch = depth
+		return nil
+	}
+}
+
+type prefetched struct {
+	offset uint64
+	msg    *Message
+	err    error
+}
+
+// The goroutine reading ahead for a consumer.
+type prefetcher struct {
+	results chan prefetched
+	stop    chan struct{}
+	// the offset of the next message given by the consumer
+	position uint64
+}
+
+// Take the next message read ahead, waiting at most timeout for it if timeout is not negative.
+func (c *Consumer) nextPrefetched(timeout time.Duration) (uint64, *Message, error) {
+	for {
+		if c.prefetcher == nil {
+			c.prefetcher = &prefetcher{
+				results:  make(chan prefetched, c.prefetch),
+				stop:     make(chan struct{}),
+				position: c.offset,
+			}
+			go c.runPrefetch(c.prefetcher)
+		}
+
+		var r prefetched
+		var ok bool
+		if timeout < 0 {
+			r, ok = <-c.prefetcher.results
+		} else {
+			timer := time.NewTimer(timeout)
+			select {
+			case r, ok = <-c.prefetcher.results:
+				timer.Stop()
+			case <-timer.C:
+				return 0, nil, nil
+			}
+		}
+		if !ok {
+			// the prefetcher stopped after returning an error, try again
+			c.prefetcher = nil
+			continue
+		}
+		if r.err == nil {
+			c.prefetcher.position = r.offset + 1
+		}
+		return r.offset, r.msg, r.err
+	}
+}
+
+func (c *Consumer) runPrefetch(p *prefetcher) {
+	defer close(p.results)
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		offset, msg, err := c.read(nil)
+		if err == notReady {
+			return
+		}
+		select {
+		case p.results <- prefetched{offset, msg, err}:
+		case <-p.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Stop the prefetching goroutine, dropping the messages read ahead.
+func (c *Consumer) stopPrefetch() {
+	p := c.prefetcher
+	if p == nil {
+		return
+	}
+	c.prefetcher = nil
+
+	close(p.stop)
+	c.log.offsetCond.L.Lock()
+	c.stopping = true
+	c.log.offsetCond.Broadcast()
+	c.log.offsetCond.L.Unlock()
+
+	for range p.results {
+	}
+	c.stopping = false
+	c.offset = p.position
+}
+
+// Open the reader of a segment, or take the one opened in advance.
+func (c *Consumer) segmentReader(s Segment) (SegmentReader, error) {
+	if r := c.nextReader; r != nil {
+		c.nextReader = nil
+		if c.nextReaderStart == s.StartOffset() {
+			return r, nil
+		}
+		r.Close()
+	}
+
+	r, err := s.Reader()
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := r.(BufferedSegmentReader); ok && c.prefetch > 0 {
+		if err := b.SetBufferSize(prefetchBufferSize); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
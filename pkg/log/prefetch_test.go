@@ -0,0 +1,52 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPrefetch(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	l, err := Open(Config{MaxSegmentSize: 200, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 1; i <= 50; i++ {
+		l.Append(NewMessage(0, nil, []byte(fmt.Sprint(i))))
+	}
+
+	c, err := l.Consumer(1, Prefetch(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(from, to uint64) {
+		for o := from; o <= to; o++ {
+			offset, msg, err := c.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != o || string(msg.Payload) != fmt.Sprint(o) {
+				t.Fatalf("expected offset %d, got %d: %q", o, offset, msg.Payload)
+			}
+		}
+		if p := c.Position(); p != to+1 {
+			t.Errorf("bad position: %d != %d", p, to+1)
+		}
+	}
+
+	expect(1, 30)
+	if err := c.Seek(10); err != nil {
+		t.Fatal(err)
+	}
+	expect(10, 50)
+
+	// the prefetcher now waits for new messages
+	l.Append(NewMessage(0, nil, []byte("51")))
+	expect(51, 51)
+}
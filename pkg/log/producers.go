@@ -0,0 +1,145 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	OutOfOrderSequence = errors.New("out of order sequence for producer")
+	DuplicateSequence  = errors.New("sequence already appended by producer")
+)
+
+// Number of recent appends remembered per producer to acknowledge retries with their offset.
+const producerWindow = 5
+
+type producerAppend struct {
+	sequence uint32
+	offset   uint64
+	// timestamp of the message in milliseconds, 0 if unknown
+	timestamp uint64
+}
+
+// The recent appends of a producer, oldest first.
+type producerState []producerAppend
+
+// The deduplication table: recent appends by producer id.
+type producers map[uint64]producerState
+
+// Check the sequence of a message from a producer.
+// Returns the offset of the original message and true if the message was already appended.
+func (p producers) check(msg *Message) (uint64, bool, error) {
+	state := p[msg.ProducerID]
+	if len(state) == 0 {
+		// unknown producer, accept any sequence
+		return 0, false, nil
+	}
+
+	// sequences may wrap
+	diff := int32(msg.Sequence - state[len(state)-1].sequence)
+	switch {
+	case diff == 1:
+		return 0, false, nil
+	case diff > 1:
+		return 0, false, OutOfOrderSequence
+	}
+
+	for _, a := range state {
+		if a.sequence == msg.Sequence {
+			return a.offset, true, nil
+		}
+	}
+	return 0, false, DuplicateSequence
+}
+
+// Record the append of a message from a producer.
+func (p producers) update(msg *Message, offset uint64) {
+	state := p[msg.ProducerID]
+	if len(state) == producerWindow {
+		copy(state, state[1:])
+		state = state[:len(state)-1]
+	}
+	p[msg.ProducerID] = append(state, producerAppend{msg.Sequence, offset, NormalizeTimestamp(msg.Timestamp)})
+}
+
+// Forget the producers whose last append is before startOffset, no longer in the log, or whose
+// last message is older than minTimestamp (0: none).
+func (p producers) expire(startOffset, minTimestamp uint64) {
+	for id, state := range p {
+		last := state[len(state)-1]
+		if last.offset < startOffset || (last.timestamp != 0 && last.timestamp < minTimestamp) {
+			delete(p, id)
+		}
+	}
+}
+
+// Snapshot format:
+//
+//	version       : 1 byte (1, 0 had no timestamps)
+//	offset        : 8 bytes (the next offset when the snapshot was taken)
+//	producers     : 4 bytes
+//	for each producer:
+//	  producer id : 8 bytes
+//	  appends     : 1 byte
+//	  for each append:
+//	    sequence  : 4 bytes
+//	    offset    : 8 bytes
+//	    timestamp : 8 bytes
+func (p producers) snapshot(nextOffset uint64) []byte {
+	buf := &bytes.Buffer{}
+	w := NewBinaryWriter(buf)
+	w.WriteByte(1)
+	w.WriteUint64(nextOffset)
+	w.WriteUint32(uint32(len(p)))
+	for id, state := range p {
+		w.WriteUint64(id)
+		w.WriteByte(byte(len(state)))
+		for _, a := range state {
+			w.WriteUint32(a.sequence)
+			w.WriteUint64(a.offset)
+			w.WriteUint64(a.timestamp)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (p producers) loadSnapshot(data []byte) (uint64, error) {
+	r := &BinaryReader{bytes.NewReader(data), nil}
+	version := r.ReadByte()
+	if r.err == nil && version > 1 {
+		return 0, errors.New("unknown producers snapshot version")
+	}
+	nextOffset := r.ReadUint64()
+	count := r.ReadUint32()
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		id := r.ReadUint64()
+		n := r.ReadByte()
+		state := make(producerState, 0, n)
+		for j := byte(0); j < n && r.err == nil; j++ {
+			a := producerAppend{sequence: r.ReadUint32(), offset: r.ReadUint64()}
+			if version > 0 {
+				a.timestamp = r.ReadUint64()
+			}
+			state = append(state, a)
+		}
+		p[id] = state
+	}
+	return nextOffset, r.err
+}
+
+func (p producers) snapshotName() string {
+	return "producers"
+}
+
+func (p producers) apply(offset uint64, msg *Message) {
+	if msg.HasProducer() && !msg.IsControl() {
+		p.update(msg, offset)
+	}
+}
+
+func (p producers) reset() {
+	for id := range p {
+		delete(p, id)
+	}
+}
@@ -0,0 +1,117 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func producerMessage(producerID uint64, sequence uint32) *Message {
+	m := NewMessage(1469067554, nil, []byte("data"))
+	m.SetProducer(producerID, sequence)
+	return m
+}
+
+func TestIdempotentAppend(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	config := Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1, Idempotent: true}
+	l, err := Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendAs := func(l *Log, producerID uint64, sequence uint32, expectedOffset uint64, expectedErr error) {
+		offset, err := l.Append(producerMessage(producerID, sequence))
+		if err != expectedErr {
+			t.Fatalf("append %d/%d: expected error %v, got %v", producerID, sequence, expectedErr, err)
+		}
+		if offset != expectedOffset {
+			t.Errorf("append %d/%d: expected offset %d, got %d", producerID, sequence, expectedOffset, offset)
+		}
+	}
+
+	appendAs(l, 1, 10, 1, nil)
+	appendAs(l, 2, 0, 2, nil)
+	appendAs(l, 1, 11, 3, nil)
+	appendAs(l, 1, 10, 1, nil) // retry
+	appendAs(l, 1, 13, 0, OutOfOrderSequence)
+	l.Close()
+
+	// the table is rebuilt from the segments
+	l, err = Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	appendAs(l, 1, 11, 3, nil) // retry
+	appendAs(l, 2, 1, 4, nil)
+	if l.NextOffset() != 5 {
+		t.Error("bad next offset: ", l.NextOffset())
+	}
+}
+
+func TestProducersSnapshot(t *testing.T) {
+	p := producers{}
+	for i := uint32(0); i < 2*producerWindow; i++ {
+		p.update(producerMessage(1, i), uint64(i+1))
+	}
+	p.update(producerMessage(2, 7), 42)
+
+	p2 := producers{}
+	nextOffset, err := p2.loadSnapshot(p.snapshot(43))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextOffset != 43 || len(p2) != 2 || len(p2[1]) != producerWindow || p2[2][0] != (producerAppend{7, 42, 1469067554000}) {
+		t.Errorf("bad snapshot: %d %v", nextOffset, p2)
+	}
+}
+
+func TestProducersExpiry(t *testing.T) {
+	store := &snapshotTestStore{newTestStore(t), map[string][]byte{}}
+	defer store.Remove()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	// every append rolls the segment
+	config := Config{MaxSegmentSize: 1, MaxSyncLag: -1, Idempotent: true, Transactional: true,
+		ProducerExpiry: time.Hour, Clock: testClock(now)}
+	l, err := Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aborted := NewMessage(Timestamp(now), nil, []byte("aborted"))
+	aborted.SetTransactional(1, 0)
+	idle := NewMessage(Timestamp(now.Add(-2*time.Hour)), nil, []byte("idle"))
+	idle.SetProducer(2, 0)
+	recent := NewMessage(Timestamp(now), nil, []byte("recent"))
+	recent.SetProducer(3, 0)
+	for _, msg := range []*Message{aborted, NewControlMessage(0, 1, AbortMarker), idle, recent} {
+		if _, err := l.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := l.producers[2]; ok || len(l.producers) != 2 || len(l.transactions.aborted) != 1 {
+		t.Errorf("idle producer not expired: %v %v", l.producers, l.transactions.aborted)
+	}
+	l.Close()
+
+	// the segments of the first producer are removed
+	segments, _ := store.Segments()
+	for _, segment := range segments {
+		if segment.StartOffset() < 3 {
+			os.Remove(segment.(*testSegment).fileName)
+		}
+	}
+	l, err = Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, ok := l.producers[3]; !ok || len(l.producers) != 1 || len(l.transactions.aborted) != 0 {
+		t.Errorf("producers before the start of the log not expired: %v %v", l.producers, l.transactions.aborted)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 )
 
 var (
@@ -18,6 +19,10 @@ type Reader struct {
 
 	bufferSize int
 	buf        *bufio.Reader
+	// memory reused by NextInto
+	raw          []byte
+	preMessage   [8 + 4]byte
+	binaryReader BinaryReader
 }
 
 type ReaderBackend interface {
@@ -30,7 +35,7 @@ func NewReader(backend ReaderBackend, position int64, bufferSize int) *Reader {
 	if bufferSize == 0 {
 		bufferSize = 4096
 	}
-	r := &Reader{backend, position, bufferSize, nil}
+	r := &Reader{ReaderBackend: backend, position: position, bufferSize: bufferSize}
 	r.resetBufio()
 	return r
 }
@@ -50,27 +55,38 @@ func (lr *Reader) SeekToEnd() (uint64, error) {
 		case io.EOF:
 			return lastValidOffset, nil
 		default:
-			return 0, err
+			return lastValidOffset, err
 		}
 	}
 }
 
+// Seek to the message with the given offset, or the first one after it. Messages before it are
+// skipped without being read nor checked. Returns io.EOF if there's no such message yet.
 func (lr *Reader) SeekToOffset(offset uint64) error {
 	// back to the start
 	if _, err := lr.Seek(0, 0); err != nil {
 		return err
 	}
+	lr.position = 0
+	lr.resetBufio()
 
 	for {
 		positionBeforeRead := lr.position
-		offset, err := lr.FastRead()
-		if err != nil {
-			return err
+		messageOffset, size, r := lr.readPreMessage()
+		if r.err != nil {
+			return r.err
 		}
-		if offset >= offset {
+		if messageOffset >= offset {
 			lr.position = positionBeforeRead
 			return lr.rewind()
 		}
+		// skip the message, in the buffer if it's there
+		lr.updatePosition(size)
+		if int(size) <= lr.buf.Buffered() {
+			lr.buf.Discard(int(size))
+		} else if err := lr.rewind(); err != nil {
+			return err
+		}
 	}
 }
 
@@ -93,7 +109,7 @@ func (lr *Reader) FastRead() (uint64, error) {
 	}
 	h := crc32.NewIEEE()
 	// we hash only "size-4" because we just read the CRC (4 bytes)
-	if _, err := io.CopyN(h, lr, int64(size)-4); err != nil {
+	if _, err := io.CopyN(h, lr.buf, int64(size)-4); err != nil {
 		return failure(err)
 	}
 	if crc != h.Sum32() {
@@ -104,9 +120,15 @@ func (lr *Reader) FastRead() (uint64, error) {
 }
 
 func (lr *Reader) readPreMessage() (uint64, uint32, *BinaryReader) {
-	r := &BinaryReader{lr, nil}
-	offset := r.ReadUint64()
-	size := r.ReadUint32()
+	// reuse the reader's memory, reads must not allocate
+	r := &lr.binaryReader
+	*r = BinaryReader{lr.buf, nil}
+	var offset uint64
+	var size uint32
+	if r.read(lr.preMessage[:]) {
+		offset = byteOrder.Uint64(lr.preMessage[:8])
+		size = byteOrder.Uint32(lr.preMessage[8:])
+	}
 	if r.err == nil && size == 0 {
 		r.err = BadCRC
 	}
@@ -118,38 +140,126 @@ func (lr *Reader) readPreMessage() (uint64, uint32, *BinaryReader) {
 
 // Read and check the next message.
 func (lr *Reader) Next() (uint64, *Message, error) {
-	var offset uint64
-
 	offset, size, r := lr.readPreMessage()
 	if r.err != nil {
 		return 0, nil, r.err
 	}
-	msg, err := lr.readMessage(r)
-	if err != nil {
+	msg := &Message{}
+	if err := lr.readInto(msg, make([]byte, size), r); err != nil {
+		return 0, nil, err
+	}
+	return offset, msg, nil
+}
+
+// Read and check the next message into msg, reusing its memory and the reader's.
+// The key, payload and header values of msg are only valid until the next call.
+func (lr *Reader) NextInto(msg *Message) (uint64, error) {
+	offset, size, r := lr.readPreMessage()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if cap(lr.raw) < int(size) {
+		lr.raw = make([]byte, size)
+	}
+	if err := lr.readInto(msg, lr.raw[:size], r); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// Read the message of len(raw) bytes after its offset and size, check its CRC in one pass over
+// the raw bytes and decode it.
+func (lr *Reader) readInto(msg *Message, raw []byte, r *BinaryReader) error {
+	failure := func(err error) error {
 		lr.rewind()
+		if err == io.EOF {
+			err = UnexpectedEOF
+		}
+		return err
 	}
-	if err == io.EOF {
-		err = UnexpectedEOF
+	if !r.read(raw) {
+		return failure(r.err)
 	}
-	lr.updatePosition(size)
-	return offset, msg, err
+	if len(raw) < 4 || byteOrder.Uint32(raw) != crc32.ChecksumIEEE(raw[4:]) {
+		return failure(BadCRC)
+	}
+	if err := msg.decode(raw); err != nil {
+		return failure(err)
+	}
+	lr.updatePosition(uint32(len(raw)))
+	return nil
 }
 
-func (lr *Reader) readMessage(r *BinaryReader) (*Message, error) {
-	var size uint32
+// Read the next message without decoding nor checking it.
+// Returns the offset and the raw message bytes, starting with the CRC.
+func (lr *Reader) NextRaw() (uint64, []byte, error) {
+	offset, size, r := lr.readPreMessage()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	raw := make([]byte, size)
+	if !r.read(raw) {
+		lr.rewind()
+		if r.err == io.EOF {
+			return 0, nil, UnexpectedEOF
+		}
+		return 0, nil, r.err
+	}
+	lr.updatePosition(size)
+	return offset, raw, nil
+}
 
-	l := &Message{}
-	if err := l.ReadFrom(lr); err != nil {
-		return nil, err
+// Read the next message, checking the key, timestamp and attributes conditions of the filter
+// before reading the payload. Returns a nil message if the message is rejected by the filter.
+func (lr *Reader) NextFiltered(filter *Filter) (uint64, *Message, error) {
+	offset, size, r := lr.readPreMessage()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	failure := func(err error) (uint64, *Message, error) {
+		lr.rewind()
+		if err == io.EOF {
+			err = UnexpectedEOF
+		}
+		return 0, nil, err
 	}
 
-	if l.ComputeCRC() != l.CRC {
-		return nil, BadCRC
+	msg := &Message{}
+	msg.CRC = r.ReadUint32()
+	if r.err != nil {
+		return failure(r.err)
 	}
 
+	// hash while decoding, so rejected messages are checked without being decoded
+	h := crc32.NewIEEE()
+	remaining := &io.LimitedReader{R: lr.buf, N: int64(size) - 4}
+	mr := &BinaryReader{io.TeeReader(remaining, h), nil}
+
+	if err := msg.readHead(mr); err != nil {
+		return failure(err)
+	}
+	accepted := filter.acceptsHead(msg)
+	if accepted {
+		msg.readBody(mr)
+		if mr.err != nil {
+			return failure(mr.err)
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, mr.Reader); err != nil {
+		return failure(err)
+	}
+	if remaining.N != 0 {
+		return failure(UnexpectedEOF)
+	}
+	if msg.CRC != h.Sum32() {
+		return failure(BadCRC)
+	}
 	lr.updatePosition(size)
 
-	return l, nil
+	if !accepted || !filter.acceptsBody(msg) {
+		return offset, nil, nil
+	}
+	return offset, msg, nil
 }
 
 func (lr *Reader) updatePosition(messageSize uint32) {
@@ -164,6 +274,17 @@ func (lr *Reader) rewind() error {
 	return err
 }
 
+// Reset the buffer, which must be done after seeking in the backend.
 func (lr *Reader) resetBufio() {
-	lr.buf = bufio.NewReaderSize(lr, lr.bufferSize)
+	if lr.buf == nil || lr.buf.Size() != lr.bufferSize {
+		lr.buf = bufio.NewReaderSize(lr.ReaderBackend, lr.bufferSize)
+	} else {
+		lr.buf.Reset(lr.ReaderBackend)
+	}
+}
+
+// Change the size of the read buffer, larger buffers making less reads of the backend.
+func (lr *Reader) SetBufferSize(size int) error {
+	lr.bufferSize = size
+	return lr.rewind()
 }
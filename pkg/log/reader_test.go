@@ -0,0 +1,128 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTestSegment(t *testing.T, messages ...*Message) *os.File {
+	f, err := ioutil.TempFile("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+
+	w := NewWriter(f, 0, 0)
+	for i, m := range messages {
+		if _, err := w.Append(uint64(i+1), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReaderPosition(t *testing.T) {
+	m := NewMessage(1469067554, []byte("key"), []byte("data"))
+	f := writeTestSegment(t, m, m, m)
+	defer f.Close()
+
+	r := NewReader(f, 0, 0)
+	for i := 1; i <= 3; i++ {
+		offset, _, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != uint64(i) {
+			t.Errorf("bad offset: %d != %d", offset, i)
+		}
+		if expected := int64(i) * int64(8+4+m.Len()); r.Position() != expected {
+			t.Errorf("bad position: %d != %d", r.Position(), expected)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Error("expected EOF, got ", err)
+	}
+}
+
+func TestReaderNextRaw(t *testing.T) {
+	m := NewMessage(1469067554, []byte("key"), []byte("data"))
+	f := writeTestSegment(t, m)
+	defer f.Close()
+
+	r := NewReader(f, 0, 0)
+	offset, raw, err := r.NextRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 1 || len(raw) != int(m.Len()) {
+		t.Errorf("bad raw message: offset %d, %d bytes", offset, len(raw))
+	}
+}
+
+func TestReaderSeekToOffset(t *testing.T) {
+	m := NewMessage(1469067554, []byte("key"), []byte("data"))
+	f := writeTestSegment(t, m, m, m)
+	defer f.Close()
+
+	r := NewReader(f, 0, 0)
+	for _, expected := range []uint64{3, 1, 2} {
+		if err := r.SeekToOffset(expected); err != nil {
+			t.Fatal(err)
+		}
+		offset, _, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != expected {
+			t.Errorf("bad offset: %d != %d", offset, expected)
+		}
+	}
+	if err := r.SeekToOffset(4); err != io.EOF {
+		t.Error("expected EOF, got ", err)
+	}
+}
+
+func TestReaderNextInto(t *testing.T) {
+	f := writeTestSegment(t,
+		NewMessageWithHeaders(1, []byte("k1"), []byte("v1"), []Header{{"h", []byte("a")}}),
+		NewMessageWithHeaders(2, []byte("k2"), []byte("v2"), []Header{{"h", []byte("b")}}),
+		NewMessage(3, []byte("k3"), []byte("v3")))
+	defer f.Close()
+
+	r := NewReader(f, 0, 0)
+	msg := &Message{}
+	for i := 1; i <= 3; i++ {
+		offset, err := r.NextInto(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != uint64(i) || msg.Timestamp != uint64(i) || string(msg.Payload) != fmt.Sprint("v", i) {
+			t.Errorf("bad message at %d: %+v", offset, msg)
+		}
+	}
+	if len(msg.Headers) != 0 {
+		t.Error("headers of a previous message: ", msg.Headers)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		r.SeekToOffset(2)
+		r.NextInto(msg)
+	})
+	if allocs != 0 {
+		t.Error("allocations per NextInto: ", allocs)
+	}
+
+	f.Seek(0, 0)
+	r = NewReader(f, 0, 0)
+	r.NextInto(msg)
+	msg.Payload[0] = 'x' // corrupt the reused buffer, not the file
+	if _, err := r.NextInto(msg); err != nil || string(msg.Header("h")) != "b" {
+		t.Errorf("bad second message: %v, %+v", err, msg)
+	}
+}
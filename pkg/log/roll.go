@@ -0,0 +1,160 @@
+package log
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Start the age of the active segment, scheduling its roll. Called with the write mutex held.
+func (l *Log) startSegmentAge(start time.Time) {
+	l.segmentStart = start
+	if l.rollTimer != nil {
+		l.rollTimer.Stop()
+		l.rollTimer = nil
+	}
+
+	age := l.config.MaxSegmentAge
+	if age <= 0 {
+		l.rollAt = time.Time{}
+		return
+	}
+	if jitter := l.config.MaxSegmentAgeJitter; jitter > 0 {
+		if jitter > age {
+			jitter = age
+		}
+		age -= time.Duration(rand.Int63n(int64(jitter)))
+	}
+	l.rollAt = start.Add(age)
+	l.rollTimer = time.AfterFunc(time.Until(l.rollAt), l.rollIfDue)
+}
+
+func (l *Log) segmentTooOld() bool {
+	return !l.rollAt.IsZero() && !time.Now().Before(l.rollAt)
+}
+
+// Roll the active segment if it's too old, for logs without appends.
+func (l *Log) rollIfDue() {
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+
+	if l.closed || !l.segmentTooOld() {
+		return
+	}
+	// on failure, the next append will try again
+	l.rollSegment()
+}
+
+// Seal the active segment and start a new one. Called with the write mutex held.
+func (l *Log) rollSegment() error {
+	if err := l.switchSegment(); err != nil {
+		return err
+	}
+	l.sealedBytes += l.activeBytes
+	l.activeBytes = 0
+	l.metrics.activeBytes.Set(0)
+
+	// the new segment is empty, its age starts with its first message
+	l.segmentStart = time.Time{}
+	l.rollAt = time.Time{}
+	if l.rollTimer != nil {
+		l.rollTimer.Stop()
+		l.rollTimer = nil
+	}
+	return nil
+}
+
+// The time of the first message of a segment, or now if it's unknown or in the future.
+func firstMessageTime(segment Segment) time.Time {
+	now := time.Now()
+	reader, err := segment.Reader()
+	if err != nil {
+		return now
+	}
+	defer reader.Close()
+
+	_, msg, err := reader.Next()
+	if err != nil || msg.Timestamp == 0 {
+		return now
+	}
+	if t := TimeOf(msg.Timestamp); t.Before(now) {
+		return t
+	}
+	return now
+}
+
+type preparedSegment struct {
+	segment PreparedSegment
+	err     error
+}
+
+// Prepare the next segment in the background, if the store supports it and it's not done yet.
+// Called with the segment switch mutex held, or before the log is used.
+func (l *Log) prepareSegment() {
+	store, ok := l.store.(PreparingStore)
+	if !ok || l.preparingPending {
+		return
+	}
+	size := int64(0)
+	if l.config.PreallocateSegments {
+		size = l.config.MaxSegmentSize
+	}
+
+	l.preparingPending = true
+	go func() {
+		segment, err := store.PrepareSegment(size)
+		l.preparing <- preparedSegment{segment, err}
+	}()
+}
+
+// The prepared segment, if it's ready. Called with the segment switch mutex held.
+func (l *Log) takePreparedSegment() PreparedSegment {
+	select {
+	case prepared := <-l.preparing:
+		l.preparingPending = false
+		if prepared.err != nil {
+			// the segment is added by the store instead, the next roll will try again
+			return nil
+		}
+		return prepared.segment
+	default:
+		return nil
+	}
+}
+
+// Wait for the segment being prepared and remove it.
+func (l *Log) discardPreparedSegment() {
+	l.segmentSwitchMutex.Lock()
+	defer l.segmentSwitchMutex.Unlock()
+
+	if l.preparingPending {
+		prepared := <-l.preparing
+		l.preparingPending = false
+		if prepared.err == nil {
+			prepared.segment.Discard()
+		}
+	}
+	if l.sealed != nil {
+		<-l.sealed
+	}
+}
+
+// Sync and close the appender of a sealed segment in the background, after the segments already
+// being sealed, and write its checkpoint if not nil. Called with the segment switch mutex held.
+func (l *Log) sealInBackground(appender SegmentAppender, segment Segment, checkpoint *checkpoint) {
+	previous := l.sealed
+	sealed := make(chan struct{})
+	l.sealed = sealed
+
+	go func() {
+		appender.Sync()
+		if err := l.writeCheckpoint(checkpoint); err != nil {
+			l.checkpointFailed(err)
+		}
+		appender.Close()
+		if previous != nil {
+			<-previous
+		}
+		l.observers.push(event{kind: segmentSealedEvent, segment: segment})
+		close(sealed)
+	}()
+}
@@ -0,0 +1,294 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitSegments(t *testing.T, l *Log, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(l.Segments()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d segments, got %d", n, len(l.Segments()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxSegmentAge(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	config := Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1, MaxSegmentAge: 50 * time.Millisecond}
+	l, err := Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty segment is never rolled
+	time.Sleep(100 * time.Millisecond)
+	if n := len(l.Segments()); n != 1 {
+		t.Fatal("empty segment rolled, segments: ", n)
+	}
+
+	// rolled by the timer
+	l.Append(NewMessage(Timestamp(time.Now()), nil, []byte("v1")))
+	waitSegments(t, l, 2)
+	time.Sleep(100 * time.Millisecond)
+	waitSegments(t, l, 2)
+
+	l.Append(NewMessage(Timestamp(time.Now().Add(-time.Hour)), nil, []byte("v2")))
+	l.Close()
+
+	// the age of the active segment starts with its first message, so it's rolled by the next append
+	config.MaxSegmentAge = time.Minute
+	if l, err = Open(config, store); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	offset, err := l.Append(NewMessage(Timestamp(time.Now()), nil, []byte("v3")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := l.Segments()
+	if len(segments) != 3 || segments[2].StartOffset() != offset {
+		t.Fatalf("segment not rolled before offset %d: %d segments", offset, len(segments))
+	}
+}
+
+// A test store preparing its segments, counting the segments added without being prepared.
+type preparingTestStore struct {
+	*testStore
+	added int
+}
+
+type preparedTestSegment struct {
+	store *preparingTestStore
+	file  *os.File
+}
+
+func (s *preparingTestStore) AddSegment(startOffset uint64) (Segment, error) {
+	s.added++
+	return s.testStore.AddSegment(startOffset)
+}
+
+func (s *preparingTestStore) PrepareSegment(size int64) (PreparedSegment, error) {
+	f, err := os.Create(filepath.Join(s.dir, "next"))
+	if err != nil {
+		return nil, err
+	}
+	return &preparedTestSegment{s, f}, nil
+}
+
+func (p *preparedTestSegment) Add(startOffset uint64) (Segment, SegmentAppender, error) {
+	name := filepath.Join(p.store.dir, fmt.Sprintf("%020d.log", startOffset))
+	if err := os.Rename(p.file.Name(), name); err != nil {
+		return nil, nil, err
+	}
+	return &testSegment{name, startOffset}, NewWriter(p.file, 0, 0), nil
+}
+
+func (p *preparedTestSegment) Discard() error {
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
+
+func TestPreparedSegments(t *testing.T) {
+	store := &preparingTestStore{testStore: newTestStore(t)}
+	defer store.Remove()
+
+	o := &recordingObserver{}
+	m := NewMessage(1, nil, []byte("data"))
+	l, err := Open(Config{MaxSegmentSize: int64(8+4+m.Len()) - 1, MaxSyncLag: 0, Observers: []Observer{o}}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first segment is added by the store, when opening the log
+	store.added = 0
+
+	for i := 0; i < 5; i++ {
+		// lets the next segment be prepared
+		time.Sleep(10 * time.Millisecond)
+		if _, err := l.Append(m); err != nil {
+			t.Fatal(err)
+		}
+		if sync := l.SyncOffset(); sync != uint64(i+1) {
+			t.Fatalf("sync offset %d after appending %d", sync, i+1)
+		}
+	}
+	if store.added != 0 {
+		t.Errorf("%d segments added without being prepared", store.added)
+	}
+	if n := len(l.Segments()); n != 6 {
+		t.Fatal("expected 6 segments, got ", n)
+	}
+
+	c, err := l.Consumer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		if offset, _, err := c.Next(); err != nil || offset != i {
+			t.Fatalf("expected offset %d, got %d, %v", i, offset, err)
+		}
+	}
+	c.Close()
+	l.Close()
+
+	sealed := 0
+	for _, event := range o.events {
+		if strings.HasPrefix(event, "sealed") {
+			sealed++
+		}
+	}
+	if sealed != 5 || o.events[len(o.events)-1] != "closed" {
+		t.Errorf("unexpected events: %q", o.events)
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, "next")); !os.IsNotExist(err) {
+		t.Error("prepared segment not removed: ", err)
+	}
+}
+
+func TestPreparedSegmentLost(t *testing.T) {
+	store := &preparingTestStore{testStore: newTestStore(t)}
+	defer store.Remove()
+
+	m := NewMessage(1, nil, []byte("data"))
+	l, err := Open(Config{MaxSegmentSize: int64(8+4+m.Len()) - 1, MaxSyncLag: 0}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	store.added = 0
+
+	// the prepared segment is removed before the roll, the store adds the next segment instead
+	time.Sleep(10 * time.Millisecond)
+	os.Remove(filepath.Join(store.dir, "next"))
+	for i := 0; i < 3; i++ {
+		if _, err := l.Append(m); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.added != 1 {
+		t.Errorf("%d segments added without being prepared, expected 1", store.added)
+	}
+	if n := len(l.Segments()); n != 4 {
+		t.Error("expected 4 segments, got ", n)
+	}
+}
+
+// A prepared segment whose appender syncs once released.
+type blockingPreparedSegment struct {
+	PreparedSegment
+	release chan struct{}
+}
+
+type blockingAppender struct {
+	SegmentAppender
+	release chan struct{}
+}
+
+func (p blockingPreparedSegment) Add(startOffset uint64) (Segment, SegmentAppender, error) {
+	segment, appender, err := p.PreparedSegment.Add(startOffset)
+	return segment, blockingAppender{appender, p.release}, err
+}
+
+func (a blockingAppender) Sync() error {
+	<-a.release
+	return a.SegmentAppender.Sync()
+}
+
+type blockingPreparingStore struct {
+	*preparingTestStore
+	release chan struct{}
+}
+
+func (s blockingPreparingStore) PrepareSegment(size int64) (PreparedSegment, error) {
+	prepared, err := s.preparingTestStore.PrepareSegment(size)
+	return blockingPreparedSegment{prepared, s.release}, err
+}
+
+func TestSyncedSegmentsWhileSealing(t *testing.T) {
+	store := blockingPreparingStore{&preparingTestStore{testStore: newTestStore(t)}, make(chan struct{})}
+	defer store.Remove()
+
+	m := NewMessage(1, nil, []byte("data"))
+	l, err := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the second segment is sealed in the background, its sync being blocked
+	time.Sleep(10 * time.Millisecond)
+	l.rollSegment()
+	time.Sleep(10 * time.Millisecond)
+	l.Append(m)
+	l.rollSegment()
+
+	done := make(chan int)
+	go func() {
+		segments, _ := l.SyncedSegments()
+		done <- len(segments)
+	}()
+	select {
+	case <-done:
+		close(store.release)
+		t.Fatal("segments returned before being synced")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(store.release)
+	if n := <-done; n != 3 {
+		t.Error("expected 3 segments, got ", n)
+	}
+}
+
+// A test store failing to add the given number of segments.
+type failingTestStore struct {
+	*testStore
+	failures int
+}
+
+func (s *failingTestStore) AddSegment(startOffset uint64) (Segment, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("no space left")
+	}
+	return s.testStore.AddSegment(startOffset)
+}
+
+func TestRollFailure(t *testing.T) {
+	store := &failingTestStore{testStore: newTestStore(t)}
+	defer store.Remove()
+
+	m := NewMessage(1, nil, []byte("data"))
+	l, err := Open(Config{MaxSegmentSize: int64(8+4+m.Len()) - 1, MaxSyncLag: 0}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the message is stored even if the segment can't be rolled after it
+	store.failures = 2
+	if offset, err := l.Append(m); err != nil || offset != 1 {
+		t.Fatal("unexpected append: ", offset, err)
+	}
+	if _, err := l.Append(m); err == nil {
+		t.Error("appended without a segment")
+	}
+	if offset, err := l.Append(m); err != nil || offset != 2 {
+		t.Fatal("unexpected append: ", offset, err)
+	}
+	if n := len(l.Segments()); n != 3 {
+		t.Error("expected 3 segments, got ", n)
+	}
+	if l.NextOffset() != 3 {
+		t.Error("unexpected next offset: ", l.NextOffset())
+	}
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"io"
+)
+
+// A state derived from the messages of the log, rebuilt when opening it.
+type logState interface {
+	// Name of the state's snapshots in a SnapshotStore.
+	snapshotName() string
+	// Serialize the state, nextOffset being the offset of the next message to apply.
+	snapshot(nextOffset uint64) []byte
+	// Load a snapshot, returning the offset of the next message to apply.
+	loadSnapshot(data []byte) (uint64, error)
+	// Update the state with an appended message.
+	apply(offset uint64, msg *Message)
+	// Clear the state.
+	reset()
+}
+
+// Rebuild the states from their snapshots, if any, and the messages after them.
+// scanFrom is the offset to start scanning from for each state when it has no snapshot.
+func (l *Log) loadStates(states []logState, scanFrom []uint64) error {
+	snapshots, _ := l.store.(SnapshotStore)
+
+	minScanFrom := l.nextOffset
+	for i, state := range states {
+		if snapshots != nil {
+			data, err := snapshots.ReadSnapshot(state.snapshotName())
+			if err != nil {
+				return err
+			}
+			if data != nil {
+				// an invalid or too recent snapshot is ignored, the segments are authoritative
+				if offset, err := state.loadSnapshot(data); err == nil && offset <= l.nextOffset {
+					scanFrom[i] = offset
+				} else {
+					state.reset()
+				}
+			}
+		}
+		if scanFrom[i] < minScanFrom {
+			minScanFrom = scanFrom[i]
+		}
+	}
+
+	for i, segment := range l.segments {
+		if i+1 < len(l.segments) && l.segments[i+1].StartOffset() <= minScanFrom {
+			continue
+		}
+		if err := l.scanStates(segment, states, scanFrom); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) scanStates(segment Segment, states []logState, scanFrom []uint64) error {
+	reader, err := segment.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		offset, msg, err := reader.Next()
+		if err == io.EOF || err == UnexpectedEOF || err == BadCRC {
+			// end of the valid messages
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i, state := range states {
+			if offset >= scanFrom[i] {
+				state.apply(offset, msg)
+			}
+		}
+	}
+}
+
+// Forget the producers and aborted transactions before the start of the log, and the producers
+// idle for more than Config.ProducerExpiry.
+func (l *Log) expireStates() {
+	startOffset := l.segments[0].StartOffset()
+	if l.producers != nil {
+		minTimestamp := uint64(0)
+		if l.config.ProducerExpiry > 0 {
+			minTimestamp = Timestamp(l.now().Add(-l.config.ProducerExpiry))
+		}
+		l.producers.expire(startOffset, minTimestamp)
+	}
+	if l.transactions != nil {
+		l.transactions.expire(startOffset)
+	}
+}
+
+// Save the states, if the store supports snapshots.
+// Snapshots are only an optimization, the segments are scanned when they're missing.
+func (l *Log) snapshotStates() error {
+	snapshots, ok := l.store.(SnapshotStore)
+	if !ok {
+		return nil
+	}
+	for _, state := range l.states {
+		if err := snapshots.WriteSnapshot(state.snapshotName(), state.snapshot(l.nextOffset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
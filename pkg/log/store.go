@@ -35,14 +35,63 @@ type SegmentReader interface {
 	// Read the next message from the segment.
 	// Returns the offset, the message, and any error that occured while reading.
 	Next() (uint64, *Message, error)
-	// Seek to a given offset
+	// Seek to a given offset, or the first one after it. Returns io.EOF if there is none.
 	SeekToOffset(offset uint64) error
-	// Seek to the end of the segment, returning the last valid offset read.
+	// Seek to the end of the segment, returning the last valid offset read (0 if none).
+	// On error, the reader is positioned after the last valid offset, which is still returned.
 	SeekToEnd() (uint64, error)
 	// Close the reader
 	Close() error
 }
 
+// Optionally implemented by segment readers able to decode messages without allocating them.
+type ReusingSegmentReader interface {
+	// Read the next message into msg. Its key, payload and header values are only valid until the next call.
+	NextInto(msg *Message) (uint64, error)
+}
+
+// Optionally implemented by stores able to keep snapshots of a log's state.
+type SnapshotStore interface {
+	// Write a snapshot, replacing the previous one with the same name.
+	WriteSnapshot(name string, data []byte) error
+	// Read a snapshot. Returns nil data and no error if there's none.
+	ReadSnapshot(name string) ([]byte, error)
+}
+
+// Optionally implemented by stores able to create a segment before knowing its start offset, so
+// the log rolls to it without waiting for the store.
+type PreparingStore interface {
+	// Prepare the next segment, preallocating size bytes if possible and size is not 0.
+	PrepareSegment(size int64) (PreparedSegment, error)
+}
+
+type PreparedSegment interface {
+	// Add the segment to the store, with its appender. Must be cheap.
+	Add(startOffset uint64) (Segment, SegmentAppender, error)
+	// Remove the segment, when it won't be added.
+	Discard() error
+}
+
+// Optionally implemented by segments able to replace their messages, for instance to re-encrypt them.
+type RewritableSegment interface {
+	// An appender to a new version of the segment, replacing it when closed.
+	// Readers opened before keep reading the previous version.
+	Rewrite() (SegmentRewriter, error)
+}
+
+type SegmentRewriter interface {
+	SegmentAppender
+	// Discard the new version of the segment, keeping the current one.
+	Abort() error
+}
+
+// Optionally implemented by stores able to notify the changes made to them, including by other
+// processes, so logs following them don't only poll them.
+type WatchingStore interface {
+	// Call changed after segments are added or written to, until stop is closed.
+	Watch(changed func(), stop <-chan struct{}) error
+}
+
 type ByStartOffset []Segment
 
 func (s ByStartOffset) Len() int {
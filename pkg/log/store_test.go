@@ -0,0 +1,143 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A minimal file based store for tests.
+type testStore struct {
+	dir string
+}
+
+type testSegment struct {
+	fileName    string
+	startOffset uint64
+}
+
+func newTestStore(t *testing.T) *testStore {
+	dir, err := ioutil.TempDir("", "log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testStore{dir}
+}
+
+func (s *testStore) Remove() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *testStore) Segments() ([]Segment, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]Segment, 0, len(names))
+	for _, name := range names {
+		var startOffset uint64
+		fmt.Sscanf(filepath.Base(name), "%d.log", &startOffset)
+		segments = append(segments, &testSegment{name, startOffset})
+	}
+	return segments, nil
+}
+
+func (s *testStore) AddSegment(startOffset uint64) (Segment, error) {
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d.log", startOffset))
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &testSegment{name, startOffset}, nil
+}
+
+func (s *testSegment) StartOffset() uint64 {
+	return s.startOffset
+}
+
+func (s *testSegment) Appender() (SegmentAppender, error) {
+	f, err := os.OpenFile(s.fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReader(f, 0, 0)
+	r.SeekToEnd()
+	return NewWriter(f, r.Position(), 0), nil
+}
+
+func (s *testSegment) Reader() (SegmentReader, error) {
+	f, err := os.Open(s.fileName)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(f, 0, 0), nil
+}
+
+// A store failing the tests writing to it.
+type readOnlyTestStore struct {
+	*testStore
+	t *testing.T
+}
+
+type readOnlyTestSegment struct {
+	Segment
+	t *testing.T
+}
+
+func (s readOnlyTestStore) Segments() ([]Segment, error) {
+	segments, err := s.testStore.Segments()
+	for i, segment := range segments {
+		segments[i] = readOnlyTestSegment{segment, s.t}
+	}
+	return segments, err
+}
+
+func (s readOnlyTestStore) AddSegment(startOffset uint64) (Segment, error) {
+	s.t.Error("segment added to a read-only store")
+	return nil, ReadOnly
+}
+
+func (s readOnlyTestSegment) Appender() (SegmentAppender, error) {
+	s.t.Error("appender of a read-only segment")
+	return nil, ReadOnly
+}
+
+func TestReadOnly(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	if _, err := Open(Config{ReadOnly: true}, readOnlyTestStore{store, t}); err != NoSegments {
+		t.Error("expected NoSegments, got ", err)
+	}
+
+	l, err := Open(Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Append(NewMessage(1, nil, []byte("a")))
+	l.Append(NewMessage(2, nil, []byte("b")))
+
+	r, err := Open(Config{ReadOnly: true, Idempotent: true}, readOnlyTestStore{store, t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.NextOffset() != 3 {
+		t.Error("unexpected next offset: ", r.NextOffset())
+	}
+	if _, err := r.Append(NewMessage(3, nil, []byte("c"))); err != ReadOnly {
+		t.Error("expected ReadOnly, got ", err)
+	}
+	c, err := r.Consumer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, msg, err := c.Next(); err != nil || string(msg.Payload) != "a" {
+		t.Error("unexpected message: ", msg, err)
+	}
+}
@@ -0,0 +1,144 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	UnknownKey  = errors.New("unknown encryption key")
+	NoActiveKey = errors.New("no active encryption key")
+)
+
+// Source of the encryption keys.
+type KeyProvider interface {
+	// The key new messages are encrypted with, and its id.
+	ActiveKey() (id string, key []byte, err error)
+	// The key with the given id, active or retired. Returns UnknownKey if there's none.
+	Key(id string) ([]byte, error)
+}
+
+// Keys stored in a local JSON file:
+//
+//	{"active": "2", "keys": {"1": "<base64 key>", "2": "<base64 key>"}}
+//
+// Keys are AES keys of 16, 24 or 32 bytes. Retired keys stay in the file to read old messages.
+type KeyFile struct {
+	path   string
+	mutex  sync.RWMutex
+	active string
+	keys   map[string][]byte
+}
+
+var _ = KeyProvider(&KeyFile{})
+
+type keyFileData struct {
+	Active string            `json:"active"`
+	Keys   map[string][]byte `json:"keys"`
+}
+
+// Open an existing key file.
+func OpenKeyFile(path string) (*KeyFile, error) {
+	f := &KeyFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Read the file again, for instance after a rotation by another process.
+func (f *KeyFile) Reload() error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	d := keyFileData{}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	for id, key := range d.Keys {
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("%s: key %q: %v", f.path, id, err)
+		}
+	}
+	if _, ok := d.Keys[d.Active]; d.Active != "" && !ok {
+		return fmt.Errorf("%s: active key %q not found", f.path, d.Active)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.active, f.keys = d.Active, d.Keys
+	return nil
+}
+
+func (f *KeyFile) ActiveKey() (string, []byte, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.active == "" {
+		return "", nil, NoActiveKey
+	}
+	return f.active, f.keys[f.active], nil
+}
+
+func (f *KeyFile) Key(id string) ([]byte, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	key, ok := f.keys[id]
+	if !ok {
+		return nil, UnknownKey
+	}
+	return key, nil
+}
+
+// Generate a new 256 bits key and make it the active one, creating the file if needed.
+// The previous keys are retired. Returns the id of the new key.
+func RotateKeyFile(path string) (string, error) {
+	d := keyFileData{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &d); err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if d.Keys == nil {
+		d.Keys = map[string][]byte{}
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	n := len(d.Keys) + 1
+	for d.Keys[strconv.Itoa(n)] != nil {
+		n++
+	}
+	d.Active = strconv.Itoa(n)
+	d.Keys[d.Active] = key
+
+	if data, err = json.MarshalIndent(d, "", "  "); err != nil {
+		return "", err
+	}
+	tmpName := path + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0600); err != nil {
+		return "", err
+	}
+	return d.Active, os.Rename(tmpName, path)
+}
+
+// Rotate the keys of this file (see RotateKeyFile).
+func (f *KeyFile) Rotate() (string, error) {
+	id, err := RotateKeyFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	return id, f.Reload()
+}
@@ -0,0 +1,153 @@
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+// The header giving the id of the key of an encrypted message.
+const KeyIDHeader = "encryption-key"
+
+var InvalidMessage = errors.New("invalid encrypted message")
+
+// Encrypts and decrypts messages, caching the ciphers of the keys.
+type codec struct {
+	keys  KeyProvider
+	mutex sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+func newCodec(keys KeyProvider) *codec {
+	return &codec{keys: keys, aeads: map[string]cipher.AEAD{}}
+}
+
+func (c *codec) aead(id string, key []byte) (cipher.AEAD, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	if key == nil {
+		var err error
+		if key, err = c.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// The message encrypted with the active key, the given one being left untouched.
+//
+// The format, key and payload are sealed with AES-GCM, bound to the offset. The encrypted message
+// has the same attributes (plus log.EncryptedAttribute), timestamp, producer and headers, so the
+// log can still use them, and the id of the key is added as last header.
+// Control messages are not encrypted.
+func (c *codec) encrypt(offset uint64, msg *log.Message) (*log.Message, error) {
+	if msg.IsControl() || msg.IsEncrypted() {
+		return msg, nil
+	}
+	id, key, err := c.keys.ActiveKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := bytes.NewBuffer(make([]byte, 0, 1+8+len(msg.Key)+len(msg.Payload)))
+	w := log.NewBinaryWriter(plain)
+	w.WriteByte(msg.Format)
+	w.WriteBytes(msg.Key)
+	w.WriteBytes(msg.Payload)
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+plain.Len()+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	headers := make([]log.Header, len(msg.Headers), len(msg.Headers)+1)
+	copy(headers, msg.Headers)
+	encrypted := &log.Message{
+		Format:     2,
+		Attributes: msg.Attributes | log.EncryptedAttribute,
+		Timestamp:  msg.Timestamp,
+		ProducerID: msg.ProducerID,
+		Sequence:   msg.Sequence,
+		Payload:    aead.Seal(nonce, nonce, plain.Bytes(), additionalData(offset)),
+		Headers:    append(headers, log.Header{Key: KeyIDHeader, Value: []byte(id)}),
+	}
+	encrypted.UpdateCRC()
+	return encrypted, nil
+}
+
+// Decrypt a message in place. Plain messages are left untouched.
+func (c *codec) decrypt(offset uint64, msg *log.Message) error {
+	if !msg.IsEncrypted() {
+		return nil
+	}
+	n := len(msg.Headers) - 1
+	if n < 0 || msg.Headers[n].Key != KeyIDHeader {
+		return InvalidMessage
+	}
+	aead, err := c.aead(string(msg.Headers[n].Value), nil)
+	if err != nil {
+		return err
+	}
+	if len(msg.Payload) < aead.NonceSize() {
+		return InvalidMessage
+	}
+	nonce, sealed := msg.Payload[:aead.NonceSize()], msg.Payload[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, additionalData(offset))
+	if err != nil {
+		return err
+	}
+
+	r := log.BinaryReader{Reader: bytes.NewReader(plain)}
+	format := r.ReadByte()
+	key := r.ReadBytes()
+	payload := r.ReadBytes()
+	if r.Err() != nil {
+		return InvalidMessage
+	}
+
+	msg.Format = format
+	msg.Attributes &^= log.EncryptedAttribute
+	msg.Key, msg.Payload = key, payload
+	msg.Headers = msg.Headers[:n]
+	if len(msg.Headers) == 0 {
+		msg.Headers = nil
+	}
+	msg.UpdateCRC()
+	return nil
+}
+
+// The id of the key of an encrypted message.
+func keyID(msg *log.Message) string {
+	if !msg.IsEncrypted() {
+		return ""
+	}
+	return string(msg.Header(KeyIDHeader))
+}
+
+func additionalData(offset uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, offset)
+	return data
+}
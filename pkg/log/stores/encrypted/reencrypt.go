@@ -0,0 +1,99 @@
+package encrypted
+
+import (
+	"io"
+	"sort"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+// Rewrite the sealed segments (all but the last one) having messages that are not encrypted
+// with the active key, for instance before removing a retired key. Returns the number of
+// rewritten segments.
+//
+// The underlying segments must implement log.RewritableSegment. The log may be open, readers of
+// a segment keep reading its previous version, but it must not roll segments meanwhile.
+func (s *Store) Reencrypt() (int, error) {
+	segments, err := s.store.Segments()
+	if err != nil {
+		return 0, err
+	}
+	activeID, _, err := s.codec.keys.ActiveKey()
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Sort(log.ByStartOffset(segments))
+	rewritten := 0
+	for i := 0; i < len(segments)-1; i++ {
+		segment := segments[i]
+		stale, err := s.hasStaleMessages(segment, activeID)
+		if err != nil {
+			return rewritten, err
+		}
+		if !stale {
+			continue
+		}
+		if err := s.reencrypt(segment); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// Check if the segment has messages that are plain or encrypted with another key than activeID.
+func (s *Store) hasStaleMessages(segment log.Segment, activeID string) (bool, error) {
+	r, err := segment.Reader()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	for {
+		_, msg, err := r.Next()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if !msg.IsControl() && keyID(msg) != activeID {
+			return true, nil
+		}
+	}
+}
+
+func (s *Store) reencrypt(segment log.Segment) error {
+	rewritable, ok := segment.(log.RewritableSegment)
+	if !ok {
+		return NotSupported
+	}
+	r, err := segment.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := rewritable.Rewrite()
+	if err != nil {
+		return err
+	}
+	a := &appender{w, s.codec}
+	for {
+		offset, msg, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.Abort()
+			return err
+		}
+		if err := s.codec.decrypt(offset, msg); err != nil {
+			w.Abort()
+			return err
+		}
+		if _, err := a.Append(offset, msg); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Close()
+}
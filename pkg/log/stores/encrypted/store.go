@@ -0,0 +1,201 @@
+// Encryption at rest of the messages of a store.
+//
+// The keys and payloads of the messages are encrypted when appended to the segments, and
+// decrypted when read, so the log and its consumers only see plain messages. The segments can
+// hold messages encrypted with different keys, old ones being readable as long as their key is
+// provided, and messages written before the encryption was enabled.
+package encrypted
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+var NotSupported = errors.New("not supported by the underlying store")
+
+// A store encrypting the messages of another one.
+type Store struct {
+	store log.Store
+	codec *codec
+}
+
+var (
+	_ = log.Store(&Store{})
+	_ = log.SnapshotStore(&Store{})
+	_ = log.PreparingStore(&Store{})
+	_ = log.WatchingStore(&Store{})
+	_ = io.Closer(&Store{})
+)
+
+func New(store log.Store, keys KeyProvider) *Store {
+	return &Store{store, newCodec(keys)}
+}
+
+func (s *Store) Segments() ([]log.Segment, error) {
+	segments, err := s.store.Segments()
+	if err != nil {
+		return nil, err
+	}
+	for i, segment := range segments {
+		segments[i] = &Segment{segment, s.codec}
+	}
+	return segments, nil
+}
+
+func (s *Store) AddSegment(startOffset uint64) (log.Segment, error) {
+	segment, err := s.store.AddSegment(startOffset)
+	if err != nil {
+		return nil, err
+	}
+	return &Segment{segment, s.codec}, nil
+}
+
+// Close the underlying store, if it has to be.
+func (s *Store) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Snapshots are not encrypted, they only hold the state of the log.
+func (s *Store) WriteSnapshot(name string, data []byte) error {
+	snapshots, ok := s.store.(log.SnapshotStore)
+	if !ok {
+		// snapshots are only an optimization
+		return nil
+	}
+	return snapshots.WriteSnapshot(name, data)
+}
+
+func (s *Store) ReadSnapshot(name string) ([]byte, error) {
+	snapshots, ok := s.store.(log.SnapshotStore)
+	if !ok {
+		return nil, nil
+	}
+	return snapshots.ReadSnapshot(name)
+}
+
+func (s *Store) Watch(changed func(), stop <-chan struct{}) error {
+	store, ok := s.store.(log.WatchingStore)
+	if !ok {
+		// the log polls the store instead
+		return NotSupported
+	}
+	return store.Watch(changed, stop)
+}
+
+func (s *Store) PrepareSegment(size int64) (log.PreparedSegment, error) {
+	store, ok := s.store.(log.PreparingStore)
+	if !ok {
+		// the log adds the segment instead
+		return nil, NotSupported
+	}
+	prepared, err := store.PrepareSegment(size)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedSegment{prepared, s.codec}, nil
+}
+
+type preparedSegment struct {
+	log.PreparedSegment
+	codec *codec
+}
+
+func (p *preparedSegment) Add(startOffset uint64) (log.Segment, log.SegmentAppender, error) {
+	segment, a, err := p.PreparedSegment.Add(startOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Segment{segment, p.codec}, &appender{a, p.codec}, nil
+}
+
+// A segment of an encrypted store.
+type Segment struct {
+	segment log.Segment
+	codec   *codec
+}
+
+var (
+	_ = log.SizedSegment(&Segment{})
+	_ = log.TimeIndexedSegment(&Segment{})
+)
+
+func (s *Segment) StartOffset() uint64 {
+	return s.segment.StartOffset()
+}
+
+func (s *Segment) Appender() (log.SegmentAppender, error) {
+	a, err := s.segment.Appender()
+	if err != nil {
+		return nil, err
+	}
+	return &appender{a, s.codec}, nil
+}
+
+func (s *Segment) Reader() (log.SegmentReader, error) {
+	r, err := s.segment.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &reader{r, s.codec}, nil
+}
+
+func (s *Segment) Size() (int64, error) {
+	sized, ok := s.segment.(log.SizedSegment)
+	if !ok {
+		return 0, NotSupported
+	}
+	return sized.Size()
+}
+
+// Timestamps are not encrypted, so the bounds are the ones of the underlying segment.
+func (s *Segment) TimestampBounds() (uint64, uint64, bool) {
+	indexed, ok := s.segment.(log.TimeIndexedSegment)
+	if !ok {
+		return 0, 0, false
+	}
+	return indexed.TimestampBounds()
+}
+
+type appender struct {
+	log.SegmentAppender
+	codec *codec
+}
+
+func (a *appender) Append(offset uint64, msg *log.Message) (int64, error) {
+	encrypted, err := a.codec.encrypt(offset, msg)
+	if err != nil {
+		return 0, err
+	}
+	return a.SegmentAppender.Append(offset, encrypted)
+}
+
+type reader struct {
+	log.SegmentReader
+	codec *codec
+}
+
+var _ = log.BufferedSegmentReader(&reader{})
+
+func (r *reader) Next() (uint64, *log.Message, error) {
+	offset, msg, err := r.SegmentReader.Next()
+	if err != nil {
+		return offset, msg, err
+	}
+	if err := r.codec.decrypt(offset, msg); err != nil {
+		return offset, nil, fmt.Errorf("offset %d: %v", offset, err)
+	}
+	return offset, msg, nil
+}
+
+func (r *reader) SetBufferSize(size int) error {
+	if b, ok := r.SegmentReader.(log.BufferedSegmentReader); ok {
+		return b.SetBufferSize(size)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package encrypted
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func appendMessages(t *testing.T, store log.Store, from, to int) {
+	l, err := log.Open(log.Config{MaxSegmentSize: 300, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := from; i <= to; i++ {
+		msg := log.NewMessage(uint64(1000+i), []byte(fmt.Sprint("key ", i)), []byte(fmt.Sprint("message ", i)))
+		if _, err := l.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkMessages(t *testing.T, store log.Store, last int) {
+	l, err := log.Open(log.Config{MaxSegmentSize: 300, MaxSyncLag: -1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := l.Consumer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 1; i <= last; i++ {
+		offset, msg, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != uint64(i) || string(msg.Key) != fmt.Sprint("key ", i) || string(msg.Payload) != fmt.Sprint("message ", i) {
+			t.Fatalf("bad message at %d: %d %q %q", i, offset, msg.Key, msg.Payload)
+		}
+		if msg.IsEncrypted() || msg.Headers != nil || msg.CRC != msg.ComputeCRC() {
+			t.Fatalf("message %d not decrypted: %+v", i, msg)
+		}
+	}
+}
+
+// The key ids of the messages as stored, by segment.
+func storedKeyIDs(t *testing.T, store log.Store) [][]string {
+	segments, err := store.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([][]string, len(segments))
+	for i, segment := range log.ByStartOffset(segments) {
+		r, err := segment.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, msg, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if msg.IsEncrypted() && bytes.Contains(msg.Payload, []byte("message")) {
+				t.Error("plain payload in encrypted message: ", string(msg.Payload))
+			}
+			ids[i] = append(ids[i], keyID(msg))
+		}
+		r.Close()
+	}
+	return ids
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "keys.json")
+	if _, err := RotateKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := OpenKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := kafka.Open(filepath.Join(dir, "log"), 0)
+	store := New(plain, keys)
+
+	// messages written before and after the encryption is enabled, and after a rotation
+	appendMessages(t, plain, 1, 5)
+	appendMessages(t, store, 6, 10)
+	if id, err := keys.Rotate(); err != nil || id != "2" {
+		t.Fatal("rotation failed: ", id, err)
+	}
+	appendMessages(t, store, 11, 15)
+	checkMessages(t, store, 15)
+
+	found := map[string]bool{}
+	for _, segment := range storedKeyIDs(t, plain) {
+		for _, id := range segment {
+			found[id] = true
+		}
+	}
+	if !found[""] || !found["1"] || !found["2"] {
+		t.Error("unexpected key ids: ", found)
+	}
+
+	n, err := store.Reencrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("no segment rewritten")
+	}
+	ids := storedKeyIDs(t, plain)
+	for _, segment := range ids[:len(ids)-1] {
+		for _, id := range segment {
+			if id != "2" {
+				t.Fatal("segment not re-encrypted: ", segment)
+			}
+		}
+	}
+	checkMessages(t, store, 15)
+
+	if n, err := store.Reencrypt(); err != nil || n != 0 {
+		t.Error("segments rewritten twice: ", n, err)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := filepath.Join(dir, "keys.json")
+	other := filepath.Join(dir, "other.json")
+	for _, path := range []string{keys, other} {
+		if _, err := RotateKeyFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k, _ := OpenKeyFile(keys)
+	o, _ := OpenKeyFile(other)
+
+	c := newCodec(k)
+	encrypted, err := c.encrypt(1, log.NewMessage(1, nil, []byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := *encrypted
+	if err := newCodec(o).decrypt(1, &msg); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+	msg = *encrypted
+	if err := c.decrypt(2, &msg); err == nil {
+		t.Error("decrypted at another offset")
+	}
+	msg = *encrypted
+	if err := c.decrypt(1, &msg); err != nil || string(msg.Payload) != "secret" {
+		t.Error("decryption failed: ", err)
+	}
+}
@@ -0,0 +1,80 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	Locked   = errors.New("log directory locked by another process")
+	ReadOnly = errors.New("read-only store")
+)
+
+// The file locked by the process writing to a store, holding its PID.
+const lockFileName = "lock"
+
+// Take the lock of the store's directory before writing to it, unless it's already taken.
+// The lock is released by Close, or when the process exits.
+func (s *Store) lock() error {
+	if s.readOnly {
+		return ReadOnly
+	}
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+
+	if s.lockFile != nil {
+		return nil
+	}
+	if err := s.mkdirs(); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, lockFileName)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := flock(f); err != nil {
+		f.Close()
+		if err != Locked {
+			return err
+		}
+		holder := "unknown"
+		if data, err := ioutil.ReadFile(name); err == nil && len(data) != 0 {
+			holder = strings.TrimSpace(string(data))
+		}
+		return fmt.Errorf("%v: %s is held by process %s", Locked, name, holder)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintln(os.Getpid())), 0)
+	}
+	s.lockFile = f
+
+	if !s.staleRemoved {
+		// the segments prepared by previous runs, never added
+		if stale, err := filepath.Glob(filepath.Join(s.dir, nextSegmentPattern)); err == nil {
+			for _, name := range stale {
+				os.Remove(name)
+			}
+		}
+		s.staleRemoved = true
+	}
+	return nil
+}
+
+// Release the lock of the store's directory, if it's taken. Writing to the store takes it again.
+func (s *Store) Close() error {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+
+	if s.lockFile == nil {
+		return nil
+	}
+	err := s.lockFile.Close()
+	s.lockFile = nil
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package kafka
+
+import "os"
+
+// Lock a file exclusively (not supported on this system).
+func flock(f *os.File) error {
+	return nil
+}
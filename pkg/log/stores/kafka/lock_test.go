@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a segment prepared by a previous run
+	stale := filepath.Join(dir, "next-stale.segment")
+	if err := ioutil.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := Open(dir, 0)
+	defer writer.Close()
+	if _, err := writer.AddSegment(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale prepared segment not removed: ", err)
+	}
+
+	other := Open(dir, 0)
+	defer other.Close()
+	segments, err := other.Segments()
+	if err != nil || len(segments) != 1 {
+		t.Fatal("reading an open store failed: ", segments, err)
+	}
+	_, err = segments[0].Appender()
+	if err == nil || !strings.Contains(err.Error(), Locked.Error()) || !strings.Contains(err.Error(), fmt.Sprint("process ", os.Getpid())) {
+		t.Error("expected a lock error naming the holder, got ", err)
+	}
+
+	readOnly := OpenReadOnly(dir, 0)
+	segments, err = readOnly.Segments()
+	if err != nil || len(segments) != 1 {
+		t.Fatal("reading a read-only store failed: ", segments, err)
+	}
+	if _, err := segments[0].Appender(); err != ReadOnly {
+		t.Error("expected ReadOnly, got ", err)
+	}
+	if err := readOnly.WriteSnapshot("test", nil); err != ReadOnly {
+		t.Error("expected ReadOnly, got ", err)
+	}
+
+	// the segment prepared by the writer is left alone
+	prepared, err := writer.PrepareSegment(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.PrepareSegment(0); err == nil {
+		t.Error("prepared a segment of a locked store")
+	}
+	// preparing another one leaves the pending one alone
+	next, err := writer.PrepareSegment(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, appender, err := prepared.Add(2); err != nil {
+		t.Error("the prepared segment was removed: ", err)
+	} else {
+		appender.Close()
+	}
+	if err := next.Discard(); err != nil {
+		t.Error("the prepared segment was removed: ", err)
+	}
+
+	writer.Close()
+	if _, err := other.AddSegment(2); err != nil {
+		t.Error("the lock was not released: ", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package kafka
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock a file exclusively, returning Locked if another process has the lock.
+func flock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return Locked
+	}
+	return err
+}
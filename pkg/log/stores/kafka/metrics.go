@@ -0,0 +1,29 @@
+package kafka
+
+import (
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
+)
+
+type storeMetrics struct {
+	segmentsAdded  metrics.Counter
+	crcFailures    metrics.Counter
+	recoveredTails metrics.Counter
+	lostBytes      metrics.Counter
+}
+
+func newStoreMetrics(r metrics.Registry, labels metrics.Labels) *storeMetrics {
+	if r == nil {
+		r = metrics.Discard
+	}
+	return &storeMetrics{
+		segmentsAdded:  r.Counter("cebaka_store_segments_added_total", "Segments added to the store.", labels),
+		crcFailures:    r.Counter("cebaka_store_crc_failures_total", "Bad CRCs found when opening segments.", labels),
+		recoveredTails: r.Counter("cebaka_store_recovered_tails_total", "Segments opened with an invalid tail.", labels),
+		lostBytes:      r.Counter("cebaka_store_lost_bytes_total", "Bytes lost in invalid segment tails.", labels),
+	}
+}
+
+// Report metrics to the given registry. Must be called before using the store.
+func (s *Store) SetMetrics(r metrics.Registry, labels metrics.Labels) {
+	s.metrics = newStoreMetrics(r, labels)
+}
@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := Open(dir, 0)
+	store.SetMetrics(nil, nil)
+	segment, err := store.AddSegment(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appender, err := segment.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appender.Append(1, log.NewMessage(1, nil, []byte("a")))
+	appender.Close()
+	store.Close()
+
+	// an incomplete message at the end of the segment
+	f, err := os.OpenFile(segment.(*Segment).logFileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0})
+	f.Close()
+
+	registry := metrics.NewPrometheus()
+	store = Open(dir, 0)
+	defer store.Close()
+	store.SetMetrics(registry, metrics.Labels{"log": "test"})
+	segments, err := store.Segments()
+	if err != nil || len(segments) != 1 {
+		t.Fatal("unexpected segments: ", segments, err)
+	}
+	if appender, err = segments[0].Appender(); err != nil {
+		t.Fatal(err)
+	}
+	appender.Close()
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		`cebaka_store_recovered_tails_total{log="test"} 1`,
+		`cebaka_store_lost_bytes_total{log="test"} 3`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("no %q in the metrics:\n%s", expected, w.Body.String())
+		}
+	}
+}
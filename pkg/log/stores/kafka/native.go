@@ -0,0 +1,290 @@
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+// A partition directory written by Apache Kafka, read-only.
+//
+// Kafka's offsets start at 0 while a log's start at 1, so the offset of a message is its Kafka
+// offset plus one, and a segment starts at its base offset (its file name) plus one. The record
+// batches (v2) and message sets (v0 and v1) are decoded to messages of the same format, or 2
+// for record batches, keeping their keys, values, headers, timestamps, producers and transaction
+// markers. Only uncompressed and gzip compressed messages can be read.
+type NativeStore struct {
+	dir            string
+	readBufferSize int
+}
+
+var _ = log.Store(&NativeStore{})
+
+// Open a Kafka partition directory, like /var/lib/kafka/topic-0.
+func OpenNative(dir string, readBufferSize int) *NativeStore {
+	return &NativeStore{dir, readBufferSize}
+}
+
+func (s *NativeStore) Segments() ([]log.Segment, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]log.Segment, 0, len(names))
+	for _, name := range names {
+		base := filepath.Base(name)
+		if !reLogFile.MatchString(base) {
+			continue
+		}
+		baseOffset, err := strconv.ParseUint(base[0:20], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, &NativeSegment{
+			logFileName: name,
+			baseOffset:  baseOffset,
+			bufferSize:  s.readBufferSize,
+		})
+	}
+	return segments, nil
+}
+
+func (s *NativeStore) AddSegment(startOffset uint64) (log.Segment, error) {
+	return nil, ReadOnly
+}
+
+// A segment of a Kafka partition.
+type NativeSegment struct {
+	logFileName string
+	baseOffset  uint64
+	bufferSize  int
+}
+
+var (
+	_ = log.Segment(&NativeSegment{})
+	_ = log.SizedSegment(&NativeSegment{})
+)
+
+func (s *NativeSegment) StartOffset() uint64 {
+	return s.baseOffset + 1
+}
+
+func (s *NativeSegment) Size() (int64, error) {
+	fi, err := os.Stat(s.logFileName)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// The file holding this segment's record batches.
+func (s *NativeSegment) FileName() string {
+	return s.logFileName
+}
+
+func (s *NativeSegment) Appender() (log.SegmentAppender, error) {
+	return nil, ReadOnly
+}
+
+func (s *NativeSegment) Reader() (log.SegmentReader, error) {
+	f, err := os.Open(s.logFileName)
+	if err != nil {
+		return nil, err
+	}
+	bufferSize := s.bufferSize
+	if bufferSize == 0 {
+		bufferSize = 4096
+	}
+	return &nativeReader{segment: s, file: f, buf: bufio.NewReaderSize(f, bufferSize)}, nil
+}
+
+// The position of the last batch at or before a Kafka offset, according to the segment's offset
+// index (0 if there's none).
+func (s *NativeSegment) indexedPosition(offset uint64) int64 {
+	data, err := ioutil.ReadFile(strings.TrimSuffix(s.logFileName, ".log") + ".index")
+	if err != nil {
+		return 0
+	}
+	// entries of a relative offset (4 bytes) and a position (4 bytes), the index of the active
+	// segment being preallocated with zeros
+	var position int64
+	var previous uint32
+	for i := 0; i+8 <= len(data); i += 8 {
+		relative := binary.BigEndian.Uint32(data[i:])
+		if i != 0 && relative <= previous {
+			break
+		}
+		if s.baseOffset+uint64(relative) > offset {
+			break
+		}
+		previous = relative
+		position = int64(binary.BigEndian.Uint32(data[i+4:]))
+	}
+	return position
+}
+
+// Reads the batches of a segment, returning their messages one by one.
+type nativeReader struct {
+	segment *NativeSegment
+	file    *os.File
+	buf     *bufio.Reader
+
+	// the position of the next batch, and the messages of the last one not read yet
+	position      int64
+	batchPosition int64
+	pending       []nativeMessage
+}
+
+type nativeMessage struct {
+	offset  uint64
+	message *log.Message
+}
+
+// The position of the batch of the next message.
+func (r *nativeReader) Position() int64 {
+	if len(r.pending) != 0 {
+		return r.batchPosition
+	}
+	return r.position
+}
+
+func (r *nativeReader) Next() (uint64, *log.Message, error) {
+	for len(r.pending) == 0 {
+		if err := r.readBatch(0); err != nil {
+			return 0, nil, err
+		}
+	}
+	m := r.pending[0]
+	r.pending = r.pending[1:]
+	return m.offset, m.message, nil
+}
+
+func (r *nativeReader) SeekToOffset(offset uint64) error {
+	kafkaOffset := uint64(0)
+	if offset > 0 {
+		kafkaOffset = offset - 1
+	}
+	r.pending = nil
+	if err := r.seek(r.segment.indexedPosition(kafkaOffset)); err != nil {
+		return err
+	}
+	for {
+		if err := r.readBatch(offset); err != nil {
+			return err
+		}
+		// messages before the offset were dropped
+		if len(r.pending) != 0 {
+			return nil
+		}
+	}
+}
+
+func (r *nativeReader) SeekToEnd() (uint64, error) {
+	var lastValidOffset uint64
+	for {
+		offset, _, err := r.Next()
+		switch err {
+		case nil:
+			lastValidOffset = offset
+		case io.EOF:
+			return lastValidOffset, nil
+		default:
+			return lastValidOffset, err
+		}
+	}
+}
+
+func (r *nativeReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *nativeReader) seek(position int64) error {
+	if _, err := r.file.Seek(position, 0); err != nil {
+		return err
+	}
+	r.position = position
+	r.buf.Reset(r.file)
+	return nil
+}
+
+// Read the next batch, keeping its messages at or after minOffset (all if 0).
+// On error, the reader stays before the batch.
+func (r *nativeReader) readBatch(minOffset uint64) error {
+	failure := func(err error) error {
+		r.seek(r.position)
+		if err == io.ErrUnexpectedEOF {
+			err = log.UnexpectedEOF
+		}
+		return err
+	}
+
+	// the base offset (the offset of a message before v2) and the length of what follows
+	var header [8 + 4]byte
+	if _, err := io.ReadFull(r.buf, header[:]); err == io.EOF {
+		r.seek(r.position)
+		return io.EOF
+	} else if err != nil {
+		return failure(err)
+	}
+	baseOffset := binary.BigEndian.Uint64(header[:])
+	length := int32(binary.BigEndian.Uint32(header[8:]))
+	if length == 0 && baseOffset == 0 {
+		// space preallocated by Kafka
+		r.seek(r.position)
+		return io.EOF
+	}
+	if length < batchMinLength {
+		return failure(log.BadCRC)
+	}
+
+	if minOffset > 0 && r.lastOffset(baseOffset, length) < minOffset-1 {
+		// the whole batch is before minOffset, skip it without reading it
+		if _, err := r.buf.Discard(int(length)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return failure(err)
+		}
+		r.position += int64(len(header)) + int64(length)
+		return nil
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.buf, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return failure(err)
+	}
+	messages, err := decodeBatch(baseOffset, data)
+	if err != nil {
+		return failure(err)
+	}
+
+	r.batchPosition = r.position
+	r.position += int64(len(header)) + int64(length)
+	r.pending = r.pending[:0]
+	for _, m := range messages {
+		if m.offset >= minOffset {
+			r.pending = append(r.pending, m)
+		}
+	}
+	return nil
+}
+
+// The last Kafka offset of a batch, from its header. The offset of v0 and v1 message sets is
+// already the one of their last message, compressed ones included.
+func (r *nativeReader) lastOffset(baseOffset uint64, length int32) uint64 {
+	data, err := r.buf.Peek(batchHeaderLength)
+	if err != nil || int(length) < batchHeaderLength || data[4] != 2 {
+		return baseOffset
+	}
+	return baseOffset + uint64(binary.BigEndian.Uint32(data[4+1+4+2:]))
+}
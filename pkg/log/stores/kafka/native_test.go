@@ -0,0 +1,224 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+// A message of a v0 or v1 message set, with its offset and size.
+func kafkaMessage(offset int64, magic, attributes byte, timestamp int64, key, value []byte) []byte {
+	body := []byte{magic, attributes}
+	if magic > 0 {
+		body = binary.BigEndian.AppendUint64(body, uint64(timestamp))
+	}
+	for _, b := range [][]byte{key, value} {
+		if b == nil {
+			body = binary.BigEndian.AppendUint32(body, ^uint32(0))
+		} else {
+			body = append(binary.BigEndian.AppendUint32(body, uint32(len(b))), b...)
+		}
+	}
+	data := binary.BigEndian.AppendUint64(nil, uint64(offset))
+	data = binary.BigEndian.AppendUint32(data, uint32(4+len(body)))
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(body))
+	return append(data, body...)
+}
+
+type kafkaRecord struct {
+	offsetDelta    int64
+	timestampDelta int64
+	key, value     []byte
+	headers        []log.Header
+}
+
+func appendVarbytes(data, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(data, -1)
+	}
+	return append(binary.AppendVarint(data, int64(len(b))), b...)
+}
+
+// A v2 record batch, gzip compressed if attributes say so.
+func kafkaBatch(baseOffset int64, attributes int16, timestamp, producerID int64, records ...kafkaRecord) []byte {
+	var data []byte
+	for _, r := range records {
+		record := []byte{0}
+		record = binary.AppendVarint(record, r.timestampDelta)
+		record = binary.AppendVarint(record, r.offsetDelta)
+		record = appendVarbytes(record, r.key)
+		record = appendVarbytes(record, r.value)
+		record = binary.AppendVarint(record, int64(len(r.headers)))
+		for _, h := range r.headers {
+			record = appendVarbytes(record, []byte(h.Key))
+			record = appendVarbytes(record, h.Value)
+		}
+		data = append(binary.AppendVarint(data, int64(len(record))), record...)
+	}
+	if attributes&codecAttributes == int16(log.Gzip) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		data = buf.Bytes()
+	}
+
+	last := records[len(records)-1]
+	afterCRC := binary.BigEndian.AppendUint16(nil, uint16(attributes))
+	afterCRC = binary.BigEndian.AppendUint32(afterCRC, uint32(last.offsetDelta))
+	afterCRC = binary.BigEndian.AppendUint64(afterCRC, uint64(timestamp))
+	afterCRC = binary.BigEndian.AppendUint64(afterCRC, uint64(timestamp+last.timestampDelta))
+	afterCRC = binary.BigEndian.AppendUint64(afterCRC, uint64(producerID))
+	afterCRC = binary.BigEndian.AppendUint16(afterCRC, 0)
+	afterCRC = binary.BigEndian.AppendUint32(afterCRC, 0)
+	afterCRC = binary.BigEndian.AppendUint32(afterCRC, uint32(len(records)))
+	afterCRC = append(afterCRC, data...)
+
+	batch := binary.BigEndian.AppendUint64(nil, uint64(baseOffset))
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(afterCRC)))
+	batch = append(batch, 0, 0, 0, 0, 2)
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(afterCRC, castagnoli))
+	return append(batch, afterCRC...)
+}
+
+func writeKafkaSegment(t *testing.T, dir string, baseOffset int64, batches ...[]byte) string {
+	name := filepath.Join(dir, fmt.Sprintf("%020d.log", baseOffset))
+	if err := ioutil.WriteFile(name, bytes.Join(batches, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestNativeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ms := int64(1500000000000)
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(kafkaMessage(0, 1, 0, ms+2, nil, []byte("v1 compressed a")))
+	w.Write(kafkaMessage(1, 1, 0, ms+3, nil, []byte("v1 compressed b")))
+	w.Close()
+
+	writeKafkaSegment(t, dir, 0,
+		kafkaMessage(0, 0, 0, 0, []byte("k"), []byte("v0")),
+		kafkaMessage(1, 1, 0, ms, nil, []byte("v1")),
+		kafkaMessage(3, 1, byte(log.Gzip), ms, nil, compressed.Bytes()),
+		kafkaBatch(4, 0, ms, -1,
+			kafkaRecord{0, 1000, []byte("k"), []byte("v2"), []log.Header{{Key: "h", Value: []byte("x")}}},
+			kafkaRecord{2, 2000, nil, []byte("v2 after a gap"), nil}),
+	)
+	transactional := kafkaBatch(7, int16(log.Gzip)|transactionalBatch, ms, 42,
+		kafkaRecord{0, 0, nil, []byte("in a transaction"), nil})
+	commit := kafkaBatch(8, transactionalBatch|controlBatch, ms, 42, kafkaRecord{0, 0, []byte{0, 0, 0, 1}, []byte{0, 0, 0, 0, 0, 0}, nil})
+	name := writeKafkaSegment(t, dir, 7, transactional, commit,
+		kafkaBatch(9, logAppendTimeAttribute, ms, -1, kafkaRecord{0, 0, nil, []byte("appended"), nil}))
+
+	// an index of the batches at offsets 8 and 9, followed by preallocated space
+	index := make([]byte, 8*4)
+	binary.BigEndian.PutUint32(index[0:], 1)
+	binary.BigEndian.PutUint32(index[4:], uint32(len(transactional)))
+	binary.BigEndian.PutUint32(index[8:], 2)
+	binary.BigEndian.PutUint32(index[12:], uint32(len(transactional)+len(commit)))
+	if err := ioutil.WriteFile(name[:len(name)-len(".log")]+".index", index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// unrelated files of Kafka
+	ioutil.WriteFile(filepath.Join(dir, "leader-epoch-checkpoint"), []byte("0\n"), 0644)
+
+	store := OpenNative(dir, 0)
+	l, err := log.Open(log.Config{ReadOnly: true, Transactional: true}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.StartOffset() != 1 || l.NextOffset() != 11 {
+		t.Fatal("unexpected offsets: ", l.StartOffset(), l.NextOffset())
+	}
+	if _, err := l.Append(log.NewMessage(0, nil, nil)); err != log.ReadOnly {
+		t.Error("expected ReadOnly, got ", err)
+	}
+
+	timestamp := log.Timestamp(time.Unix(ms/1000, ms%1000*int64(time.Millisecond)))
+	expected := []string{
+		"1 0 k v0 []",
+		fmt.Sprintf("2 %d  v1 []", timestamp),
+		fmt.Sprintf("3 %d  v1 compressed a []", log.Timestamp(time.Unix(0, (ms+2)*int64(time.Millisecond)))),
+		fmt.Sprintf("4 %d  v1 compressed b []", log.Timestamp(time.Unix(0, (ms+3)*int64(time.Millisecond)))),
+		fmt.Sprintf("5 %d k v2 [{h [120]}]", log.Timestamp(time.Unix(0, (ms+1000)*int64(time.Millisecond)))),
+		fmt.Sprintf("7 %d  v2 after a gap []", log.Timestamp(time.Unix(0, (ms+2000)*int64(time.Millisecond)))),
+		fmt.Sprintf("8 %d  in a transaction []", timestamp),
+		fmt.Sprintf("10 %d  appended []", timestamp),
+	}
+	c, err := l.Consumer(1, log.ReadCommitted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, e := range expected {
+		offset, msg, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := fmt.Sprintf("%d %d %s %s %v", offset, msg.Timestamp, msg.Key, msg.Payload, msg.Headers); s != e {
+			t.Errorf("expected %q, got %q", e, s)
+		}
+		if msg.CRC != msg.ComputeCRC() {
+			t.Errorf("bad CRC at offset %d", offset)
+		}
+		if offset == 8 && (!msg.IsTransactional() || msg.ProducerID != 42) {
+			t.Error("not transactional: ", msg)
+		}
+		if offset == 10 && msg.TimestampType() != log.LogAppendTime {
+			t.Error("unexpected timestamp type: ", msg.TimestampType())
+		}
+	}
+
+	// the transaction markers are read, and seeking uses the index
+	segments := l.Segments()
+	r, err := segments[1].Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.SeekToOffset(9); err != nil {
+		t.Fatal(err)
+	}
+	if r.Position() != int64(len(transactional)) {
+		t.Error("unexpected position: ", r.Position())
+	}
+	offset, msg, err := r.Next()
+	if controlType, ok := msg.ControlType(); err != nil || offset != 9 || !ok || controlType != log.CommitMarker {
+		t.Error("unexpected message: ", offset, msg, err)
+	}
+	if err := r.SeekToOffset(11); err != io.EOF {
+		t.Error("expected EOF, got ", err)
+	}
+
+	// a batch being written
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(kafkaBatch(10, 0, ms, -1, kafkaRecord{0, 0, nil, []byte("partial"), nil})[:30])
+	f.Close()
+	if err := r.SeekToOffset(8); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := r.SeekToEnd(); err != log.UnexpectedEOF || last != 10 {
+		t.Error("unexpected end: ", last, err)
+	}
+}
@@ -0,0 +1,14 @@
+package kafka
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE: the file size doesn't change, readers still see the end of the messages.
+const fallocKeepSize = 0x01
+
+// Allocate the space of a segment file in advance.
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package kafka
+
+import "os"
+
+// Allocate the space of a segment file in advance (not supported on this system).
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
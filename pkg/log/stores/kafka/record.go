@@ -0,0 +1,322 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+var (
+	InvalidBatch           = errors.New("invalid Kafka record batch")
+	UnsupportedCompression = errors.New("unsupported compression codec")
+)
+
+// Length of the header of a record batch (v2), after its base offset and length:
+//
+//	partition leader epoch : 4 bytes
+//	magic                  : 1 byte (2)
+//	crc                    : 4 bytes (CRC-32C of what follows)
+//	attributes             : 2 bytes
+//	last offset delta      : 4 bytes
+//	base timestamp         : 8 bytes
+//	max timestamp          : 8 bytes
+//	producer id            : 8 bytes
+//	producer epoch         : 2 bytes
+//	base sequence          : 4 bytes
+//	record count           : 4 bytes
+const batchHeaderLength = 4 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4 + 4
+
+// Length of the smallest message (v0): crc, magic, attributes, and null key and value.
+const batchMinLength = 4 + 1 + 1 + 4 + 4
+
+// Attributes of Kafka's messages and record batches.
+const (
+	codecAttributes        = 0x07
+	logAppendTimeAttribute = 1 << 3
+	transactionalBatch     = 1 << 4
+	controlBatch           = 1 << 5
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Decode the messages of a batch, given its base offset and what follows its length.
+func decodeBatch(baseOffset uint64, data []byte) ([]nativeMessage, error) {
+	switch magic := data[4]; magic {
+	case 0, 1:
+		return decodeMessage(baseOffset, data)
+	case 2:
+		return decodeRecordBatch(baseOffset, data)
+	default:
+		return nil, fmt.Errorf("%v: %d", log.UnsupportedFormat, magic)
+	}
+}
+
+// Decode a message of a v0 or v1 message set, which holds a message set when it's compressed.
+func decodeMessage(offset uint64, data []byte) ([]nativeMessage, error) {
+	if binary.BigEndian.Uint32(data) != crc32.ChecksumIEEE(data[4:]) {
+		return nil, log.BadCRC
+	}
+	r := &batchReader{data: data[4:]}
+	magic := r.byte()
+	attributes := r.byte()
+	timestamp := int64(-1)
+	if magic > 0 {
+		timestamp = r.int64()
+	}
+	key := r.bytes()
+	value := r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	codec := log.Codec(attributes & codecAttributes)
+	if codec == log.NoCompression {
+		msg := &log.Message{Format: magic, Timestamp: timestampOf(timestamp), Key: key, Payload: value}
+		if magic > 0 {
+			msg.Attributes = attributes & logAppendTimeAttribute
+		}
+		msg.UpdateCRC()
+		return []nativeMessage{{offset + 1, msg}}, nil
+	}
+
+	set, err := decompress(codec, value)
+	if err != nil {
+		return nil, err
+	}
+	var messages []nativeMessage
+	for len(set) != 0 {
+		if len(set) < 8+4 {
+			return nil, InvalidBatch
+		}
+		innerOffset := binary.BigEndian.Uint64(set)
+		size := int(binary.BigEndian.Uint32(set[8:]))
+		if size < batchMinLength || 8+4+size > len(set) {
+			return nil, InvalidBatch
+		}
+		inner, err := decodeMessage(innerOffset, set[8+4:8+4+size])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, inner...)
+		set = set[8+4+size:]
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	if magic > 0 {
+		// the inner offsets are relative, the wrapper has the offset of the last message
+		last := messages[len(messages)-1].offset
+		for i := range messages {
+			messages[i].offset = offset + 1 - (last - messages[i].offset)
+		}
+		if attributes&logAppendTimeAttribute != 0 {
+			for _, m := range messages {
+				m.message.Attributes |= logAppendTimeAttribute
+				m.message.Timestamp = timestampOf(timestamp)
+				m.message.UpdateCRC()
+			}
+		}
+	}
+	return messages, nil
+}
+
+// Decode the records of a v2 record batch.
+func decodeRecordBatch(baseOffset uint64, data []byte) ([]nativeMessage, error) {
+	if len(data) < batchHeaderLength {
+		return nil, InvalidBatch
+	}
+	if binary.BigEndian.Uint32(data[4+1:]) != crc32.Checksum(data[4+1+4:], castagnoli) {
+		return nil, log.BadCRC
+	}
+	r := &batchReader{data: data[4+1+4:]}
+	attributes := r.int16()
+	r.int32() // last offset delta
+	baseTimestamp := r.int64()
+	maxTimestamp := r.int64()
+	producerID := r.int64()
+	r.int16() // producer epoch
+	baseSequence := r.int32()
+	count := r.int32()
+	if r.err != nil || count < 0 {
+		return nil, InvalidBatch
+	}
+
+	records := r.data
+	if codec := log.Codec(attributes & codecAttributes); codec != log.NoCompression {
+		var err error
+		if records, err = decompress(codec, records); err != nil {
+			return nil, err
+		}
+	}
+
+	messages := make([]nativeMessage, 0, count)
+	r = &batchReader{data: records}
+	for i := int32(0); i < count; i++ {
+		r.varint() // length
+		r.byte()   // attributes, unused
+		timestampDelta := r.varint()
+		offsetDelta := r.varint()
+		key := r.varbytes()
+		value := r.varbytes()
+		var headers []log.Header
+		for n := r.varint(); n > 0 && r.err == nil; n-- {
+			headerKey := r.varbytes()
+			headers = append(headers, log.Header{Key: string(headerKey), Value: r.varbytes()})
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		timestamp := baseTimestamp + timestampDelta
+		if attributes&logAppendTimeAttribute != 0 {
+			timestamp = maxTimestamp
+		}
+
+		var msg *log.Message
+		if attributes&controlBatch != 0 {
+			// only transaction markers, the other control records are Kafka's own
+			if attributes&transactionalBatch == 0 || len(key) != 4 {
+				continue
+			}
+			controlType := log.ControlType(binary.BigEndian.Uint16(key[2:]))
+			if controlType != log.AbortMarker && controlType != log.CommitMarker {
+				continue
+			}
+			msg = log.NewControlMessage(timestampOf(timestamp), uint64(producerID), controlType)
+		} else {
+			msg = log.NewMessageWithHeaders(timestampOf(timestamp), key, value, headers)
+			if producerID >= 0 {
+				var sequence uint32
+				if baseSequence >= 0 {
+					sequence = uint32(baseSequence + int32(offsetDelta))
+				}
+				if attributes&transactionalBatch != 0 {
+					msg.SetTransactional(uint64(producerID), sequence)
+				} else {
+					msg.SetProducer(uint64(producerID), sequence)
+				}
+			}
+		}
+		if attributes&logAppendTimeAttribute != 0 {
+			msg.Attributes |= logAppendTimeAttribute
+			msg.UpdateCRC()
+		}
+		messages = append(messages, nativeMessage{baseOffset + uint64(offsetDelta) + 1, msg})
+	}
+	return messages, nil
+}
+
+func decompress(codec log.Codec, data []byte) ([]byte, error) {
+	if codec != log.Gzip {
+		return nil, fmt.Errorf("%v: %v", UnsupportedCompression, codec)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", InvalidBatch, err)
+	}
+	defer r.Close()
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", InvalidBatch, err)
+	}
+	return data, nil
+}
+
+// The timestamp of a message from Kafka's milliseconds (no timestamp if negative).
+func timestampOf(ms int64) uint64 {
+	if ms < 0 {
+		return 0
+	}
+	return log.Timestamp(time.Unix(ms/1000, ms%1000*int64(time.Millisecond)))
+}
+
+// Reads the fields of Kafka's messages and records, until an error occurs.
+type batchReader struct {
+	data []byte
+	err  error
+}
+
+func (r *batchReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = InvalidBatch
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *batchReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *batchReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *batchReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *batchReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Bytes prefixed by their length (4 bytes), nil if it's -1.
+func (r *batchReader) bytes() []byte {
+	n := r.int32()
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// A zigzag encoded variable length integer.
+func (r *batchReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = InvalidBatch
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+// Bytes prefixed by their length (a varint), nil if it's -1.
+func (r *batchReader) varbytes() []byte {
+	n := r.varint()
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	if n > int64(len(r.data)) {
+		r.err = InvalidBatch
+		return nil
+	}
+	return r.next(int(n))
+}
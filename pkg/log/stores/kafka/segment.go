@@ -10,15 +10,36 @@ type Segment struct {
 	logFileName string
 	startOffset uint64
 	bufferSize  int
+	metrics     *storeMetrics
+	store       *Store
 }
 
-var _ = log.Segment(&Segment{})
+var (
+	_ = log.Segment(&Segment{})
+	_ = log.SizedSegment(&Segment{})
+)
 
 func (s *Segment) StartOffset() uint64 {
 	return s.startOffset
 }
 
+func (s *Segment) Size() (int64, error) {
+	fi, err := os.Stat(s.logFileName)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// The file holding this segment's messages.
+func (s *Segment) FileName() string {
+	return s.logFileName
+}
+
 func (s *Segment) Appender() (log.SegmentAppender, error) {
+	if err := s.store.lock(); err != nil {
+		return nil, err
+	}
 	logFile, err := os.OpenFile(s.logFileName, os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
@@ -29,13 +50,22 @@ func (s *Segment) Appender() (log.SegmentAppender, error) {
 
 	if _, err := r.SeekToEnd(); err != nil {
 		if err == log.UnexpectedEOF || err == log.BadCRC {
+			if err == log.BadCRC {
+				s.metrics.crcFailures.Add(1)
+			}
 			s.lostTail(logFile, r.Position())
 		} else {
 			return nil, err
 		}
 	}
 
-	return log.NewWriter(logFile, r.Position(), s.bufferSize), nil
+	return &timeIndexAppender{
+		Writer:  log.NewWriter(logFile, r.Position(), s.bufferSize),
+		file:    logFile,
+		segment: s,
+		index:   s.loadTimeIndex(),
+		size:    r.Position(),
+	}, nil
 }
 
 func (s *Segment) Reader() (log.SegmentReader, error) {
@@ -48,8 +78,54 @@ func (s *Segment) Reader() (log.SegmentReader, error) {
 }
 
 func (s *Segment) lostTail(logFile *os.File, position int64) error {
+	s.metrics.recoveredTails.Add(1)
+	if fi, err := logFile.Stat(); err == nil {
+		s.metrics.lostBytes.Add(float64(fi.Size() - position))
+	}
+
 	// TODO archive tail
 	// TODO truncate
 	logFile.Seek(position, 0)
 	return nil
 }
+
+var _ = log.RewritableSegment(&Segment{})
+
+// Write a new version of the segment next to it, renamed over it when the rewriter is closed.
+func (s *Segment) Rewrite() (log.SegmentRewriter, error) {
+	if err := s.store.lock(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.logFileName+".rewrite", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentRewriter{&timeIndexAppender{
+		Writer:  log.NewWriter(f, 0, s.bufferSize),
+		file:    f,
+		segment: s,
+		index:   &timeIndex{min: ^uint64(0), empty: true},
+	}}, nil
+}
+
+type segmentRewriter struct {
+	*timeIndexAppender
+}
+
+func (r *segmentRewriter) Close() error {
+	if err := r.Sync(); err != nil {
+		r.Abort()
+		return err
+	}
+	// the index is written for the new size, so it's only valid once the file is renamed
+	if err := r.timeIndexAppender.Close(); err != nil {
+		os.Remove(r.file.Name())
+		return err
+	}
+	return os.Rename(r.file.Name(), r.segment.logFileName)
+}
+
+func (r *segmentRewriter) Abort() error {
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
@@ -2,12 +2,15 @@ package kafka
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 
 	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
 )
 
 var (
@@ -17,22 +20,53 @@ var (
 type Store struct {
 	dir             string
 	writeBufferSize int
+	metrics         *storeMetrics
+
+	// the lock of the directory, taken on the first write
+	readOnly  bool
+	lockMutex sync.Mutex
+	lockFile  *os.File
+	// whether the segments prepared by previous runs were removed, on the first lock
+	staleRemoved bool
 }
 
-var _ = log.Store(&Store{})
+var (
+	_ = log.Store(&Store{})
+	_ = log.SnapshotStore(&Store{})
+	_ = log.PreparingStore(&Store{})
+)
+
+// Pattern of the files of prepared segments. Each one has its own file, so a store never
+// truncates nor removes the file prepared by another one.
+const nextSegmentPattern = "next*.segment"
 
+// Open a store. It's only locked when written to, so another process writing to the same
+// directory makes the first write fail with Locked.
 func Open(dir string, writeBufferSize int) *Store {
 	return &Store{
 		dir:             dir + "/",
 		writeBufferSize: writeBufferSize,
+		metrics:         newStoreMetrics(metrics.Discard, nil),
 	}
 }
 
+// Open a store without locking it, to read a log written by another process. Writing to the
+// store or its segments returns ReadOnly.
+func OpenReadOnly(dir string, readBufferSize int) *Store {
+	s := Open(dir, readBufferSize)
+	s.readOnly = true
+	return s
+}
+
 func (s *Store) Segments() ([]log.Segment, error) {
 	f, err := os.Open(s.dir)
-	if err != nil {
+	if os.IsNotExist(err) {
+		// new store, AddSegment will create it
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	allNames, err := f.Readdirnames(-1)
 	if err != nil {
@@ -52,13 +86,15 @@ func (s *Store) Segments() ([]log.Segment, error) {
 			logFileName: filepath.Join(s.dir, name),
 			startOffset: n,
 			bufferSize:  s.writeBufferSize,
+			metrics:     s.metrics,
+			store:       s,
 		})
 	}
 	return segments, nil
 }
 
 func (s *Store) AddSegment(startOffset uint64) (log.Segment, error) {
-	if err := os.MkdirAll(s.dir, 0755); err != nil {
+	if err := s.lock(); err != nil {
 		return nil, err
 	}
 	name := fmt.Sprintf("%s/%020d.log", s.dir, startOffset)
@@ -67,13 +103,104 @@ func (s *Store) AddSegment(startOffset uint64) (log.Segment, error) {
 		return nil, err
 	}
 	f.Close()
+	s.metrics.segmentsAdded.Add(1)
 	return &Segment{
 		logFileName: name,
 		startOffset: startOffset,
 		bufferSize:  s.writeBufferSize,
+		metrics:     s.metrics,
+		store:       s,
+	}, nil
+}
+
+// Create the file of the next segment, preallocating its space when supported (see preallocate).
+func (s *Store) PrepareSegment(size int64) (log.PreparedSegment, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(s.dir, nextSegmentPattern)
+	if err != nil {
+		return nil, err
+	}
+	f.Chmod(0644)
+	if size > 0 {
+		// the space is only an optimization
+		preallocate(f, size)
+	}
+	return &preparedSegment{s, f}, nil
+}
+
+type preparedSegment struct {
+	store *Store
+	file  *os.File
+}
+
+func (p *preparedSegment) Add(startOffset uint64) (log.Segment, log.SegmentAppender, error) {
+	s := p.store
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d.log", startOffset))
+	if err := os.Rename(p.file.Name(), name); err != nil {
+		p.file.Close()
+		return nil, nil, err
+	}
+	s.metrics.segmentsAdded.Add(1)
+
+	segment := &Segment{
+		logFileName: name,
+		startOffset: startOffset,
+		bufferSize:  s.writeBufferSize,
+		metrics:     s.metrics,
+		store:       s,
+	}
+	return segment, &timeIndexAppender{
+		Writer:  log.NewWriter(p.file, 0, s.writeBufferSize),
+		file:    p.file,
+		segment: segment,
+		index:   &timeIndex{min: ^uint64(0), empty: true},
 	}, nil
 }
 
+func (p *preparedSegment) Discard() error {
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
+
 func (s *Store) mkdirs() error {
 	return os.MkdirAll(s.dir, 0755)
 }
+
+func (s *Store) WriteSnapshot(name string, data []byte) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	fileName := s.snapshotFileName(name)
+	tmpName := fileName + ".tmp"
+
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+func (s *Store) ReadSnapshot(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.snapshotFileName(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *Store) snapshotFileName(name string) string {
+	return filepath.Join(s.dir, name+".snapshot")
+}
@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+// Time index of a segment, written when its appender is closed.
+//
+// Format:
+//
+//	min timestamp : 8 bytes
+//	max timestamp : 8 bytes
+//	segment size  : 8 bytes (the index is only valid for a segment of this size)
+const timeIndexSize = 8 + 8 + 8
+
+var _ = log.TimeIndexedSegment(&Segment{})
+
+type timeIndex struct {
+	min, max uint64
+	size     int64
+	empty    bool
+}
+
+func (s *Segment) timeIndexFileName() string {
+	return strings.TrimSuffix(s.logFileName, ".log") + ".timeindex"
+}
+
+// The timestamp bounds of the segment's messages, if its time index matches the segment.
+func (s *Segment) TimestampBounds() (uint64, uint64, bool) {
+	idx, ok := s.readTimeIndex()
+	if !ok || idx.empty {
+		return 0, 0, false
+	}
+	return idx.min, idx.max, true
+}
+
+func (s *Segment) readTimeIndex() (*timeIndex, bool) {
+	data, err := ioutil.ReadFile(s.timeIndexFileName())
+	if err != nil || len(data) != timeIndexSize {
+		return nil, false
+	}
+	idx := &timeIndex{
+		min:  binary.BigEndian.Uint64(data[0:]),
+		max:  binary.BigEndian.Uint64(data[8:]),
+		size: int64(binary.BigEndian.Uint64(data[16:])),
+	}
+	idx.empty = idx.min > idx.max
+	if size, err := s.Size(); err != nil || size != idx.size {
+		// the segment was appended to since the index was written
+		return nil, false
+	}
+	return idx, true
+}
+
+func (s *Segment) writeTimeIndex(idx *timeIndex) error {
+	data := make([]byte, timeIndexSize)
+	binary.BigEndian.PutUint64(data[0:], idx.min)
+	binary.BigEndian.PutUint64(data[8:], idx.max)
+	binary.BigEndian.PutUint64(data[16:], uint64(idx.size))
+	return ioutil.WriteFile(s.timeIndexFileName(), data, 0644)
+}
+
+// Load the timestamp bounds of the segment's messages, from its time index or by reading it.
+func (s *Segment) loadTimeIndex() *timeIndex {
+	if idx, ok := s.readTimeIndex(); ok {
+		return idx
+	}
+	idx := &timeIndex{min: ^uint64(0), empty: true}
+	r, err := s.Reader()
+	if err != nil {
+		return idx
+	}
+	defer r.Close()
+	for {
+		_, msg, err := r.Next()
+		if err != nil {
+			return idx
+		}
+		idx.add(msg.Timestamp)
+	}
+}
+
+func (idx *timeIndex) add(timestamp uint64) {
+	if idx.empty || timestamp < idx.min {
+		idx.min = timestamp
+	}
+	if idx.empty || timestamp > idx.max {
+		idx.max = timestamp
+	}
+	idx.empty = false
+}
+
+// Appender tracking the timestamps of the messages, to write the time index on close.
+type timeIndexAppender struct {
+	*log.Writer
+	file    *os.File
+	segment *Segment
+	index   *timeIndex
+	size    int64
+}
+
+func (a *timeIndexAppender) Append(offset uint64, message *log.Message) (int64, error) {
+	size, err := a.Writer.Append(offset, message)
+	if err != nil {
+		return size, err
+	}
+	a.index.add(message.Timestamp)
+	a.size = size
+	return size, nil
+}
+
+func (a *timeIndexAppender) Close() error {
+	// releases the space preallocated after the messages, if any
+	a.file.Truncate(a.size)
+	if err := a.Writer.Close(); err != nil {
+		return err
+	}
+	a.index.size = a.size
+	if a.index.empty {
+		a.index.min, a.index.max = ^uint64(0), 0
+	}
+	// the index is only an optimization, consumers read the segment without it
+	a.segment.writeTimeIndex(a.index)
+	return nil
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Changes of the directory's files notified by inotify: segments created, renamed, written or removed.
+const watchedEvents = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE
+
+// Call changed after files of the store's directory are created, written or removed (including
+// by other processes), until stop is closed.
+func (s *Store) Watch(changed func(), stop <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, s.dir, watchedEvents)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	var mutex sync.Mutex
+	closed := false
+	go func() {
+		<-stop
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !closed {
+			// the reads below get an IN_IGNORED event
+			syscall.InotifyRmWatch(fd, uint32(wd))
+		}
+	}()
+
+	go func() {
+		defer func() {
+			mutex.Lock()
+			closed = true
+			syscall.Close(fd)
+			mutex.Unlock()
+		}()
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil || n <= 0 {
+				return
+			}
+			ignored := false
+			for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					// stopped, or the directory was removed
+					ignored = true
+				}
+				i += syscall.SizeofInotifyEvent + int(event.Len)
+			}
+			if ignored {
+				return
+			}
+			changed()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer := Open(dir, 0)
+	defer writer.Close()
+	segment, err := writer.AddSegment(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan struct{}, 100)
+	stop := make(chan struct{})
+	reader := OpenReadOnly(dir, 0)
+	if err := reader.Watch(func() { changes <- struct{}{} }, stop); err != nil {
+		t.Fatal(err)
+	}
+	expectChange := func(what string) {
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change notified after ", what)
+		}
+		for len(changes) != 0 {
+			<-changes
+		}
+	}
+
+	appender, err := segment.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appender.Append(1, log.NewMessage(1, nil, []byte("a")))
+	expectChange("an append")
+	appender.Close()
+
+	if _, err := writer.AddSegment(2); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("a new segment")
+
+	close(stop)
+	time.Sleep(50 * time.Millisecond)
+	for len(changes) != 0 {
+		<-changes
+	}
+	writer.AddSegment(3)
+	time.Sleep(50 * time.Millisecond)
+	if len(changes) != 0 {
+		t.Error("change notified after stopping")
+	}
+}
@@ -0,0 +1,38 @@
+package log
+
+import (
+	"fmt"
+	"time"
+)
+
+// The source of a log's time (see Config.Clock).
+type Clock interface {
+	Now() time.Time
+}
+
+func (l *Log) now() time.Time {
+	if l.config.Clock != nil {
+		return l.config.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Apply the log's timestamp type to a message before it's appended. A stamped message is a copy,
+// the given one is left as is.
+func (l *Log) timestamp(message *Message) (*Message, error) {
+	if l.config.TimestampType == LogAppendTime {
+		stamped := *message
+		stamped.SetLogAppendTime(Timestamp(l.now()))
+		return &stamped, nil
+	}
+
+	maxDelta := l.config.MaxTimestampDelta
+	if maxDelta <= 0 || message.Format == 0 || message.Timestamp == 0 || message.IsControl() {
+		return message, nil
+	}
+	delta := TimeOf(message.Timestamp).Sub(l.now())
+	if delta > maxDelta || delta < -maxDelta {
+		return nil, fmt.Errorf("%v: %v", TimestampOutOfRange, delta)
+	}
+	return message, nil
+}
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClock time.Time
+
+func (c testClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestTimestamp(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 678900000, time.UTC)
+	ts := Timestamp(now)
+	if ts != 1577934245678 {
+		t.Error("unexpected timestamp: ", ts)
+	}
+	if !TimeOf(ts).Equal(now.Truncate(time.Millisecond)) {
+		t.Error("unexpected time: ", TimeOf(ts))
+	}
+
+	// timestamps in seconds written before
+	legacy := uint64(now.Unix())
+	if !TimeOf(legacy).Equal(now.Truncate(time.Second)) {
+		t.Error("unexpected time of a legacy timestamp: ", TimeOf(legacy))
+	}
+	if NormalizeTimestamp(legacy) != 1577934245000 || NormalizeTimestamp(0) != 0 {
+		t.Error("unexpected normalized timestamp: ", NormalizeTimestamp(legacy))
+	}
+	filter := &Filter{MinTimestamp: ts - 1000, MaxTimestamp: ts + 1000}
+	if !filter.acceptsTimestamps(legacy, legacy) || filter.acceptsTimestamps(legacy-2, legacy-2) {
+		t.Error("legacy timestamps not filtered in milliseconds")
+	}
+}
+
+func TestLogAppendTime(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l, err := Open(Config{MaxSegmentSize: 1 << 20, TimestampType: LogAppendTime, Clock: testClock(now)}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	v0 := &Message{Format: 0, Payload: []byte("v0")}
+	v0.UpdateCRC()
+	for _, msg := range []*Message{v0, NewMessage(1, nil, []byte("v1"))} {
+		if _, err := l.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v0.Format != 0 || v0.Timestamp != 0 {
+		t.Error("the appended message was changed: ", v0)
+	}
+
+	c, err := l.Consumer(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		_, msg, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Timestamp != Timestamp(now) || msg.TimestampType() != LogAppendTime || msg.Format < 1 {
+			t.Error("not stamped: ", msg)
+		}
+		if msg.CRC != msg.ComputeCRC() {
+			t.Error("bad CRC: ", msg)
+		}
+	}
+}
+
+func TestMaxTimestampDelta(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l, err := Open(Config{MaxSegmentSize: 1 << 20, Clock: testClock(now), MaxTimestampDelta: time.Minute}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, c := range []struct {
+		timestamp uint64
+		accepted  bool
+	}{
+		{Timestamp(now), true},
+		{Timestamp(now.Add(-time.Minute)), true},
+		{Timestamp(now.Add(time.Minute + time.Millisecond)), false},
+		{Timestamp(now.Add(-time.Hour)), false},
+		{uint64(now.Unix()), true}, // in seconds
+		{0, true},                  // no timestamp
+	} {
+		_, err := l.Append(NewMessage(c.timestamp, nil, []byte("a")))
+		if c.accepted && err != nil {
+			t.Errorf("%d: %v", c.timestamp, err)
+		} else if !c.accepted && (err == nil || !strings.HasPrefix(err.Error(), TimestampOutOfRange.Error())) {
+			t.Errorf("%d: expected TimestampOutOfRange, got %v", c.timestamp, err)
+		}
+	}
+	if l.NextOffset() != 5 {
+		t.Error("unexpected next offset: ", l.NextOffset())
+	}
+}
@@ -0,0 +1,199 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var NotTransactional = errors.New("log is not transactional")
+
+type offsetRange struct {
+	first, last uint64
+}
+
+// Tracks the transactions of the log's producers.
+type transactions struct {
+	mutex sync.RWMutex
+	// first offset of the open transactions, by producer id
+	open map[uint64]uint64
+	// offsets of the aborted transactions (from their first message to their abort marker), by producer id
+	aborted map[uint64][]offsetRange
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		open:    map[uint64]uint64{},
+		aborted: map[uint64][]offsetRange{},
+	}
+}
+
+func (t *transactions) apply(offset uint64, msg *Message) {
+	if !msg.IsTransactional() {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	producerID := msg.ProducerID
+	first, open := t.open[producerID]
+
+	if !msg.IsControl() {
+		if !open {
+			t.open[producerID] = offset
+		}
+		return
+	}
+
+	controlType, ok := msg.ControlType()
+	if !ok {
+		return
+	}
+	switch controlType {
+	case BeginMarker:
+		if !open {
+			t.open[producerID] = offset
+		}
+	case CommitMarker:
+		delete(t.open, producerID)
+	case AbortMarker:
+		if open {
+			t.aborted[producerID] = append(t.aborted[producerID], offsetRange{first, offset})
+			delete(t.open, producerID)
+		}
+	}
+}
+
+// The first offset of the oldest open transaction, or nextOffset if there's none.
+func (t *transactions) stableOffset(nextOffset uint64) uint64 {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	stable := nextOffset
+	for _, first := range t.open {
+		if first < stable {
+			stable = first
+		}
+	}
+	return stable
+}
+
+func (t *transactions) openCount() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.open)
+}
+
+// Is the message at offset part of an aborted transaction of the producer?
+func (t *transactions) isAborted(producerID, offset uint64) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for _, r := range t.aborted[producerID] {
+		if r.first <= offset && offset <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget the aborted transactions ending before startOffset, no longer in the log.
+func (t *transactions) expire(startOffset uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for id, ranges := range t.aborted {
+		kept := ranges[:0]
+		for _, r := range ranges {
+			if r.last >= startOffset {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.aborted, id)
+		} else {
+			t.aborted[id] = kept
+		}
+	}
+}
+
+func (t *transactions) snapshotName() string {
+	return "transactions"
+}
+
+// Snapshot format:
+//
+//	version          : 1 byte (0)
+//	offset           : 8 bytes (the next offset when the snapshot was taken)
+//	open             : 4 bytes
+//	for each open transaction:
+//	  producer id    : 8 bytes
+//	  first offset   : 8 bytes
+//	producers        : 4 bytes
+//	for each producer with aborted transactions:
+//	  producer id    : 8 bytes
+//	  aborted        : 4 bytes
+//	  for each aborted transaction:
+//	    first offset : 8 bytes
+//	    last offset  : 8 bytes
+func (t *transactions) snapshot(nextOffset uint64) []byte {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	buf := &bytes.Buffer{}
+	w := NewBinaryWriter(buf)
+	w.WriteByte(0)
+	w.WriteUint64(nextOffset)
+	w.WriteUint32(uint32(len(t.open)))
+	for id, first := range t.open {
+		w.WriteUint64(id)
+		w.WriteUint64(first)
+	}
+	w.WriteUint32(uint32(len(t.aborted)))
+	for id, ranges := range t.aborted {
+		w.WriteUint64(id)
+		w.WriteUint32(uint32(len(ranges)))
+		for _, r := range ranges {
+			w.WriteUint64(r.first)
+			w.WriteUint64(r.last)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (t *transactions) loadSnapshot(data []byte) (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	r := &BinaryReader{bytes.NewReader(data), nil}
+	if version := r.ReadByte(); r.err == nil && version != 0 {
+		return 0, errors.New("unknown transactions snapshot version")
+	}
+	nextOffset := r.ReadUint64()
+
+	count := r.ReadUint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		id := r.ReadUint64()
+		t.open[id] = r.ReadUint64()
+	}
+
+	count = r.ReadUint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		id := r.ReadUint64()
+		n := r.ReadUint32()
+		ranges := make([]offsetRange, 0)
+		for j := uint32(0); j < n && r.err == nil; j++ {
+			ranges = append(ranges, offsetRange{r.ReadUint64(), r.ReadUint64()})
+		}
+		t.aborted[id] = ranges
+	}
+	return nextOffset, r.err
+}
+
+func (t *transactions) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.open = map[uint64]uint64{}
+	t.aborted = map[uint64][]offsetRange{}
+}
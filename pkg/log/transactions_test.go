@@ -0,0 +1,55 @@
+package log
+
+import (
+	"testing"
+)
+
+func TestTransactionsReopen(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Remove()
+
+	config := Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1, Transactional: true}
+	l, err := Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := func(producerID uint64, value string) *Message {
+		m := NewMessage(0, nil, []byte(value))
+		m.SetTransactional(producerID, 0)
+		return m
+	}
+
+	l.Append(data(1, "aborted"))
+	l.Append(data(2, "open"))
+	l.Append(NewControlMessage(0, 1, AbortMarker))
+	l.Close()
+
+	l, err = Open(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if lso := l.LastStableOffset(); lso != 2 {
+		t.Error("bad last stable offset: ", lso)
+	}
+	l.Append(NewControlMessage(0, 2, CommitMarker))
+	if lso := l.LastStableOffset(); lso != l.NextOffset() {
+		t.Error("bad last stable offset: ", lso)
+	}
+
+	c, err := l.Consumer(1, ReadCommitted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	offset, msg, err := c.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 2 || string(msg.Payload) != "open" {
+		t.Errorf("unexpected message at %d: %q", offset, msg.Payload)
+	}
+}
@@ -0,0 +1,78 @@
+// Package metrics defines the instruments used to monitor logs and stores.
+//
+// The Registry interface allows to plug any metrics system; a dependency free
+// Prometheus implementation is provided by NewPrometheus.
+package metrics
+
+import (
+	"time"
+)
+
+// Constant labels of a metric
+type Labels map[string]string
+
+// A monotonic counter
+type Counter interface {
+	Add(delta float64)
+}
+
+// A value that can go up and down
+type Gauge interface {
+	Set(value float64)
+	Add(delta float64)
+}
+
+// A distribution of observed values
+type Histogram interface {
+	Observe(value float64)
+}
+
+// Creates instruments.
+// Asking twice for the same name and labels must return the same instrument.
+type Registry interface {
+	Counter(name, help string, labels Labels) Counter
+	Gauge(name, help string, labels Labels) Gauge
+	Histogram(name, help string, buckets []float64, labels Labels) Histogram
+}
+
+// Optionally implemented by registries to drop the instruments of things that are gone, like
+// closed consumers.
+type Remover interface {
+	Remove(name string, labels Labels)
+}
+
+// Buckets suitable for disk operations latencies, in seconds.
+var LatencyBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// Buckets suitable for counts of messages.
+var CountBuckets = []float64{0, 1, 10, 100, 1000, 10000, 100000, 1000000}
+
+// Observe the time elapsed since t0, in seconds.
+func ObserveSince(h Histogram, t0 time.Time) {
+	h.Observe(time.Since(t0).Seconds())
+}
+
+// A registry dropping all measurements.
+var Discard Registry = discard{}
+
+type discard struct{}
+
+func (discard) Counter(name, help string, labels Labels) Counter { return discard{} }
+func (discard) Gauge(name, help string, labels Labels) Gauge     { return discard{} }
+func (discard) Histogram(name, help string, buckets []float64, labels Labels) Histogram {
+	return discard{}
+}
+
+func (discard) Add(float64)     {}
+func (discard) Set(float64)     {}
+func (discard) Observe(float64) {}
+
+// Returns a copy of labels with the given label added.
+func (labels Labels) With(name, value string) Labels {
+	l := make(Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A registry exposing its metrics in the Prometheus text format.
+type Prometheus struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+var (
+	_ = Registry(&Prometheus{})
+	_ = Remover(&Prometheus{})
+	_ = http.Handler(&Prometheus{})
+)
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]writerTo
+}
+
+type writerTo interface {
+	writeTo(w *bufio.Writer, name, labels string)
+}
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{families: map[string]*family{}}
+}
+
+func (p *Prometheus) Counter(name, help string, labels Labels) Counter {
+	return p.get(name, help, "counter", nil, labels, func() writerTo { return &value{} }).(*value)
+}
+
+func (p *Prometheus) Gauge(name, help string, labels Labels) Gauge {
+	return p.get(name, help, "gauge", nil, labels, func() writerTo { return &value{} }).(*value)
+}
+
+func (p *Prometheus) Histogram(name, help string, buckets []float64, labels Labels) Histogram {
+	return p.get(name, help, "histogram", buckets, labels, func() writerTo {
+		return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	}).(*histogram)
+}
+
+func (p *Prometheus) get(name, help, kind string, buckets []float64, labels Labels, create func() writerTo) writerTo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	f, ok := p.families[name]
+	if !ok {
+		f = &family{
+			name:    name,
+			help:    help,
+			kind:    kind,
+			buckets: buckets,
+			series:  map[string]writerTo{},
+		}
+		p.families[name] = f
+	} else if f.kind != kind {
+		panic(fmt.Errorf("metric %s registered as %s and %s", name, f.kind, kind))
+	}
+
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = create()
+		f.series[key] = s
+	}
+	return s
+}
+
+// Remove the series of a metric with the given labels.
+func (p *Prometheus) Remove(name string, labels Labels) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if f, ok := p.families[name]; ok {
+		delete(f.series, formatLabels(labels))
+	}
+}
+
+// Write all metrics in the Prometheus text format (version 0.0.4).
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	p.mutex.Lock()
+	families := make([]*family, 0, len(p.families))
+	for _, f := range p.families {
+		families = append(families, f)
+	}
+	p.mutex.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for _, f := range families {
+		fmt.Fprintf(out, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+		fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.kind)
+
+		p.mutex.Lock()
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		series := make([]writerTo, len(keys))
+		for i, key := range keys {
+			series[i] = f.series[key]
+		}
+		p.mutex.Unlock()
+
+		for i, s := range series {
+			s.writeTo(out, f.name, keys[i])
+		}
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Format labels as `a="x",b="y"` (sorted, without braces).
+func formatLabels(labels Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + valueEscaper.Replace(labels[name]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteByte('{')
+		w.WriteString(labels)
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// A counter or gauge
+type value struct {
+	bits uint64
+}
+
+func (v *value) Set(x float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(x))
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, new) {
+			return
+		}
+	}
+}
+
+func (v *value) writeTo(w *bufio.Writer, name, labels string) {
+	writeSample(w, name, labels, math.Float64frombits(atomic.LoadUint64(&v.bits)))
+}
+
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) Observe(x float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, upperBound := range h.buckets {
+		if x <= upperBound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += x
+}
+
+func (h *histogram) writeTo(w *bufio.Writer, name, labels string) {
+	h.mutex.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mutex.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var cumulative uint64
+	for i, upperBound := range h.buckets {
+		cumulative += counts[i]
+		writeSample(w, name+"_bucket", labels+sep+`le="`+formatFloat(upperBound)+`"`, float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", labels+sep+`le="+Inf"`, float64(count))
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
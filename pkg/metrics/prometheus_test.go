@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrometheusExposition(t *testing.T) {
+	p := NewPrometheus()
+	labels := Labels{"log": `a"b`}
+
+	p.Counter("test_total", "A counter.", labels).Add(2)
+	p.Counter("test_total", "A counter.", labels).Add(1)
+	p.Gauge("test_gauge", "A gauge.", nil).Set(-1.5)
+	h := p.Histogram("test_seconds", "A histogram.", []float64{1, 2}, labels)
+	h.Observe(0.5)
+	h.Observe(1.5)
+	h.Observe(3)
+	p.Gauge("test_gauge", "A gauge.", labels).Set(1)
+	p.Remove("test_gauge", labels)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge -1.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{log="a\"b",le="1"} 1
+test_seconds_bucket{log="a\"b",le="2"} 2
+test_seconds_bucket{log="a\"b",le="+Inf"} 3
+test_seconds_sum{log="a\"b"} 5
+test_seconds_count{log="a\"b"} 3
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{log="a\"b"} 3
+`
+	if body := rec.Body.String(); body != expected {
+		t.Errorf("unexpected exposition:\n%s", body)
+	}
+}
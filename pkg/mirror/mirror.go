@@ -0,0 +1,301 @@
+// Package mirror copies a log into another one, continuously.
+//
+// The destination either keeps the offsets of the source, or already has other messages and the
+// mirror translates the offsets. In the latter case, each copied message has a header with its
+// source offset, so the mirror knows what was copied after its last checkpoint when it restarts.
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+var (
+	DestinationChanged = errors.New("the destination was written by something else than the mirror")
+	// The offset of an encrypted message is part of its encryption, so it can't change.
+	EncryptedMessage = errors.New("encrypted message, the source must be read with its keys to translate offsets")
+)
+
+const (
+	// Default interval between checkpoints.
+	DefaultCheckpointInterval = time.Second
+
+	// Prefix of the header holding the source offset of copied messages.
+	OffsetHeaderPrefix = "mirror-offset:"
+
+	pollInterval = 500 * time.Millisecond
+)
+
+type Config struct {
+	// The name of the mirror, naming its checkpoint and offset headers.
+	Name string
+	// Keep the offsets of the source. The destination must only be written by the mirror.
+	PreserveOffsets bool
+	// The first offset copied when there's no checkpoint yet (default: the start of the source).
+	StartOffset uint64
+	// The interval between checkpoints (default: DefaultCheckpointInterval).
+	CheckpointInterval time.Duration
+}
+
+// The persisted state of a mirror.
+type checkpoint struct {
+	// The next offset to copy from the source.
+	SourceOffset uint64 `json:"sourceOffset"`
+	// The next offset of the destination when the checkpoint was written.
+	DestinationOffset uint64 `json:"destinationOffset"`
+	// The offset translations (when not preserving offsets).
+	Ranges []Range `json:"ranges,omitempty"`
+}
+
+// Offsets of the source from Source, up to the next range, are copied at Destination + (offset - Source).
+type Range struct {
+	Source      uint64 `json:"source"`
+	Destination uint64 `json:"destination"`
+}
+
+type Mirror struct {
+	config      Config
+	source      Source
+	dest        *log.Log
+	checkpoints log.SnapshotStore
+
+	mutex sync.Mutex
+	state checkpoint
+	// whether the state changed since the last checkpoint
+	dirty          bool
+	lastCheckpoint time.Time
+}
+
+// Create a mirror, resuming from its checkpoint if any.
+func New(source Source, dest *log.Log, checkpoints log.SnapshotStore, config Config) (*Mirror, error) {
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = DefaultCheckpointInterval
+	}
+	m := &Mirror{
+		config:      config,
+		source:      source,
+		dest:        dest,
+		checkpoints: checkpoints,
+	}
+
+	data, err := checkpoints.ReadSnapshot(m.checkpointName())
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &m.state); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint: %v", err)
+		}
+	} else {
+		// first run
+		start := config.StartOffset
+		if start == 0 {
+			if start, err = source.StartOffset(); err != nil {
+				return nil, err
+			}
+		}
+		m.state = checkpoint{SourceOffset: start, DestinationOffset: dest.NextOffset()}
+	}
+
+	if config.PreserveOffsets {
+		if data == nil && dest.NextOffset() != m.state.SourceOffset {
+			return nil, fmt.Errorf("can't preserve offsets: the destination is at offset %d, the source at %d",
+				dest.NextOffset(), m.state.SourceOffset)
+		}
+		// the messages appended after the checkpoint were copied
+		if next := dest.NextOffset(); next < m.state.SourceOffset {
+			return nil, fmt.Errorf("%v: it's at offset %d, before the checkpoint at %d", DestinationChanged, next, m.state.SourceOffset)
+		}
+		m.state.SourceOffset = dest.NextOffset()
+		m.state.DestinationOffset = dest.NextOffset()
+	} else if err := m.recover(); err != nil {
+		return nil, err
+	}
+
+	// the first checkpoint bounds the recovery of the next runs
+	if err := m.writeCheckpoint(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mirror) checkpointName() string {
+	if m.config.Name == "" {
+		return "mirror"
+	}
+	return "mirror-" + m.config.Name
+}
+
+func (m *Mirror) offsetHeader() string {
+	return OffsetHeaderPrefix + m.config.Name
+}
+
+// Find the messages copied after the checkpoint.
+func (m *Mirror) recover() error {
+	next := m.dest.NextOffset()
+	if next < m.state.DestinationOffset {
+		return fmt.Errorf("%v: it's at offset %d, before the checkpoint at %d", DestinationChanged, next, m.state.DestinationOffset)
+	}
+	if next == m.state.DestinationOffset {
+		return nil
+	}
+
+	c, err := m.dest.Consumer(m.state.DestinationOffset, log.ControlMessages())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for destOffset := m.state.DestinationOffset; destOffset < next; destOffset++ {
+		offset, msg, err := c.Next()
+		if err != nil {
+			return err
+		}
+		value := msg.Header(m.offsetHeader())
+		if value == nil {
+			continue
+		}
+		sourceOffset, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s header at offset %d", m.offsetHeader(), offset)
+		}
+		m.copied(sourceOffset, offset)
+	}
+	m.state.DestinationOffset = next
+	return nil
+}
+
+// Record a copied message.
+func (m *Mirror) copied(sourceOffset, destOffset uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.config.PreserveOffsets {
+		ranges := m.state.Ranges
+		if n := len(ranges); n == 0 || destOffset-ranges[n-1].Destination != sourceOffset-ranges[n-1].Source ||
+			sourceOffset != m.state.SourceOffset {
+			m.state.Ranges = append(ranges, Range{sourceOffset, destOffset})
+		}
+	}
+	m.state.SourceOffset = sourceOffset + 1
+	m.state.DestinationOffset = destOffset + 1
+	m.dirty = true
+}
+
+// The destination offset of a source offset, if it was copied.
+func (m *Mirror) Translate(sourceOffset uint64) (uint64, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if sourceOffset >= m.state.SourceOffset {
+		return 0, false
+	}
+	if m.config.PreserveOffsets {
+		return sourceOffset, true
+	}
+
+	ranges := m.state.Ranges
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].Source > sourceOffset }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return ranges[i].Destination + sourceOffset - ranges[i].Source, true
+}
+
+// The next offset to copy from the source.
+func (m *Mirror) Position() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state.SourceOffset
+}
+
+func (m *Mirror) writeCheckpoint() error {
+	m.mutex.Lock()
+	data, err := json.Marshal(m.state)
+	m.dirty = false
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the checkpoint must not be ahead of the destination
+	m.dest.Sync()
+	if err := m.checkpoints.WriteSnapshot(m.checkpointName(), data); err != nil {
+		return err
+	}
+	m.lastCheckpoint = time.Now()
+	return nil
+}
+
+func (m *Mirror) checkpointIfDue() error {
+	if !m.dirty || time.Since(m.lastCheckpoint) < m.config.CheckpointInterval {
+		return nil
+	}
+	return m.writeCheckpoint()
+}
+
+// Copy messages until stop is closed or an error occurs, writing a last checkpoint when stopping.
+func (m *Mirror) Run(stop <-chan struct{}) error {
+	sub, err := m.source.Subscribe(m.Position())
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case <-stop:
+			return m.writeCheckpoint()
+		default:
+		}
+
+		offset, msg, err := sub.Next(pollInterval)
+		if err != nil {
+			m.writeCheckpoint()
+			return err
+		}
+		if msg != nil {
+			if err := m.copy(offset, msg); err != nil {
+				m.writeCheckpoint()
+				return err
+			}
+		}
+		if err := m.checkpointIfDue(); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Mirror) copy(offset uint64, msg *log.Message) error {
+	if m.config.PreserveOffsets {
+		if next := m.dest.NextOffset(); next != offset {
+			return fmt.Errorf("%v: it's at offset %d, the mirror at %d", DestinationChanged, next, offset)
+		}
+	} else {
+		if msg.IsEncrypted() {
+			return fmt.Errorf("%v: offset %d", EncryptedMessage, offset)
+		}
+		if msg.Format < 2 {
+			msg.Format = 2
+		}
+		msg.Headers = append(msg.Headers, log.Header{
+			Key:   m.offsetHeader(),
+			Value: []byte(strconv.FormatUint(offset, 10)),
+		})
+		msg.UpdateCRC()
+	}
+
+	destOffset, err := m.dest.Append(msg)
+	if err != nil {
+		return err
+	}
+	m.copied(offset, destOffset)
+	return nil
+}
@@ -0,0 +1,250 @@
+package mirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func openLog(t *testing.T, dir string) (*log.Log, *kafka.Store) {
+	store := kafka.Open(dir, 0)
+	l, err := log.Open(log.Config{MaxSegmentSize: 1 << 20, MaxSyncLag: 0}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, store
+}
+
+func appendMessages(t *testing.T, l *log.Log, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(log.NewMessage(1, nil, []byte(fmt.Sprint(prefix, i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Run the mirror until it copied the source up to the given offset.
+func runUntil(t *testing.T, m *Mirror, offset uint64) {
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() { errs <- m.Run(stop) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Position() <= offset {
+		if time.Now().After(deadline) {
+			t.Fatal("mirror stuck at ", m.Position())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func payload(t *testing.T, l *log.Log, offset uint64) string {
+	c, err := l.Consumer(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, msg, err := c.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(msg.Payload)
+}
+
+func TestMirrorTranslate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, _ := openLog(t, filepath.Join(dir, "source"))
+	defer source.Close()
+	dest, destStore := openLog(t, filepath.Join(dir, "dest"))
+	defer dest.Close()
+
+	appendMessages(t, source, "s", 5)
+	// the destination already has messages
+	appendMessages(t, dest, "d", 3)
+
+	config := Config{Name: "test", CheckpointInterval: time.Hour}
+	m, err := New(LogSource(source), dest, destStore, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initialCheckpoint, _ := destStore.ReadSnapshot("mirror-test")
+
+	runUntil(t, m, 5)
+	for sourceOffset := uint64(1); sourceOffset <= 5; sourceOffset++ {
+		destOffset, ok := m.Translate(sourceOffset)
+		if !ok || destOffset != sourceOffset+3 {
+			t.Fatalf("offset %d translated to %d, %v", sourceOffset, destOffset, ok)
+		}
+		if p := payload(t, dest, destOffset); p != fmt.Sprint("s", sourceOffset-1) {
+			t.Fatalf("bad payload at %d: %q", destOffset, p)
+		}
+	}
+	if _, ok := m.Translate(6); ok {
+		t.Error("offset 6 translated before being copied")
+	}
+
+	// something else writes to the destination, then the mirror restarts having lost its last
+	// checkpoint, as if it crashed
+	appendMessages(t, dest, "d", 2)
+	appendMessages(t, source, "s", 2)
+	destStore.WriteSnapshot("mirror-test", initialCheckpoint)
+
+	if m, err = New(LogSource(source), dest, destStore, config); err != nil {
+		t.Fatal(err)
+	}
+	if p := m.Position(); p != 6 {
+		t.Fatal("resumed at ", p)
+	}
+	runUntil(t, m, 7)
+	if next := dest.NextOffset(); next != 13 {
+		t.Fatal("messages copied twice or lost, next offset: ", next)
+	}
+	for sourceOffset, expected := range map[uint64]uint64{1: 4, 5: 8, 6: 11, 7: 12} {
+		if destOffset, ok := m.Translate(sourceOffset); !ok || destOffset != expected {
+			t.Errorf("offset %d translated to %d, expected %d", sourceOffset, destOffset, expected)
+		}
+	}
+}
+
+func TestMirrorPreserveOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, _ := openLog(t, filepath.Join(dir, "source"))
+	defer source.Close()
+	dest, destStore := openLog(t, filepath.Join(dir, "dest"))
+	defer dest.Close()
+	appendMessages(t, source, "s", 3)
+
+	config := Config{PreserveOffsets: true}
+	m, err := New(LogSource(source), dest, destStore, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runUntil(t, m, 3)
+	if p := payload(t, dest, 3); p != "s2" {
+		t.Fatal("bad payload: ", p)
+	}
+
+	// resumes where the destination is
+	appendMessages(t, source, "s", 1)
+	if m, err = New(LogSource(source), dest, destStore, config); err != nil {
+		t.Fatal(err)
+	}
+	runUntil(t, m, 4)
+	if p := payload(t, dest, 4); p != "s0" {
+		t.Fatal("bad payload: ", p)
+	}
+
+	// something else writes to the destination
+	if m, err = New(LogSource(source), dest, destStore, config); err != nil {
+		t.Fatal(err)
+	}
+	appendMessages(t, dest, "d", 1)
+	appendMessages(t, source, "s", 1)
+	if err := m.Run(nil); err == nil {
+		t.Error("mirrored over a changed destination")
+	}
+}
+
+func TestMirrorTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := log.Config{MaxSegmentSize: 1 << 20, MaxSyncLag: 0, Transactional: true}
+	source, err := log.Open(config, kafka.Open(filepath.Join(dir, "source"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	msg := log.NewMessage(1, nil, []byte("in a transaction"))
+	msg.SetTransactional(42, 0)
+	source.Append(msg)
+	source.Append(log.NewControlMessage(1, 42, log.CommitMarker))
+	appendMessages(t, source, "s", 1)
+
+	for _, preserveOffsets := range []bool{true, false} {
+		name := fmt.Sprint("dest-", preserveOffsets)
+		destStore := kafka.Open(filepath.Join(dir, name), 0)
+		dest, err := log.Open(config, destStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dest.Close()
+		if !preserveOffsets {
+			appendMessages(t, dest, "d", 1)
+		}
+
+		m, err := New(LogSource(source), dest, destStore, Config{PreserveOffsets: preserveOffsets})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runUntil(t, m, 3)
+		if next, lso := dest.NextOffset(), dest.LastStableOffset(); lso != next {
+			t.Errorf("%s: the transaction is still open, last stable offset %d, next offset %d", name, lso, next)
+		}
+		if destOffset, ok := m.Translate(3); !ok || payload(t, dest, destOffset) != "s0" {
+			t.Errorf("%s: offset 3 translated to %d, %v", name, destOffset, ok)
+		}
+	}
+}
+
+func TestMirrorEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, _ := openLog(t, filepath.Join(dir, "source"))
+	defer source.Close()
+	msg := log.NewMessageWithHeaders(1, nil, []byte("ciphertext"), []log.Header{{Key: "encryption-key", Value: []byte("k")}})
+	msg.Attributes |= log.EncryptedAttribute
+	msg.UpdateCRC()
+	source.Append(msg)
+
+	// the offset of an encrypted message can't change
+	dest, destStore := openLog(t, filepath.Join(dir, "dest"))
+	defer dest.Close()
+	appendMessages(t, dest, "d", 1)
+	m, err := New(LogSource(source), dest, destStore, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(nil); err == nil || !strings.HasPrefix(err.Error(), EncryptedMessage.Error()) {
+		t.Error("expected EncryptedMessage, got ", err)
+	}
+
+	// it can be copied at the same offset
+	dest, destStore = openLog(t, filepath.Join(dir, "preserved"))
+	defer dest.Close()
+	if m, err = New(LogSource(source), dest, destStore, Config{PreserveOffsets: true}); err != nil {
+		t.Fatal(err)
+	}
+	runUntil(t, m, 1)
+	if p := payload(t, dest, 1); p != "ciphertext" {
+		t.Error("bad payload: ", p)
+	}
+}
@@ -0,0 +1,138 @@
+package mirror
+
+import (
+	"context"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/rpc"
+)
+
+// Where a mirror reads messages.
+type Source interface {
+	// The first offset available.
+	StartOffset() (uint64, error)
+	// Read messages from an offset, following the end of the source.
+	Subscribe(offset uint64) (Subscription, error)
+}
+
+type Subscription interface {
+	// The next message, or a nil message if none came before the timeout.
+	Next(timeout time.Duration) (uint64, *log.Message, error)
+	Close()
+}
+
+// A log as a source, transaction markers included.
+func LogSource(l *log.Log) Source {
+	return logSource{l}
+}
+
+type logSource struct {
+	log *log.Log
+}
+
+func (s logSource) StartOffset() (uint64, error) {
+	return s.log.StartOffset(), nil
+}
+
+func (s logSource) Subscribe(offset uint64) (Subscription, error) {
+	if offset < s.log.StartOffset() || offset > s.log.NextOffset() {
+		return nil, log.OffsetOutOfRange
+	}
+	// the transaction markers are copied with the messages of the transactions
+	c, err := s.log.Consumer(offset, log.ControlMessages())
+	if err != nil {
+		return nil, err
+	}
+	return logSubscription{c}, nil
+}
+
+type logSubscription struct {
+	*log.Consumer
+}
+
+func (s logSubscription) Next(timeout time.Duration) (uint64, *log.Message, error) {
+	return s.Consumer.NextTimeout(timeout)
+}
+
+// A log served by the rpc package as a source. The records don't have the producer ids,
+// sequences nor transaction attributes of the messages.
+func RemoteSource(client *rpc.Client, name string) Source {
+	return remoteSource{client, name}
+}
+
+type remoteSource struct {
+	client *rpc.Client
+	name   string
+}
+
+func (s remoteSource) StartOffset() (uint64, error) {
+	info, err := s.client.Info(context.Background(), &rpc.InfoRequest{Log: s.name})
+	if err != nil {
+		return 0, err
+	}
+	return info.StartOffset, nil
+}
+
+func (s remoteSource) Subscribe(offset uint64) (Subscription, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := s.client.Subscribe(ctx, &rpc.SubscribeRequest{Log: s.name, Offset: &offset})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	rs := &remoteSubscription{results: make(chan remoteResult), cancel: cancel}
+	go func() {
+		for {
+			record, err := sub.Recv()
+			select {
+			case rs.results <- remoteResult{record, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return rs, nil
+}
+
+type remoteResult struct {
+	record *rpc.Record
+	err    error
+}
+
+type remoteSubscription struct {
+	// unbuffered, so records are received as they're read
+	results chan remoteResult
+	cancel  func()
+}
+
+func (s *remoteSubscription) Next(timeout time.Duration) (uint64, *log.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return 0, nil, nil
+	case result := <-s.results:
+		if result.err != nil {
+			return 0, nil, result.err
+		}
+		r := result.record
+		if len(r.Headers) == 0 {
+			return r.Offset, log.NewMessage(r.Timestamp, r.Key, r.Value), nil
+		}
+		headers := make([]log.Header, len(r.Headers))
+		for i, h := range r.Headers {
+			headers[i] = log.Header{Key: h.Key, Value: h.Value}
+		}
+		return r.Offset, log.NewMessageWithHeaders(r.Timestamp, r.Key, r.Value, headers), nil
+	}
+}
+
+func (s *remoteSubscription) Close() {
+	s.cancel()
+}
@@ -0,0 +1,63 @@
+package quota
+
+import (
+	"time"
+)
+
+// A token bucket, filled at rate tokens per second up to burst tokens.
+// A rate of 0 is unlimited.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) setRate(rate float64, burst time.Duration) {
+	b.rate = rate
+	b.burst = rate * burst.Seconds()
+	if b.last.IsZero() || b.tokens > b.burst {
+		// new buckets start full
+		b.tokens = b.burst
+	}
+}
+
+func (b *bucket) fill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// How long to wait for n tokens to be available, or a full bucket if n is more than its burst.
+func (b *bucket) delay(now time.Time, n float64) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.fill(now)
+	if n > b.burst {
+		n = b.burst
+	}
+	if missing := n - b.tokens; missing > 0 {
+		return time.Duration(missing / b.rate * float64(time.Second))
+	}
+	return 0
+}
+
+// Take n tokens, going into debt if there are not enough.
+func (b *bucket) take(now time.Time, n float64) {
+	if b.rate == 0 {
+		return
+	}
+	b.fill(now)
+	b.tokens -= n
+}
+
+// Check if the bucket is full, so it can be forgotten.
+func (b *bucket) full(now time.Time) bool {
+	b.fill(now)
+	return b.rate == 0 || b.tokens >= b.burst
+}
@@ -0,0 +1,242 @@
+// Rate limits of the producers and consumers of logs.
+//
+// Token buckets limit the bytes and messages appended per second, and the bytes read per second,
+// of each log (all its clients together) and of each client id (on all the logs). Producers over
+// quota are delayed, or rejected when the delay would be too long. Consumers are only delayed.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+var Exceeded = errors.New("quota exceeded")
+
+// Rates per second (0: unlimited).
+type Rates struct {
+	ProduceBytes    float64 `json:"produceBytes,omitempty"`
+	ProduceMessages float64 `json:"produceMessages,omitempty"`
+	ConsumeBytes    float64 `json:"consumeBytes,omitempty"`
+}
+
+type Config struct {
+	// Rates of each log by name, and of the logs not listed.
+	Logs       map[string]Rates
+	DefaultLog Rates
+	// Rates of each client by id, and of the clients not listed.
+	Clients       map[string]Rates
+	DefaultClient Rates
+
+	// How much an idle producer or consumer can send or read at once, as a duration of its
+	// rate (default: 1 second).
+	Burst time.Duration
+	// Delay producers over quota at most this long, rejecting them beyond (0: always reject).
+	MaxThrottle time.Duration
+}
+
+// Read a configuration in JSON, durations being strings like "1.5s":
+//
+//	{
+//	  "logs": {"<log>": {"produceBytes": 1e6, "produceMessages": 1000, "consumeBytes": 1e7}},
+//	  "defaultLog": {...},
+//	  "clients": {"<client id>": {...}},
+//	  "defaultClient": {...},
+//	  "burst": "1s",
+//	  "maxThrottle": "5s"
+//	}
+func ReadConfig(r io.Reader) (Config, error) {
+	data := struct {
+		Logs          map[string]Rates `json:"logs"`
+		DefaultLog    Rates            `json:"defaultLog"`
+		Clients       map[string]Rates `json:"clients"`
+		DefaultClient Rates            `json:"defaultClient"`
+		Burst         string           `json:"burst"`
+		MaxThrottle   string           `json:"maxThrottle"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return Config{}, err
+	}
+	config := Config{
+		Logs:          data.Logs,
+		DefaultLog:    data.DefaultLog,
+		Clients:       data.Clients,
+		DefaultClient: data.DefaultClient,
+	}
+	var err error
+	if data.Burst != "" {
+		if config.Burst, err = time.ParseDuration(data.Burst); err != nil {
+			return Config{}, fmt.Errorf("invalid burst: %v", err)
+		}
+	}
+	if data.MaxThrottle != "" {
+		if config.MaxThrottle, err = time.ParseDuration(data.MaxThrottle); err != nil {
+			return Config{}, fmt.Errorf("invalid maxThrottle: %v", err)
+		}
+	}
+	return config, nil
+}
+
+func (c *Config) logRates(name string) Rates {
+	if r, ok := c.Logs[name]; ok {
+		return r
+	}
+	return c.DefaultLog
+}
+
+func (c *Config) clientRates(id string) Rates {
+	if r, ok := c.Clients[id]; ok {
+		return r
+	}
+	return c.DefaultClient
+}
+
+func (c *Config) burst() time.Duration {
+	if c.Burst <= 0 {
+		return time.Second
+	}
+	return c.Burst
+}
+
+type buckets struct {
+	produceBytes    bucket
+	produceMessages bucket
+	consumeBytes    bucket
+}
+
+func (b *buckets) setRates(r Rates, burst time.Duration) {
+	b.produceBytes.setRate(r.ProduceBytes, burst)
+	b.produceMessages.setRate(r.ProduceMessages, burst)
+	b.consumeBytes.setRate(r.ConsumeBytes, burst)
+}
+
+func (b *buckets) full(now time.Time) bool {
+	return b.produceBytes.full(now) && b.produceMessages.full(now) && b.consumeBytes.full(now)
+}
+
+// Forget the buckets of idle clients beyond this many clients.
+const maxIdleClients = 10000
+
+// The quotas of logs and clients. Safe for concurrent use.
+type Quotas struct {
+	mutex   sync.Mutex
+	config  Config
+	logs    map[string]*buckets
+	clients map[string]*buckets
+}
+
+func New(config Config) *Quotas {
+	return &Quotas{
+		config:  config,
+		logs:    map[string]*buckets{},
+		clients: map[string]*buckets{},
+	}
+}
+
+// Change the configuration. The buckets keep their tokens, up to their new burst.
+func (q *Quotas) SetConfig(config Config) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.config = config
+	for name, b := range q.logs {
+		b.setRates(config.logRates(name), config.burst())
+	}
+	for id, b := range q.clients {
+		b.setRates(config.clientRates(id), config.burst())
+	}
+}
+
+func (q *Quotas) buckets(logName, clientID string, now time.Time) (*buckets, *buckets) {
+	l := q.logs[logName]
+	if l == nil {
+		l = &buckets{}
+		l.setRates(q.config.logRates(logName), q.config.burst())
+		q.logs[logName] = l
+	}
+	c := q.clients[clientID]
+	if c == nil {
+		if len(q.clients) >= maxIdleClients {
+			for id, b := range q.clients {
+				if b.full(now) {
+					delete(q.clients, id)
+				}
+			}
+		}
+		c = &buckets{}
+		c.setRates(q.config.clientRates(clientID), q.config.burst())
+		q.clients[clientID] = c
+	}
+	return l, c
+}
+
+// Account for a producer appending messages of the given size to a log. Returns how long the
+// producer must wait before appending them, or Exceeded and how long it should wait before
+// trying again if it's rejected (its quota is then unchanged).
+func (q *Quotas) Produce(logName, clientID string, messages, bytes int) (time.Duration, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	l, c := q.buckets(logName, clientID, now)
+	delay := time.Duration(0)
+	for _, d := range []time.Duration{
+		l.produceBytes.delay(now, float64(bytes)),
+		l.produceMessages.delay(now, float64(messages)),
+		c.produceBytes.delay(now, float64(bytes)),
+		c.produceMessages.delay(now, float64(messages)),
+	} {
+		if d > delay {
+			delay = d
+		}
+	}
+	if delay > q.config.MaxThrottle {
+		return delay, Exceeded
+	}
+
+	for _, b := range []*buckets{l, c} {
+		b.produceBytes.take(now, float64(bytes))
+		b.produceMessages.take(now, float64(messages))
+	}
+	return delay, nil
+}
+
+// Account for a consumer reading bytes from a log. Returns how long it must wait before reading more.
+func (q *Quotas) Consume(logName, clientID string, bytes int) time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	l, c := q.buckets(logName, clientID, now)
+	delay := time.Duration(0)
+	for _, b := range []*buckets{l, c} {
+		// the bytes are already read, the debt delays the next reads
+		b.consumeBytes.take(now, float64(bytes))
+		if d := b.consumeBytes.delay(now, 0); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// Append a message to a log, waiting for the producer's quota if needed.
+func (q *Quotas) Append(l *log.Log, logName, clientID string, msg *log.Message) (uint64, error) {
+	delay, err := q.Produce(logName, clientID, 1, int(8+4+msg.Len()))
+	if err != nil {
+		return 0, err
+	}
+	time.Sleep(delay)
+	return l.Append(msg)
+}
+
+// A consumer option applying the consumer quotas.
+func (q *Quotas) Consumer(logName, clientID string) log.ConsumerOption {
+	return log.Throttle(func(size int) time.Duration {
+		return q.Consume(logName, clientID, size)
+	})
+}
@@ -0,0 +1,106 @@
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func TestProduce(t *testing.T) {
+	q := New(Config{
+		Logs:          map[string]Rates{"small": {ProduceMessages: 10}},
+		DefaultClient: Rates{ProduceBytes: 1000},
+		Burst:         100 * time.Millisecond,
+		MaxThrottle:   time.Second,
+	})
+
+	// one message every 100ms on the small log, after a burst of one
+	if delay, err := q.Produce("small", "a", 1, 1); err != nil || delay != 0 {
+		t.Fatal("unexpected throttle: ", delay, err)
+	}
+	if delay, err := q.Produce("small", "b", 1, 1); err != nil || delay < 80*time.Millisecond {
+		t.Error("expected a delay, got ", delay, err)
+	}
+	// 100 bytes every 100ms for each client, on any log
+	if delay, err := q.Produce("other", "c", 1, 100); err != nil || delay != 0 {
+		t.Fatal("unexpected throttle: ", delay, err)
+	}
+	if delay, err := q.Produce("other", "d", 1, 100); err != nil || delay != 0 {
+		t.Fatal("unexpected throttle of another client: ", delay, err)
+	}
+	if delay, err := q.Produce("other", "c", 1, 100); err != nil || delay < 80*time.Millisecond {
+		t.Error("expected a delay, got ", delay, err)
+	}
+
+	// reject instead of throttling
+	q.SetConfig(Config{DefaultClient: Rates{ProduceBytes: 1000}, Burst: 100 * time.Millisecond})
+	if delay, err := q.Produce("other", "c", 1, 100); err != Exceeded || delay == 0 {
+		t.Error("expected a rejection, got ", delay, err)
+	}
+	if _, err := q.Produce("small", "e", 1, 100); err != nil {
+		t.Error("the small log is not limited anymore: ", err)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := log.Open(log.Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, kafka.Open(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	msg := log.NewMessage(1, nil, make([]byte, 100-8-4-4-1-1-8-4-4))
+	if size := 8 + 4 + msg.Len(); size != 100 {
+		t.Fatal("unexpected message size: ", size)
+	}
+	for i := 0; i < 5; i++ {
+		l.Append(msg)
+	}
+
+	// 100 bytes every 50ms, after a burst of 100 bytes
+	q := New(Config{DefaultLog: Rates{ConsumeBytes: 2000}, Burst: 50 * time.Millisecond})
+	c, err := l.Consumer(1, q.Consumer("log", "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	t0 := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, _, err := c.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(t0); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Error("unexpected consumption time: ", elapsed)
+	}
+
+	// the throttle doesn't hold timeouts back
+	if _, msg, err := c.NextTimeout(10 * time.Millisecond); err != nil || msg != nil {
+		t.Error("unexpected read: ", msg, err)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	config, err := ReadConfig(strings.NewReader(`{"logs": {"a": {"produceBytes": 100}}, "defaultClient": {"consumeBytes": 10}, "maxThrottle": "2s"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Logs["a"].ProduceBytes != 100 || config.DefaultClient.ConsumeBytes != 10 || config.MaxThrottle != 2*time.Second || config.Burst != 0 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if _, err := ReadConfig(strings.NewReader(`{"burst": "soon"}`)); err == nil {
+		t.Error("invalid burst accepted")
+	}
+}
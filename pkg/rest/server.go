@@ -0,0 +1,505 @@
+// Package rest exposes logs over HTTP, with JSON bodies.
+//
+// Endpoints, {log} being the name of a log:
+//
+//	GET  /logs                  names and metadata of the logs
+//	GET  /logs/{log}            metadata of a log: offsets and segments
+//	POST /logs/{log}/messages   append a batch of records, returning their offsets
+//	GET  /logs/{log}/messages   read records, waiting for them if needed (long polling)
+//	GET  /logs/{log}/events     stream records as Server-Sent Events
+//
+// Appended batches are limited to MaxRecords records and MaxProduceBytes bytes of JSON, larger
+// ones are rejected with 413 Request Entity Too Large.
+//
+// Reads start at the offset parameter, the end of the log by default, and are limited by the
+// max (records) and maxBytes parameters. They wait up to the wait parameter (a duration) for a
+// first record. With isolation=read_committed, only records of committed transactions are read.
+//
+// Keys, values and header values are base64 encoded, like []byte values in encoding/json.
+//
+// With quotas, clients are identified by the X-Client-Id header. Producers over quota are delayed,
+// or rejected with 429 Too Many Requests and a Retry-After header.
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/quota"
+)
+
+const (
+	// Default and maximum number of records returned by a read. The maximum also applies to the
+	// records appended by a request.
+	DefaultMaxRecords = 100
+	MaxRecords        = 10000
+	// Maximum size of the body of an append request.
+	MaxProduceBytes = 16 << 20
+	// Default maximum size of the records returned by a read.
+	DefaultMaxBytes = 1 << 20
+	// Maximum time a read waits for records.
+	MaxWait = time.Minute
+	// Interval between keep alive comments in event streams.
+	KeepAliveInterval = 15 * time.Second
+
+	streamPollInterval = 500 * time.Millisecond
+)
+
+// The header identifying clients, for quotas.
+const ClientIDHeader = "X-Client-Id"
+
+type Server struct {
+	logs   map[string]*log.Log
+	quotas *quota.Quotas
+}
+
+// Create a server of the given logs, by name.
+func NewServer(logs map[string]*log.Log) *Server {
+	return &Server{logs: logs}
+}
+
+// Apply quotas to the producers and consumers. Must be called before serving requests.
+func (s *Server) SetQuotas(q *quota.Quotas) {
+	s.quotas = q
+}
+
+// A record, as appended and read.
+type Record struct {
+	Offset    uint64   `json:"offset,omitempty"`
+	Timestamp uint64   `json:"timestamp,omitempty"`
+	Key       []byte   `json:"key,omitempty"`
+	Value     []byte   `json:"value"`
+	Headers   []Header `json:"headers,omitempty"`
+}
+
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type ProduceRequest struct {
+	Records []Record `json:"records"`
+}
+
+type ProduceResponse struct {
+	Offsets []uint64 `json:"offsets"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type ConsumeResponse struct {
+	Records []Record `json:"records"`
+	// The offset to read from next.
+	NextOffset uint64 `json:"nextOffset"`
+}
+
+type Metadata struct {
+	Name             string            `json:"name"`
+	StartOffset      uint64            `json:"startOffset"`
+	NextOffset       uint64            `json:"nextOffset"`
+	SyncOffset       uint64            `json:"syncOffset"`
+	LastStableOffset uint64            `json:"lastStableOffset"`
+	Segments         []SegmentMetadata `json:"segments"`
+}
+
+type SegmentMetadata struct {
+	StartOffset uint64 `json:"startOffset"`
+	// The size of the segment in bytes, if known.
+	Size *int64 `json:"size,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "logs" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		s.allowMethods(w, r, map[string]http.HandlerFunc{"GET": s.listLogs})
+		return
+	}
+
+	name := parts[1]
+	l := s.logs[name]
+	if l == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown log: %q", name))
+		return
+	}
+
+	if len(parts) == 2 {
+		s.allowMethods(w, r, map[string]http.HandlerFunc{"GET": func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, metadata(name, l))
+		}})
+		return
+	}
+
+	switch parts[2] {
+	case "messages":
+		s.allowMethods(w, r, map[string]http.HandlerFunc{
+			"GET":  func(w http.ResponseWriter, r *http.Request) { s.consume(w, r, name, l) },
+			"POST": func(w http.ResponseWriter, r *http.Request) { s.produce(w, r, name, l) },
+		})
+	case "events":
+		s.allowMethods(w, r, map[string]http.HandlerFunc{
+			"GET": func(w http.ResponseWriter, r *http.Request) { s.stream(w, r, name, l) },
+		})
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) allowMethods(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	handler := handlers[r.Method]
+	if handler == nil {
+		methods := make([]string, 0, len(handlers))
+		for method := range handlers {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	handler(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{message})
+}
+
+func (s *Server) listLogs(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.logs))
+	for name := range s.logs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	logs := make([]Metadata, len(names))
+	for i, name := range names {
+		logs[i] = metadata(name, s.logs[name])
+	}
+	writeJSON(w, http.StatusOK, logs)
+}
+
+func metadata(name string, l *log.Log) Metadata {
+	m := Metadata{
+		Name:             name,
+		StartOffset:      l.StartOffset(),
+		NextOffset:       l.NextOffset(),
+		SyncOffset:       l.SyncOffset(),
+		LastStableOffset: l.LastStableOffset(),
+	}
+	for _, segment := range l.Segments() {
+		sm := SegmentMetadata{StartOffset: segment.StartOffset()}
+		if sized, ok := segment.(log.SizedSegment); ok {
+			if size, err := sized.Size(); err == nil {
+				sm.Size = &size
+			}
+		}
+		m.Segments = append(m.Segments, sm)
+	}
+	return m
+}
+
+func (s *Server) produce(w http.ResponseWriter, r *http.Request, name string, l *log.Log) {
+	req := ProduceRequest{}
+	body := &countingReader{r: http.MaxBytesReader(w, r.Body, MaxProduceBytes)}
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		if body.n >= MaxProduceBytes {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request larger than %d bytes", MaxProduceBytes))
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	if len(req.Records) > MaxRecords {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("more than %d records", MaxRecords))
+		return
+	}
+
+	now := log.Timestamp(time.Now())
+	messages := make([]*log.Message, 0, len(req.Records))
+	size := 0
+	for _, record := range req.Records {
+		timestamp := record.Timestamp
+		if timestamp == 0 {
+			timestamp = now
+		}
+		var msg *log.Message
+		if len(record.Headers) != 0 {
+			headers := make([]log.Header, len(record.Headers))
+			for i, h := range record.Headers {
+				headers[i] = log.Header{Key: h.Key, Value: h.Value}
+			}
+			msg = log.NewMessageWithHeaders(timestamp, record.Key, record.Value, headers)
+		} else {
+			msg = log.NewMessage(timestamp, record.Key, record.Value)
+		}
+		messages = append(messages, msg)
+		size += int(8 + 4 + msg.Len())
+	}
+
+	if s.quotas != nil {
+		delay, err := s.quotas.Produce(name, r.Header.Get(ClientIDHeader), len(messages), size)
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(delay/time.Second)+1))
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if !sleep(r.Context(), delay) {
+			return
+		}
+	}
+
+	res := ProduceResponse{Offsets: make([]uint64, 0, len(messages))}
+	for _, msg := range messages {
+		offset, err := l.Append(msg)
+		if err != nil {
+			// the records before were appended, the client must not send them again
+			res.Error = err.Error()
+			writeJSON(w, http.StatusInternalServerError, res)
+			return
+		}
+		res.Offsets = append(res.Offsets, offset)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// A reader counting the bytes read, to tell when a request body reached its limit.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// The parameters of reads.
+type consumeParams struct {
+	offset        uint64
+	maxRecords    int
+	maxBytes      int
+	wait          time.Duration
+	readCommitted bool
+}
+
+func parseConsumeParams(r *http.Request, l *log.Log) (*consumeParams, error) {
+	q := r.URL.Query()
+	p := &consumeParams{
+		offset:        l.NextOffset(),
+		maxRecords:    DefaultMaxRecords,
+		maxBytes:      DefaultMaxBytes,
+		readCommitted: q.Get("isolation") == "read_committed",
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset: %q", v)
+		}
+		p.offset = offset
+	} else if v := r.Header.Get("Last-Event-ID"); v != "" {
+		// resuming an event stream
+		offset, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Last-Event-ID: %q", v)
+		}
+		p.offset = offset + 1
+	}
+	if p.offset < l.StartOffset() || p.offset > l.NextOffset() {
+		return nil, fmt.Errorf("offset %d out of range [%d, %d]", p.offset, l.StartOffset(), l.NextOffset())
+	}
+
+	if v := q.Get("max"); v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil || max <= 0 || max > MaxRecords {
+			return nil, fmt.Errorf("invalid max: %q", v)
+		}
+		p.maxRecords = max
+	}
+	if v := q.Get("maxBytes"); v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil || max <= 0 {
+			return nil, fmt.Errorf("invalid maxBytes: %q", v)
+		}
+		p.maxBytes = max
+	}
+	if v := q.Get("wait"); v != "" {
+		wait, err := time.ParseDuration(v)
+		if err != nil || wait < 0 || wait > MaxWait {
+			return nil, fmt.Errorf("invalid wait: %q", v)
+		}
+		p.wait = wait
+	}
+	return p, nil
+}
+
+func (s *Server) consumer(p *consumeParams, r *http.Request, name string, l *log.Log) (*log.Consumer, error) {
+	var options []log.ConsumerOption
+	if p.readCommitted {
+		options = append(options, log.ReadCommitted())
+	}
+	if s.quotas != nil {
+		options = append(options, s.quotas.Consumer(name, r.Header.Get(ClientIDHeader)))
+	}
+	return l.Consumer(p.offset, options...)
+}
+
+// Wait for delay, unless the context is done first. Returns false if it is.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func newRecord(offset uint64, msg *log.Message) Record {
+	record := Record{
+		Offset:    offset,
+		Timestamp: log.NormalizeTimestamp(msg.Timestamp),
+		Key:       msg.Key,
+		Value:     msg.Payload,
+	}
+	for _, h := range msg.Headers {
+		record.Headers = append(record.Headers, Header{h.Key, h.Value})
+	}
+	return record
+}
+
+// Read records, waiting up to the wait parameter for the first one.
+func (s *Server) consume(w http.ResponseWriter, r *http.Request, name string, l *log.Log) {
+	p, err := parseConsumeParams(r, l)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c, err := s.consumer(p, r, name, l)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer c.Close()
+
+	res := ConsumeResponse{Records: []Record{}}
+	size := 0
+	deadline := time.Now().Add(p.wait)
+	for len(res.Records) < p.maxRecords {
+		timeout := time.Until(deadline)
+		if len(res.Records) != 0 || timeout < 0 {
+			// only wait for the first record
+			timeout = 0
+		}
+		offset, msg, err := c.NextTimeout(timeout)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if msg == nil {
+			break
+		}
+		size += len(msg.Key) + len(msg.Payload)
+		if len(res.Records) != 0 && size > p.maxBytes {
+			// the first record is always returned, for the client to make progress
+			break
+		}
+		res.Records = append(res.Records, newRecord(offset, msg))
+	}
+
+	res.NextOffset = p.offset
+	if n := len(res.Records); n != 0 {
+		res.NextOffset = res.Records[n-1].Offset + 1
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Stream records as Server-Sent Events, the id of the events being the offsets of the records.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, name string, l *log.Log) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	p, err := parseConsumeParams(r, l)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c, err := s.consumer(p, r, name, l)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer c.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	done := r.Context().Done()
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		// wait in short steps to notice disconnected clients
+		offset, msg, err := c.NextTimeout(streamPollInterval)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strconv.Quote(err.Error()))
+			flusher.Flush()
+			return
+		}
+		if msg == nil {
+			if time.Since(lastWrite) < KeepAliveInterval {
+				continue
+			}
+			if _, err := fmt.Fprint(w, ": keep alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+			continue
+		}
+
+		data, err := json.Marshal(newRecord(offset, msg))
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		lastWrite = time.Now()
+	}
+}
@@ -0,0 +1,219 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+	"github.com/MikaelCluseau/webaka/pkg/quota"
+)
+
+func testServer(t *testing.T) (*httptest.Server, *log.Log, func()) {
+	dir, err := ioutil.TempDir("", "rest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := log.Open(log.Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, kafka.Open(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(map[string]*log.Log{"test": l}))
+	return server, l, func() {
+		server.Close()
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status: ", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProduceConsume(t *testing.T) {
+	server, l, cleanup := testServer(t)
+	defer cleanup()
+
+	body, _ := json.Marshal(ProduceRequest{Records: []Record{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Value: []byte("v2"), Headers: []Header{{"h", []byte("x")}}},
+	}})
+	res, err := http.Post(server.URL+"/logs/test/messages", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	produced := ProduceResponse{}
+	json.NewDecoder(res.Body).Decode(&produced)
+	res.Body.Close()
+	if len(produced.Offsets) != 2 || produced.Offsets[0] != 1 || produced.Offsets[1] != 2 {
+		t.Fatal("bad offsets: ", produced.Offsets)
+	}
+
+	consumed := ConsumeResponse{}
+	getJSON(t, server.URL+"/logs/test/messages?offset=1&max=10", &consumed)
+	if len(consumed.Records) != 2 || string(consumed.Records[1].Value) != "v2" || consumed.NextOffset != 3 {
+		t.Fatalf("bad records: %+v", consumed)
+	}
+	if h := consumed.Records[1].Headers; len(h) != 1 || string(h[0].Value) != "x" {
+		t.Error("bad headers: ", h)
+	}
+
+	// long poll, with a record appended while waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		http.Post(server.URL+"/logs/test/messages", "application/json",
+			strings.NewReader(`{"records": [{"value": "djM="}]}`))
+	}()
+	consumed = ConsumeResponse{}
+	getJSON(t, server.URL+"/logs/test/messages?offset=3&wait=5s", &consumed)
+	if len(consumed.Records) != 1 || string(consumed.Records[0].Value) != "v3" {
+		t.Fatalf("bad records: %+v", consumed)
+	}
+
+	// no wait
+	consumed = ConsumeResponse{}
+	getJSON(t, server.URL+"/logs/test/messages", &consumed)
+	if len(consumed.Records) != 0 || consumed.NextOffset != 4 {
+		t.Fatalf("bad records: %+v", consumed)
+	}
+
+	metadata := Metadata{}
+	getJSON(t, server.URL+"/logs/test", &metadata)
+	if metadata.NextOffset != 4 || len(metadata.Segments) != 1 || metadata.Segments[0].Size == nil {
+		t.Errorf("bad metadata: %+v", metadata)
+	}
+
+	res, err = http.Get(server.URL + "/logs/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Error("unexpected status: ", res.Status)
+	}
+
+	// a message written when timestamps were in seconds
+	l.Append(log.NewMessage(1500000000, nil, []byte("old")))
+	consumed = ConsumeResponse{}
+	getJSON(t, server.URL+"/logs/test/messages?offset=4", &consumed)
+	if len(consumed.Records) != 1 || consumed.Records[0].Timestamp != 1500000000000 {
+		t.Errorf("bad records: %+v", consumed)
+	}
+}
+
+func TestProduceLimits(t *testing.T) {
+	server, l, cleanup := testServer(t)
+	defer cleanup()
+
+	post := func(body []byte) int {
+		res, err := http.Post(server.URL+"/logs/test/messages", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	body, _ := json.Marshal(ProduceRequest{Records: make([]Record, MaxRecords+1)})
+	if status := post(body); status != http.StatusRequestEntityTooLarge {
+		t.Error("too many records: unexpected status: ", status)
+	}
+	body, _ = json.Marshal(ProduceRequest{Records: []Record{{Value: make([]byte, MaxProduceBytes)}}})
+	if status := post(body); status != http.StatusRequestEntityTooLarge {
+		t.Error("too large: unexpected status: ", status)
+	}
+	if status := post([]byte(`{"records": [`)); status != http.StatusBadRequest {
+		t.Error("invalid: unexpected status: ", status)
+	}
+	if l.NextOffset() != 1 {
+		t.Error("records appended: ", l.NextOffset())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server, l, cleanup := testServer(t)
+	defer cleanup()
+
+	l.Append(log.NewMessage(0, nil, []byte("v1")))
+	l.Append(log.NewMessage(0, nil, []byte("v2")))
+
+	req, _ := http.NewRequest("GET", server.URL+"/logs/test/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("bad content type: ", ct)
+	}
+
+	r := bufio.NewReader(res.Body)
+	expect := func(expected string) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+	expect("id: 2\n")
+	expect(`data: {"offset":2,"value":"djI="}` + "\n")
+	expect("\n")
+
+	l.Append(log.NewMessage(0, nil, []byte("v3")))
+	expect("id: 3\n")
+}
+
+func TestQuotas(t *testing.T) {
+	server, _, cleanup := testServer(t)
+	defer cleanup()
+	// one message per minute for each client
+	server.Config.Handler.(*Server).SetQuotas(quota.New(quota.Config{DefaultClient: quota.Rates{ProduceMessages: 1}, Burst: time.Minute}))
+
+	produce := func(client string, count int) *http.Response {
+		records := make([]Record, count)
+		for i := range records {
+			records[i].Value = []byte("v")
+		}
+		body, _ := json.Marshal(ProduceRequest{Records: records})
+		req, _ := http.NewRequest("POST", server.URL+"/logs/test/messages", bytes.NewReader(body))
+		req.Header.Set(ClientIDHeader, client)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := produce("a", 60); res.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status: ", res.Status)
+	}
+	res := produce("a", 1)
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Error("expected a rejection, got ", res.Status)
+	}
+	if res := produce("b", 1); res.StatusCode != http.StatusOK {
+		t.Error("unexpected status of another client: ", res.Status)
+	}
+}
@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// A client of the service.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{conn}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, res interface{}) error {
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, res, grpc.CallContentSubtype(CodecName))
+}
+
+func (c *Client) stream(ctx context.Context, index int) (grpc.ClientStream, error) {
+	desc := &serviceDesc.Streams[index]
+	return c.conn.NewStream(ctx, desc, "/"+ServiceName+"/"+desc.StreamName, grpc.CallContentSubtype(CodecName))
+}
+
+func (c *Client) Produce(ctx context.Context, req *ProduceRequest) (*ProduceResponse, error) {
+	res := &ProduceResponse{}
+	if err := c.invoke(ctx, "Produce", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Client) Info(ctx context.Context, req *InfoRequest) (*Info, error) {
+	res := &Info{}
+	if err := c.invoke(ctx, "Info", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Client) List(ctx context.Context) (*ListResponse, error) {
+	res := &ListResponse{}
+	if err := c.invoke(ctx, "List", &ListRequest{}, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// A stream of produce requests.
+type ProduceStream struct {
+	stream grpc.ClientStream
+}
+
+func (c *Client) ProduceStream(ctx context.Context) (*ProduceStream, error) {
+	stream, err := c.stream(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ProduceStream{stream}, nil
+}
+
+func (s *ProduceStream) Send(req *ProduceRequest) error {
+	return s.stream.SendMsg(req)
+}
+
+// End the stream, returning the offsets of all the records produced.
+func (s *ProduceStream) CloseAndRecv() (*ProduceResponse, error) {
+	if err := s.stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	res := &ProduceResponse{}
+	if err := s.stream.RecvMsg(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// A subscription, ended by cancelling its context.
+type Subscription struct {
+	stream grpc.ClientStream
+}
+
+func (c *Client) Subscribe(ctx context.Context, req *SubscribeRequest) (*Subscription, error) {
+	stream, err := c.stream(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &Subscription{stream}, nil
+}
+
+// Receive the next record, waiting for it.
+func (s *Subscription) Recv() (*Record, error) {
+	record := &Record{}
+	if err := s.stream.RecvMsg(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
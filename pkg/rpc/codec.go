@@ -0,0 +1,31 @@
+package rpc
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// The name of the codec of the service's messages, to be given as the content subtype of calls
+// (see grpc.CallContentSubtype). The Client does it. The codec has its own name so it doesn't
+// replace a "json" codec registered by another package of the process.
+const CodecName = "cebaka-json"
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// Encodes messages in JSON, so the service doesn't need code generated from protobuf definitions.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return CodecName
+}
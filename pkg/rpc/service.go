@@ -0,0 +1,379 @@
+// Package rpc exposes logs as a gRPC service, cebaka.Log, with JSON encoded messages.
+//
+// Methods, the log being named in each request:
+//
+//	Produce        (unary)             append a batch of records
+//	ProduceStream  (client streaming)  append batches, returning the offsets of all the records
+//	Subscribe      (server streaming)  read records from an offset or a time, following the tail
+//	Info           (unary)             offsets and segments of a log
+//	List           (unary)             names of the logs
+//
+// Subscribe reads the next record only after the previous one has been sent, and sending blocks
+// when the client doesn't read, so slow subscribers are held back by the stream's flow control
+// instead of being buffered by the server.
+//
+// Messages are JSON objects, encoded by encoding/json from the request and response types of this
+// package, []byte values in base64, and sent with the application/grpc+cebaka-json content type
+// (see CodecName). Calls with another content type, protobuf by default, fail to decode.
+//
+// With quotas, clients are identified by the client-id metadata (see WithClientID). Producers
+// over quota are delayed, or rejected with ResourceExhausted.
+package rpc
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/quota"
+)
+
+// The full name of the service.
+const ServiceName = "cebaka.Log"
+
+// Interval at which subscriptions check that their client is still there.
+const subscribePollInterval = 500 * time.Millisecond
+
+// A record, as appended and read.
+type Record struct {
+	Offset    uint64   `json:"offset,omitempty"`
+	Timestamp uint64   `json:"timestamp,omitempty"`
+	Key       []byte   `json:"key,omitempty"`
+	Value     []byte   `json:"value"`
+	Headers   []Header `json:"headers,omitempty"`
+}
+
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type ProduceRequest struct {
+	Log     string   `json:"log"`
+	Records []Record `json:"records"`
+}
+
+type ProduceResponse struct {
+	Offsets []uint64 `json:"offsets"`
+}
+
+type SubscribeRequest struct {
+	Log string `json:"log"`
+	// The offset of the first record, the end of the log if nil.
+	Offset *uint64 `json:"offset,omitempty"`
+	// If not zero, start at the first record with this timestamp or a later one instead.
+	Timestamp     uint64 `json:"timestamp,omitempty"`
+	ReadCommitted bool   `json:"readCommitted,omitempty"`
+}
+
+type InfoRequest struct {
+	Log string `json:"log"`
+}
+
+type Info struct {
+	Name             string        `json:"name"`
+	StartOffset      uint64        `json:"startOffset"`
+	NextOffset       uint64        `json:"nextOffset"`
+	SyncOffset       uint64        `json:"syncOffset"`
+	LastStableOffset uint64        `json:"lastStableOffset"`
+	Segments         []SegmentInfo `json:"segments"`
+}
+
+type SegmentInfo struct {
+	StartOffset uint64 `json:"startOffset"`
+	// The size of the segment in bytes, if known.
+	Size *int64 `json:"size,omitempty"`
+}
+
+type ListRequest struct{}
+
+type ListResponse struct {
+	Logs []string `json:"logs"`
+}
+
+// The metadata identifying clients, for quotas.
+const ClientIDMetadata = "client-id"
+
+// The implementation of the service.
+type Server struct {
+	logs   map[string]*log.Log
+	quotas *quota.Quotas
+}
+
+// Create a server of the given logs, by name.
+func NewServer(logs map[string]*log.Log) *Server {
+	return &Server{logs: logs}
+}
+
+// Apply quotas to the producers and subscribers. Must be called before serving requests.
+func (s *Server) SetQuotas(q *quota.Quotas) {
+	s.quotas = q
+}
+
+// Identify the client of the calls made with the context, for quotas.
+func WithClientID(ctx context.Context, id string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, ClientIDMetadata, id)
+}
+
+func clientID(ctx context.Context) string {
+	if ids := metadata.ValueFromIncomingContext(ctx, ClientIDMetadata); len(ids) != 0 {
+		return ids[len(ids)-1]
+	}
+	return ""
+}
+
+// Register the service in a gRPC server.
+func (s *Server) Register(server *grpc.Server) {
+	server.RegisterService(&serviceDesc, s)
+}
+
+func (s *Server) log(name string) (*log.Log, error) {
+	l := s.logs[name]
+	if l == nil {
+		return nil, status.Errorf(codes.NotFound, "unknown log: %q", name)
+	}
+	return l, nil
+}
+
+// Append the records of a request, adding their offsets to the response.
+func (s *Server) produce(ctx context.Context, req *ProduceRequest, res *ProduceResponse) error {
+	l, err := s.log(req.Log)
+	if err != nil {
+		return err
+	}
+
+	now := log.Timestamp(time.Now())
+	messages := make([]*log.Message, 0, len(req.Records))
+	size := 0
+	for _, record := range req.Records {
+		timestamp := record.Timestamp
+		if timestamp == 0 {
+			timestamp = now
+		}
+		var msg *log.Message
+		if len(record.Headers) != 0 {
+			headers := make([]log.Header, len(record.Headers))
+			for i, h := range record.Headers {
+				headers[i] = log.Header{Key: h.Key, Value: h.Value}
+			}
+			msg = log.NewMessageWithHeaders(timestamp, record.Key, record.Value, headers)
+		} else {
+			msg = log.NewMessage(timestamp, record.Key, record.Value)
+		}
+		messages = append(messages, msg)
+		size += int(8 + 4 + msg.Len())
+	}
+
+	if s.quotas != nil {
+		delay, err := s.quotas.Produce(req.Log, clientID(ctx), len(messages), size)
+		if err != nil {
+			return status.Errorf(codes.ResourceExhausted, "%v, retry in %v", err, delay)
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return status.FromContextError(ctx.Err()).Err()
+			}
+		}
+	}
+
+	for _, msg := range messages {
+		offset, err := l.Append(msg)
+		if err != nil {
+			// the records before were appended, as told by the offsets in the response
+			return status.Errorf(codes.Internal, "append failed after %d records: %v", len(res.Offsets), err)
+		}
+		res.Offsets = append(res.Offsets, offset)
+	}
+	return nil
+}
+
+func (s *Server) Produce(ctx context.Context, req *ProduceRequest) (*ProduceResponse, error) {
+	res := &ProduceResponse{Offsets: make([]uint64, 0, len(req.Records))}
+	if err := s.produce(ctx, req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *Server) ProduceStream(stream grpc.ServerStream) error {
+	res := &ProduceResponse{Offsets: []uint64{}}
+	for {
+		req := &ProduceRequest{}
+		if err := stream.RecvMsg(req); err == io.EOF {
+			return stream.SendMsg(res)
+		} else if err != nil {
+			return err
+		}
+		if err := s.produce(stream.Context(), req, res); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) Subscribe(req *SubscribeRequest, stream grpc.ServerStream) error {
+	l, err := s.log(req.Log)
+	if err != nil {
+		return err
+	}
+
+	offset := l.NextOffset()
+	if req.Offset != nil {
+		offset = *req.Offset
+	}
+	if offset < l.StartOffset() || offset > l.NextOffset() {
+		return status.Errorf(codes.OutOfRange, "offset %d out of range [%d, %d]", offset, l.StartOffset(), l.NextOffset())
+	}
+	var options []log.ConsumerOption
+	if req.ReadCommitted {
+		options = append(options, log.ReadCommitted())
+	}
+	if s.quotas != nil {
+		options = append(options, s.quotas.Consumer(req.Log, clientID(stream.Context())))
+	}
+	c, err := l.Consumer(offset, options...)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer c.Close()
+
+	if req.Timestamp != 0 {
+		if err := c.SeekToTimestamp(req.Timestamp); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	ctx := stream.Context()
+	for ctx.Err() == nil {
+		// wait in short steps to notice cancelled subscriptions
+		offset, msg, err := c.NextTimeout(subscribePollInterval)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if msg == nil {
+			continue
+		}
+		// blocks while the stream's flow control window is full
+		if err := stream.SendMsg(newRecord(offset, msg)); err != nil {
+			return err
+		}
+	}
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+func newRecord(offset uint64, msg *log.Message) *Record {
+	record := &Record{
+		Offset:    offset,
+		Timestamp: log.NormalizeTimestamp(msg.Timestamp),
+		Key:       msg.Key,
+		Value:     msg.Payload,
+	}
+	for _, h := range msg.Headers {
+		record.Headers = append(record.Headers, Header{h.Key, h.Value})
+	}
+	return record
+}
+
+func (s *Server) Info(ctx context.Context, req *InfoRequest) (*Info, error) {
+	l, err := s.log(req.Log)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{
+		Name:             req.Log,
+		StartOffset:      l.StartOffset(),
+		NextOffset:       l.NextOffset(),
+		SyncOffset:       l.SyncOffset(),
+		LastStableOffset: l.LastStableOffset(),
+	}
+	for _, segment := range l.Segments() {
+		si := SegmentInfo{StartOffset: segment.StartOffset()}
+		if sized, ok := segment.(log.SizedSegment); ok {
+			if size, err := sized.Size(); err == nil {
+				si.Size = &size
+			}
+		}
+		info.Segments = append(info.Segments, si)
+	}
+	return info, nil
+}
+
+func (s *Server) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	res := &ListResponse{Logs: make([]string, 0, len(s.logs))}
+	for name := range s.logs {
+		res.Logs = append(res.Logs, name)
+	}
+	sort.Strings(res.Logs)
+	return res, nil
+}
+
+// The service's description, as generated by protoc-gen-go-grpc for a .proto definition.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Produce", Handler: unaryHandler("Produce",
+			func() interface{} { return &ProduceRequest{} },
+			func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Produce(ctx, req.(*ProduceRequest))
+			})},
+		{MethodName: "Info", Handler: unaryHandler("Info",
+			func() interface{} { return &InfoRequest{} },
+			func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Info(ctx, req.(*InfoRequest))
+			})},
+		{MethodName: "List", Handler: unaryHandler("List",
+			func() interface{} { return &ListRequest{} },
+			func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.List(ctx, req.(*ListRequest))
+			})},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "ProduceStream",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*Server).ProduceStream(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "Subscribe",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := &SubscribeRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(*Server).Subscribe(req, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+}
+
+func unaryHandler(method string, newRequest func() interface{},
+	call func(s *Server, ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		s := srv.(*Server)
+		if interceptor == nil {
+			return call(s, ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(s, ctx, req)
+		})
+	}
+}
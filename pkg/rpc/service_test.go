@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func TestService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := log.Open(log.Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, kafka.Open(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	NewServer(map[string]*log.Log{"test": l}).Register(server)
+	go server.Serve(listener)
+	// waits for the subscriptions to end before the log is closed
+	defer server.GracefulStop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewClient(conn)
+	if encoding.GetCodec("json") != nil {
+		t.Error("a json codec is registered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := client.Produce(ctx, &ProduceRequest{Log: "test", Records: []Record{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Value: []byte("v2"), Headers: []Header{{"h", []byte("x")}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Offsets) != 2 || res.Offsets[0] != 1 || res.Offsets[1] != 2 {
+		t.Fatal("bad offsets: ", res.Offsets)
+	}
+
+	ps, err := client.ProduceStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v3", "v4"} {
+		if err := ps.Send(&ProduceRequest{Log: "test", Records: []Record{{Value: []byte(v)}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err = ps.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Offsets) != 2 || res.Offsets[1] != 4 {
+		t.Fatal("bad offsets: ", res.Offsets)
+	}
+
+	offset := uint64(2)
+	subCtx, subCancel := context.WithCancel(ctx)
+	sub, err := client.Subscribe(subCtx, &SubscribeRequest{Log: "test", Offset: &offset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended := make(chan bool)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Append(log.NewMessage(log.Timestamp(time.Now()), nil, []byte("v5")))
+		close(appended)
+	}()
+	for i, expected := range []string{"v2", "v3", "v4", "v5"} {
+		record, err := sub.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Offset != offset+uint64(i) || string(record.Value) != expected {
+			t.Fatalf("bad record %d: %+v", i, record)
+		}
+	}
+	<-appended
+	subCancel()
+	if _, err := sub.Recv(); status.Code(err) != codes.Canceled {
+		t.Error("expected a cancellation, got ", err)
+	}
+
+	info, err := client.Info(ctx, &InfoRequest{Log: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NextOffset != 6 || len(info.Segments) != 1 {
+		t.Errorf("bad info: %+v", info)
+	}
+
+	list, err := client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Logs) != 1 || list.Logs[0] != "test" {
+		t.Error("bad list: ", list.Logs)
+	}
+
+	if _, err := client.Info(ctx, &InfoRequest{Log: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Error("expected not found, got ", err)
+	}
+	offset = 100
+	sub, err = client.Subscribe(ctx, &SubscribeRequest{Log: "test", Offset: &offset})
+	if err == nil {
+		_, err = sub.Recv()
+	}
+	if status.Code(err) != codes.OutOfRange {
+		t.Error("expected out of range, got ", err)
+	}
+}
@@ -0,0 +1,451 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// An Avro schema, validating data in Avro's binary encoding.
+// See https://avro.apache.org/docs/current/spec.html.
+type avroSchema struct {
+	text string
+	root *avroType
+}
+
+type avroType struct {
+	// a primitive type name, or record, enum, array, map, union or fixed
+	kind string
+	// full name of named types
+	name string
+
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	values   *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name       string
+	typ        *avroType
+	hasDefault bool
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+func parseAvro(text string) (*avroSchema, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return nil, err
+	}
+	p := &avroParser{named: map[string]*avroType{}}
+	root, err := p.parse(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	return &avroSchema{text, root}, nil
+}
+
+type avroParser struct {
+	named map[string]*avroType
+}
+
+func (p *avroParser) parse(doc interface{}, namespace string) (*avroType, error) {
+	switch v := doc.(type) {
+	case string:
+		return p.reference(v, namespace)
+
+	case []interface{}:
+		union := &avroType{kind: "union"}
+		for _, branch := range v {
+			t, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if t.kind == "union" {
+				return nil, errors.New("unions can't contain unions")
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return p.parseComplex(v, namespace)
+	}
+	return nil, fmt.Errorf("unexpected %T in schema", doc)
+}
+
+func (p *avroParser) reference(name, namespace string) (*avroType, error) {
+	if avroPrimitives[name] {
+		return &avroType{kind: name}, nil
+	}
+	if t := p.named[fullName(name, namespace)]; t != nil {
+		return t, nil
+	}
+	if t := p.named[name]; t != nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", name)
+}
+
+func fullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (p *avroParser) parseComplex(v map[string]interface{}, namespace string) (*avroType, error) {
+	kind, ok := v["type"].(string)
+	if !ok {
+		// the type is itself a schema, like {"type": {"type": "array", ...}}
+		return p.parse(v["type"], namespace)
+	}
+
+	t := &avroType{kind: kind}
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := v["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s without a name", kind)
+		}
+		if ns, ok := v["namespace"].(string); ok {
+			namespace = ns
+		}
+		t.name = fullName(name, namespace)
+		if i := strings.LastIndex(t.name, "."); i >= 0 {
+			namespace = t.name[:i]
+		}
+		if p.named[t.name] != nil {
+			return nil, fmt.Errorf("type %q defined twice", t.name)
+		}
+		// registered before its fields, for recursive types
+		p.named[t.name] = t
+	}
+
+	switch kind {
+	case "record", "error":
+		t.kind = "record"
+		fields, _ := v["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("field without a name in %q", t.name)
+			}
+			typ, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return nil, fmt.Errorf("field %q of %q: %v", name, t.name, err)
+			}
+			_, hasDefault := field["default"]
+			t.fields = append(t.fields, avroField{name, typ, hasDefault})
+		}
+
+	case "enum":
+		symbols, _ := v["symbols"].([]interface{})
+		for _, s := range symbols {
+			symbol, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid symbol in enum %q", t.name)
+			}
+			t.symbols = append(t.symbols, symbol)
+		}
+
+	case "array":
+		items, err := p.parse(v["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		t.items = items
+
+	case "map":
+		values, err := p.parse(v["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		t.values = values
+
+	case "fixed":
+		size, ok := v["size"].(float64)
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("invalid size of fixed %q", t.name)
+		}
+		t.size = int(size)
+
+	default:
+		if !avroPrimitives[kind] {
+			// a reference to a named type
+			return p.reference(kind, namespace)
+		}
+	}
+	return t, nil
+}
+
+func (s *avroSchema) Type() Type {
+	return Avro
+}
+
+func (s *avroSchema) Text() string {
+	return s.text
+}
+
+func (s *avroSchema) Validate(data []byte) error {
+	d := &avroDecoder{data}
+	if err := d.skip(s.root); err != nil {
+		return fmt.Errorf("%v: %v", InvalidPayload, err)
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%v: %d trailing bytes", InvalidPayload, len(d.data))
+	}
+	return nil
+}
+
+var (
+	avroShortData = errors.New("unexpected end of data")
+	avroString    = &avroType{kind: "string"}
+)
+
+// Decodes Avro's binary encoding, only to check it.
+type avroDecoder struct {
+	data []byte
+}
+
+func (d *avroDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data) {
+		return nil, avroShortData
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *avroDecoder) long() (int64, error) {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		return 0, avroShortData
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+func (d *avroDecoder) skip(t *avroType) error {
+	switch t.kind {
+	case "null":
+		return nil
+	case "boolean":
+		b, err := d.next(1)
+		if err == nil && b[0] > 1 {
+			err = fmt.Errorf("invalid boolean %d", b[0])
+		}
+		return err
+	case "int":
+		v, err := d.long()
+		if err == nil && (v < math.MinInt32 || v > math.MaxInt32) {
+			err = fmt.Errorf("int out of range: %d", v)
+		}
+		return err
+	case "long":
+		_, err := d.long()
+		return err
+	case "float":
+		_, err := d.next(4)
+		return err
+	case "double":
+		_, err := d.next(8)
+		return err
+	case "bytes", "string":
+		n, err := d.long()
+		if err != nil {
+			return err
+		}
+		b, err := d.next(int(n))
+		if err == nil && t.kind == "string" && !utf8.Valid(b) {
+			err = errors.New("invalid UTF-8 string")
+		}
+		return err
+	case "fixed":
+		_, err := d.next(t.size)
+		return err
+	case "enum":
+		i, err := d.long()
+		if err == nil && (i < 0 || i >= int64(len(t.symbols))) {
+			err = fmt.Errorf("invalid symbol index %d of enum %q", i, t.name)
+		}
+		return err
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(t.branches)) {
+			return fmt.Errorf("invalid union branch %d", i)
+		}
+		return d.skip(t.branches[i])
+	case "record":
+		for _, f := range t.fields {
+			if err := d.skip(f.typ); err != nil {
+				return fmt.Errorf("%s.%s: %v", t.name, f.name, err)
+			}
+		}
+		return nil
+	case "array", "map":
+		for {
+			count, err := d.long()
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return nil
+			}
+			if count < 0 {
+				// followed by the size of the block in bytes
+				count = -count
+				if _, err := d.long(); err != nil {
+					return err
+				}
+			}
+			if count > int64(len(d.data)) {
+				// not an actual limit for items of no size (null), but protects from invalid counts
+				return avroShortData
+			}
+			for i := int64(0); i < count; i++ {
+				if t.kind == "map" {
+					if err := d.skip(avroString); err != nil {
+						return err
+					}
+					err = d.skip(t.values)
+				} else {
+					err = d.skip(t.items)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return fmt.Errorf("unknown type %q", t.kind)
+}
+
+func (s *avroSchema) canRead(writer Schema) error {
+	w, ok := writer.(*avroSchema)
+	if !ok {
+		return fmt.Errorf("not an Avro schema")
+	}
+	return avroCanRead(s.root, w.root, map[[2]*avroType]bool{})
+}
+
+// Avro's primitive type promotions, by writer type.
+var avroPromotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+// Check Avro's schema resolution rules.
+func avroCanRead(reader, writer *avroType, seen map[[2]*avroType]bool) error {
+	if writer.kind == "union" {
+		for _, branch := range writer.branches {
+			if err := avroCanRead(reader, branch, seen); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if reader.kind == "union" {
+		for _, branch := range reader.branches {
+			if avroCanRead(branch, writer, seen) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no branch of the union can read %s", describe(writer))
+	}
+
+	if reader.kind != writer.kind {
+		for _, promoted := range avroPromotions[writer.kind] {
+			if promoted == reader.kind {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s can't read %s", describe(reader), describe(writer))
+	}
+	if reader.name != "" && shortName(reader.name) != shortName(writer.name) {
+		return fmt.Errorf("%s can't read %s", describe(reader), describe(writer))
+	}
+
+	switch reader.kind {
+	case "record":
+		pair := [2]*avroType{reader, writer}
+		if seen[pair] {
+			// recursive types, already being checked
+			return nil
+		}
+		seen[pair] = true
+		if err := avroRecordCanRead(reader, writer, seen); err != nil {
+			delete(seen, pair)
+			return err
+		}
+	case "enum":
+		for _, symbol := range writer.symbols {
+			found := false
+			for _, s := range reader.symbols {
+				found = found || s == symbol
+			}
+			if !found {
+				return fmt.Errorf("symbol %q missing in %s", symbol, reader.name)
+			}
+		}
+	case "fixed":
+		if reader.size != writer.size {
+			return fmt.Errorf("size of %s changed from %d to %d", reader.name, writer.size, reader.size)
+		}
+	case "array":
+		return avroCanRead(reader.items, writer.items, seen)
+	case "map":
+		return avroCanRead(reader.values, writer.values, seen)
+	}
+	return nil
+}
+
+func avroRecordCanRead(reader, writer *avroType, seen map[[2]*avroType]bool) error {
+	for _, rf := range reader.fields {
+		var wf *avroField
+		for i := range writer.fields {
+			if writer.fields[i].name == rf.name {
+				wf = &writer.fields[i]
+				break
+			}
+		}
+		if wf == nil {
+			if !rf.hasDefault {
+				return fmt.Errorf("field %q of %s has no default", rf.name, reader.name)
+			}
+			continue
+		}
+		if err := avroCanRead(rf.typ, wf.typ, seen); err != nil {
+			return fmt.Errorf("field %q of %s: %v", rf.name, reader.name, err)
+		}
+	}
+	return nil
+}
+
+func shortName(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func describe(t *avroType) string {
+	if t.name != "" {
+		return t.kind + " " + t.name
+	}
+	return t.kind
+}
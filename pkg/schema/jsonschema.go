@@ -0,0 +1,456 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+// A JSON Schema, validating JSON documents.
+//
+// Only a subset of the specification is supported: type, properties, required,
+// additionalProperties, items, enum, minimum, maximum, minLength, maxLength, pattern, minItems
+// and maxItems. Other keywords are ignored.
+type jsonSchema struct {
+	text string
+	root *jsonNode
+}
+
+type jsonNode struct {
+	// accepted types, any if empty
+	types []string
+
+	properties map[string]*jsonNode
+	required   []string
+	// false when additionalProperties is false
+	additional bool
+	// the schema of additional properties, if given
+	additionalSchema *jsonNode
+	items            *jsonNode
+
+	enum               []interface{}
+	minimum, maximum   *float64
+	minLength          *int
+	maxLength          *int
+	minItems, maxItems *int
+	pattern            *regexp.Regexp
+}
+
+func parseJSONSchema(text string) (*jsonSchema, error) {
+	var doc interface{}
+	if err := unmarshalJSON([]byte(text), &doc); err != nil {
+		return nil, err
+	}
+	root, err := parseJSONNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonSchema{text, root}, nil
+}
+
+func unmarshalJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.More() {
+		return errors.New("data after the JSON value")
+	}
+	return nil
+}
+
+func parseJSONNode(doc interface{}) (*jsonNode, error) {
+	n := &jsonNode{additional: true}
+	switch v := doc.(type) {
+	case bool:
+		if !v {
+			// the schema false accepts nothing
+			n.enum = []interface{}{}
+		}
+		return n, nil
+	case map[string]interface{}:
+		return n, n.parse(v)
+	}
+	return nil, fmt.Errorf("unexpected %T in schema", doc)
+}
+
+func (n *jsonNode) parse(v map[string]interface{}) error {
+	switch t := v["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, typ := range t {
+			s, ok := typ.(string)
+			if !ok {
+				return errors.New("invalid type")
+			}
+			n.types = append(n.types, s)
+		}
+	default:
+		return errors.New("invalid type")
+	}
+
+	if properties, ok := v["properties"].(map[string]interface{}); ok {
+		n.properties = map[string]*jsonNode{}
+		for name, p := range properties {
+			property, err := parseJSONNode(p)
+			if err != nil {
+				return fmt.Errorf("property %q: %v", name, err)
+			}
+			n.properties[name] = property
+		}
+	}
+	if required, ok := v["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, ok := r.(string)
+			if !ok {
+				return errors.New("invalid required property")
+			}
+			n.required = append(n.required, name)
+		}
+	}
+	switch a := v["additionalProperties"].(type) {
+	case bool:
+		n.additional = a
+	case map[string]interface{}:
+		additional, err := parseJSONNode(a)
+		if err != nil {
+			return fmt.Errorf("additionalProperties: %v", err)
+		}
+		n.additionalSchema = additional
+	}
+	if items, ok := v["items"]; ok {
+		node, err := parseJSONNode(items)
+		if err != nil {
+			return fmt.Errorf("items: %v", err)
+		}
+		n.items = node
+	}
+
+	if enum, ok := v["enum"].([]interface{}); ok {
+		n.enum = enum
+	}
+	var err error
+	number := func(key string) *float64 {
+		value, ok := v[key].(json.Number)
+		if !ok || err != nil {
+			return nil
+		}
+		f, e := value.Float64()
+		if e != nil {
+			err = fmt.Errorf("invalid %s: %v", key, e)
+		}
+		return &f
+	}
+	integer := func(key string) *int {
+		if f := number(key); f != nil {
+			i := int(*f)
+			return &i
+		}
+		return nil
+	}
+	n.minimum, n.maximum = number("minimum"), number("maximum")
+	n.minLength, n.maxLength = integer("minLength"), integer("maxLength")
+	n.minItems, n.maxItems = integer("minItems"), integer("maxItems")
+	if err != nil {
+		return err
+	}
+	if pattern, ok := v["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+		n.pattern = re
+	}
+	return nil
+}
+
+func (s *jsonSchema) Type() Type {
+	return JSONSchema
+}
+
+func (s *jsonSchema) Text() string {
+	return s.text
+}
+
+func (s *jsonSchema) Validate(data []byte) error {
+	var doc interface{}
+	if err := unmarshalJSON(data, &doc); err != nil {
+		return fmt.Errorf("%v: %v", InvalidPayload, err)
+	}
+	if err := s.root.validate(doc, "$"); err != nil {
+		return fmt.Errorf("%v: %v", InvalidPayload, err)
+	}
+	return nil
+}
+
+// The JSON Schema type of a decoded value.
+func jsonType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (n *jsonNode) acceptsType(t string) bool {
+	if len(n.types) == 0 {
+		return true
+	}
+	for _, accepted := range n.types {
+		if accepted == t || (accepted == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *jsonNode) validate(v interface{}, path string) error {
+	if t := jsonType(v); !n.acceptsType(t) {
+		return fmt.Errorf("%s: %s is not one of %v", path, t, n.types)
+	}
+	if n.enum != nil {
+		found := false
+		for _, e := range n.enum {
+			found = found || jsonEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+
+	switch x := v.(type) {
+	case json.Number:
+		f, _ := x.Float64()
+		if n.minimum != nil && f < *n.minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, x, *n.minimum)
+		}
+		if n.maximum != nil && f > *n.maximum {
+			return fmt.Errorf("%s: %v is more than %v", path, x, *n.maximum)
+		}
+
+	case string:
+		length := utf8.RuneCountInString(x)
+		if n.minLength != nil && length < *n.minLength {
+			return fmt.Errorf("%s: shorter than %d", path, *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			return fmt.Errorf("%s: longer than %d", path, *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(x) {
+			return fmt.Errorf("%s: doesn't match %s", path, n.pattern)
+		}
+
+	case []interface{}:
+		if n.minItems != nil && len(x) < *n.minItems {
+			return fmt.Errorf("%s: less than %d items", path, *n.minItems)
+		}
+		if n.maxItems != nil && len(x) > *n.maxItems {
+			return fmt.Errorf("%s: more than %d items", path, *n.maxItems)
+		}
+		if n.items != nil {
+			for i, item := range x {
+				if err := n.items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range n.required {
+			if _, ok := x[name]; !ok {
+				return fmt.Errorf("%s: missing property %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property := n.properties[name]
+			if property == nil {
+				if !n.additional {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				property = n.additionalSchema
+			}
+			if property != nil {
+				if err := property.validate(x[name], path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func jsonEqual(a, b interface{}) bool {
+	na, aIsNumber := a.(json.Number)
+	nb, bIsNumber := b.(json.Number)
+	if aIsNumber && bIsNumber {
+		fa, _ := na.Float64()
+		fb, _ := nb.Float64()
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (s *jsonSchema) canRead(writer Schema) error {
+	w, ok := writer.(*jsonSchema)
+	if !ok {
+		return fmt.Errorf("not a JSON schema")
+	}
+	return s.root.canRead(w.root, "$")
+}
+
+// Check that every document valid for the writer is valid for this node. The check is
+// conservative: some compatible changes may be refused.
+func (n *jsonNode) canRead(w *jsonNode, path string) error {
+	if len(n.types) != 0 {
+		if len(w.types) == 0 {
+			return fmt.Errorf("%s: type restricted to %v", path, n.types)
+		}
+		for _, t := range w.types {
+			if !n.acceptsType(t) {
+				return fmt.Errorf("%s: type %s not accepted anymore", path, t)
+			}
+		}
+	}
+
+	if n.enum != nil {
+		if w.enum == nil {
+			return fmt.Errorf("%s: enum added", path)
+		}
+		for _, value := range w.enum {
+			found := false
+			for _, e := range n.enum {
+				found = found || jsonEqual(e, value)
+			}
+			if !found {
+				return fmt.Errorf("%s: enum value %v removed", path, value)
+			}
+		}
+	}
+
+	if err := checkBound(path, "minimum", n.minimum, w.minimum, false); err != nil {
+		return err
+	}
+	if err := checkBound(path, "maximum", n.maximum, w.maximum, true); err != nil {
+		return err
+	}
+	for _, b := range []struct {
+		name   string
+		n, w   *int
+		higher bool
+	}{
+		{"minLength", n.minLength, w.minLength, false},
+		{"maxLength", n.maxLength, w.maxLength, true},
+		{"minItems", n.minItems, w.minItems, false},
+		{"maxItems", n.maxItems, w.maxItems, true},
+	} {
+		if err := checkBound(path, b.name, intBound(b.n), intBound(b.w), b.higher); err != nil {
+			return err
+		}
+	}
+	if n.pattern != nil && (w.pattern == nil || w.pattern.String() != n.pattern.String()) {
+		return fmt.Errorf("%s: pattern changed", path)
+	}
+
+	for _, name := range n.required {
+		found := false
+		for _, r := range w.required {
+			found = found || r == name
+		}
+		if !found {
+			return fmt.Errorf("%s: property %q became required", path, name)
+		}
+	}
+	if !n.additional && w.additional {
+		return fmt.Errorf("%s: additional properties not accepted anymore", path)
+	}
+	for name, wp := range w.properties {
+		np := n.properties[name]
+		if np == nil {
+			if !n.additional {
+				return fmt.Errorf("%s: property %q removed while additional properties are refused", path, name)
+			}
+			if np = n.additionalSchema; np == nil {
+				continue
+			}
+		}
+		if err := np.canRead(wp, path+"."+name); err != nil {
+			return err
+		}
+	}
+	if n.additionalSchema != nil && w.additional {
+		if w.additionalSchema == nil {
+			return fmt.Errorf("%s: additional properties restricted", path)
+		}
+		if err := n.additionalSchema.canRead(w.additionalSchema, path+".*"); err != nil {
+			return err
+		}
+	}
+	for name, np := range n.properties {
+		if w.properties[name] == nil && w.additional {
+			// the writer may have written anything in this property
+			anything := w.additionalSchema
+			if anything == nil {
+				anything = &jsonNode{additional: true}
+			}
+			if err := np.canRead(anything, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.items != nil {
+		items := w.items
+		if items == nil {
+			items = &jsonNode{additional: true}
+		}
+		if err := n.items.canRead(items, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func intBound(i *int) *float64 {
+	if i == nil {
+		return nil
+	}
+	f := float64(*i)
+	return &f
+}
+
+// Check a bound of the reader is not stricter than the writer's.
+func checkBound(path, name string, reader, writer *float64, upper bool) error {
+	if reader == nil {
+		return nil
+	}
+	if writer == nil || (upper && *reader < *writer) || (!upper && *reader > *writer) {
+		return fmt.Errorf("%s: stricter %s", path, name)
+	}
+	return nil
+}
@@ -0,0 +1,517 @@
+package schema
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Protobuf schema, validating data in Protobuf's wire format. The payloads are messages of the
+// first message type of the schema.
+//
+// The schema is a .proto file, without imports: messages (nested or not), enums, scalar, map
+// and oneof fields are supported. Options and reserved statements are ignored.
+type protobufSchema struct {
+	text    string
+	root    *protoMessage
+	message map[string]*protoMessage
+}
+
+type protoMessage struct {
+	name   string
+	fields map[int]*protoField
+}
+
+type protoField struct {
+	name     string
+	number   int
+	typeName string
+	repeated bool
+	// resolved message type, nil for scalars and enums
+	// (for map fields, the entry message with the key (1) and value (2) fields)
+	message *protoMessage
+}
+
+// Wire types of Protobuf's encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var protoScalars = map[string]int{
+	"int32": wireVarint, "int64": wireVarint, "uint32": wireVarint, "uint64": wireVarint,
+	"sint32": wireVarint, "sint64": wireVarint, "bool": wireVarint,
+	"fixed64": wireFixed64, "sfixed64": wireFixed64, "double": wireFixed64,
+	"fixed32": wireFixed32, "sfixed32": wireFixed32, "float": wireFixed32,
+	"string": wireBytes, "bytes": wireBytes,
+}
+
+func parseProtobuf(text string) (*protobufSchema, error) {
+	p := &protoParser{
+		tokens: tokenizeProto(text),
+		enums:  map[string]bool{},
+		schema: &protobufSchema{text: text, message: map[string]*protoMessage{}},
+	}
+	if err := p.parseFile(); err != nil {
+		return nil, err
+	}
+	if p.schema.root == nil {
+		return nil, errors.New("no message in schema")
+	}
+	if err := p.resolve(); err != nil {
+		return nil, err
+	}
+	return p.schema, nil
+}
+
+func tokenizeProto(text string) []string {
+	tokens := []string{}
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '/' && strings.HasPrefix(text[i:], "//"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				i = len(text)
+			} else {
+				i += 2 + end + 2
+			}
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(text) && text[j] != c {
+				if text[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(text) {
+				j = len(text) - 1
+			}
+			tokens = append(tokens, text[i:j+1])
+			i = j + 1
+		case c == '_' || c == '.' || c == '-' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(text) && (text[j] == '_' || text[j] == '.' || text[j] == '-' || text[j] == '+' ||
+				unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j]))) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+type protoParser struct {
+	tokens  []string
+	pkg     string
+	enums   map[string]bool
+	schema  *protobufSchema
+	pending []*protoPending
+}
+
+// A field of message type, resolved once all the types are known.
+type protoPending struct {
+	field *protoField
+	scope string
+}
+
+func (p *protoParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *protoParser) next() string {
+	t := p.peek()
+	if len(p.tokens) != 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *protoParser) expect(token string) error {
+	if t := p.next(); t != token {
+		return fmt.Errorf("expected %q, got %q", token, t)
+	}
+	return nil
+}
+
+// Skip a statement up to its ";", or a block.
+func (p *protoParser) skipStatement() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return errors.New("unexpected end of schema")
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseFile() error {
+	for p.peek() != "" {
+		switch p.peek() {
+		case "syntax", "option", "edition":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "package":
+			p.next()
+			p.pkg = p.next()
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "import":
+			return errors.New("imports are not supported")
+		case "message":
+			p.next()
+			if err := p.parseMessage(p.pkg); err != nil {
+				return err
+			}
+		case "enum":
+			p.next()
+			p.enums[qualify(p.pkg, p.next())] = true
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case ";":
+			p.next()
+		default:
+			return fmt.Errorf("unexpected %q", p.peek())
+		}
+	}
+	return nil
+}
+
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (p *protoParser) parseMessage(scope string) error {
+	m := &protoMessage{name: qualify(scope, p.next()), fields: map[int]*protoField{}}
+	p.schema.message[m.name] = m
+	if p.schema.root == nil {
+		p.schema.root = m
+	}
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch t := p.peek(); t {
+		case "":
+			return errors.New("unexpected end of schema")
+		case "}":
+			p.next()
+			return nil
+		case ";":
+			p.next()
+		case "message":
+			p.next()
+			if err := p.parseMessage(m.name); err != nil {
+				return err
+			}
+		case "enum":
+			p.next()
+			p.enums[qualify(m.name, p.next())] = true
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "option", "reserved", "extensions", "extend":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "oneof":
+			p.next()
+			p.next() // name
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			for p.peek() != "}" {
+				if p.peek() == "option" {
+					if err := p.skipStatement(); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := p.parseField(m, false); err != nil {
+					return err
+				}
+			}
+			p.next()
+		default:
+			repeated := false
+			switch t {
+			case "repeated":
+				repeated = true
+				p.next()
+			case "optional", "required":
+				p.next()
+			}
+			if err := p.parseField(m, repeated); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseField(m *protoMessage, repeated bool) error {
+	f := &protoField{typeName: p.next(), repeated: repeated}
+	if f.typeName == "map" {
+		// map<key, value> is a repeated entry message
+		if err := p.expect("<"); err != nil {
+			return err
+		}
+		key := p.next()
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		value := p.next()
+		if err := p.expect(">"); err != nil {
+			return err
+		}
+		entry := &protoMessage{name: m.name + ".<map entry>", fields: map[int]*protoField{
+			1: {name: "key", number: 1, typeName: key},
+			2: {name: "value", number: 2, typeName: value},
+		}}
+		p.pending = append(p.pending, &protoPending{entry.fields[2], m.name})
+		f.typeName, f.repeated, f.message = "map", true, entry
+	}
+	f.name = p.next()
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(p.next())
+	if err != nil || number <= 0 {
+		return fmt.Errorf("invalid number of field %q", f.name)
+	}
+	f.number = number
+	if p.peek() == "[" {
+		for p.next() != "]" {
+			if p.peek() == "" {
+				return errors.New("unexpected end of schema")
+			}
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+	if m.fields[number] != nil {
+		return fmt.Errorf("field number %d used twice in %s", number, m.name)
+	}
+	m.fields[number] = f
+	if f.message == nil {
+		p.pending = append(p.pending, &protoPending{f, m.name})
+	}
+	return nil
+}
+
+// Resolve the types of the fields, following Protobuf's scoping rules.
+func (p *protoParser) resolve() error {
+	for _, pending := range p.pending {
+		f := pending.field
+		if _, ok := protoScalars[f.typeName]; ok {
+			continue
+		}
+		name := f.typeName
+		resolved := false
+		for scope := pending.scope; !resolved; {
+			candidate := qualify(scope, name)
+			if strings.HasPrefix(name, ".") {
+				candidate = name[1:]
+			}
+			if m := p.schema.message[candidate]; m != nil {
+				f.message, resolved = m, true
+			} else if p.enums[candidate] {
+				f.typeName, resolved = "enum", true
+			} else if scope == "" || strings.HasPrefix(name, ".") {
+				break
+			} else if i := strings.LastIndex(scope, "."); i >= 0 {
+				scope = scope[:i]
+			} else {
+				scope = ""
+			}
+		}
+		if !resolved {
+			return fmt.Errorf("unknown type %q", name)
+		}
+	}
+	return nil
+}
+
+func (s *protobufSchema) Type() Type {
+	return Protobuf
+}
+
+func (s *protobufSchema) Text() string {
+	return s.text
+}
+
+func (s *protobufSchema) Validate(data []byte) error {
+	if err := validateProto(s.root, data, 0); err != nil {
+		return fmt.Errorf("%v: %v", InvalidPayload, err)
+	}
+	return nil
+}
+
+// Maximum depth of nested messages.
+const maxProtoDepth = 100
+
+func (f *protoField) wireType() int {
+	if f.message != nil {
+		return wireBytes
+	}
+	if f.typeName == "enum" {
+		return wireVarint
+	}
+	return protoScalars[f.typeName]
+}
+
+func validateProto(m *protoMessage, data []byte, depth int) error {
+	if depth > maxProtoDepth {
+		return errors.New("messages nested too deeply")
+	}
+	for len(data) != 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid tag")
+		}
+		data = data[n:]
+		number, wireType := int(tag>>3), int(tag&7)
+
+		var value []byte
+		switch wireType {
+		case wireVarint:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", number)
+			}
+			data = data[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return fmt.Errorf("truncated field %d", number)
+			}
+			data = data[size:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return fmt.Errorf("truncated field %d", number)
+			}
+			value = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d of field %d", wireType, number)
+		}
+
+		f := m.fields[number]
+		if f == nil {
+			// unknown fields are kept by Protobuf, for forward compatibility
+			continue
+		}
+		expected := f.wireType()
+		if wireType != expected {
+			if wireType == wireBytes && f.repeated && expected != wireBytes {
+				// packed repeated scalars
+				continue
+			}
+			return fmt.Errorf("field %s has wire type %d, expected %d", f.name, wireType, expected)
+		}
+		if f.message != nil {
+			if err := validateProto(f.message, value, depth+1); err != nil {
+				return fmt.Errorf("%s: %v", f.name, err)
+			}
+		} else if f.typeName == "string" && !utf8.Valid(value) {
+			return fmt.Errorf("field %s is not valid UTF-8", f.name)
+		}
+	}
+	return nil
+}
+
+func (s *protobufSchema) canRead(writer Schema) error {
+	w, ok := writer.(*protobufSchema)
+	if !ok {
+		return fmt.Errorf("not a Protobuf schema")
+	}
+	return protoCanRead(s.root, w.root, map[[2]*protoMessage]bool{})
+}
+
+// Groups of scalar types with the same encoding, that can be read as each other.
+var protoEncodings = map[string]string{
+	"int32": "varint", "int64": "varint", "uint32": "varint", "uint64": "varint", "bool": "varint", "enum": "varint",
+	"sint32": "zigzag", "sint64": "zigzag",
+	"fixed32": "fixed32", "sfixed32": "fixed32",
+	"fixed64": "fixed64", "sfixed64": "fixed64",
+	"float": "float", "double": "double",
+	"string": "bytes", "bytes": "bytes",
+}
+
+// Check that fields with the same number have compatible types. Added and removed fields are
+// compatible since Protobuf fields are optional.
+func protoCanRead(reader, writer *protoMessage, seen map[[2]*protoMessage]bool) error {
+	pair := [2]*protoMessage{reader, writer}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+
+	for number, rf := range reader.fields {
+		wf := writer.fields[number]
+		if wf == nil {
+			continue
+		}
+		if (rf.message == nil) != (wf.message == nil) || rf.repeated != wf.repeated {
+			return fmt.Errorf("field %d changed from %s to %s", number, describeField(wf), describeField(rf))
+		}
+		if rf.message != nil {
+			if err := protoCanRead(rf.message, wf.message, seen); err != nil {
+				return fmt.Errorf("field %s: %v", rf.name, err)
+			}
+		} else if protoEncodings[rf.typeName] != protoEncodings[wf.typeName] {
+			return fmt.Errorf("field %d changed from %s to %s", number, describeField(wf), describeField(rf))
+		}
+	}
+	return nil
+}
+
+func describeField(f *protoField) string {
+	s := f.typeName
+	if f.message != nil && f.typeName != "map" {
+		s = f.message.name
+	}
+	if f.repeated && f.typeName != "map" {
+		s = "repeated " + s
+	}
+	return s + " " + f.name
+}
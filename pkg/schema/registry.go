@@ -0,0 +1,304 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+// The compatibility of subjects without their own.
+const DefaultCompatibility = Backward
+
+// A registry of schemas, persisted in a log.
+type Registry struct {
+	mutex sync.RWMutex
+	log   *log.Log
+
+	compatibility Compatibility
+	subjects      map[string]*subject
+	schemas       map[uint32]Schema
+	// ids by schema type and text, identical schemas having the same id in every subject
+	ids    map[Type]map[string]uint32
+	nextID uint32
+}
+
+type subject struct {
+	compatibility Compatibility
+	// schema ids of the versions, the version being the index + 1
+	versions []uint32
+}
+
+// A record of the registry's log, the key being the subject.
+//
+// Kinds of records:
+//	schema : registers the schema with the id as the next version of the subject
+//	config : sets the compatibility of the subject (of the registry when the subject is empty)
+type record struct {
+	Kind          string        `json:"kind"`
+	ID            uint32        `json:"id,omitempty"`
+	Type          Type          `json:"schemaType,omitempty"`
+	Schema        string        `json:"schema,omitempty"`
+	Compatibility Compatibility `json:"compatibility,omitempty"`
+}
+
+// Open the registry persisted in the given log, reading its records.
+func NewRegistry(l *log.Log) (*Registry, error) {
+	r := &Registry{
+		log:           l,
+		compatibility: DefaultCompatibility,
+		subjects:      map[string]*subject{},
+		schemas:       map[uint32]Schema{},
+		ids:           map[Type]map[string]uint32{},
+		nextID:        1,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) load() error {
+	start, end := r.log.StartOffset(), r.log.NextOffset()
+	if start >= end {
+		return nil
+	}
+
+	consumer, err := r.log.Consumer(start)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	for offset := uint64(0); offset < end-1; {
+		var msg *log.Message
+		if offset, msg, err = consumer.Next(); err != nil {
+			return err
+		}
+		rec := record{}
+		if err := json.Unmarshal(msg.Payload, &rec); err != nil {
+			return fmt.Errorf("invalid registry record at offset %d: %v", offset, err)
+		}
+		if err := r.apply(string(msg.Key), rec); err != nil {
+			return fmt.Errorf("invalid registry record at offset %d: %v", offset, err)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) apply(name string, rec record) error {
+	switch rec.Kind {
+	case "schema":
+		s, err := Parse(rec.Type, rec.Schema)
+		if err != nil {
+			return err
+		}
+		r.schemas[rec.ID] = s
+		if r.ids[rec.Type] == nil {
+			r.ids[rec.Type] = map[string]uint32{}
+		}
+		r.ids[rec.Type][rec.Schema] = rec.ID
+		if rec.ID >= r.nextID {
+			r.nextID = rec.ID + 1
+		}
+		sub := r.subject(name)
+		sub.versions = append(sub.versions, rec.ID)
+
+	case "config":
+		if name == "" {
+			r.compatibility = rec.Compatibility
+		} else {
+			r.subject(name).compatibility = rec.Compatibility
+		}
+
+	default:
+		return fmt.Errorf("unknown record kind %q", rec.Kind)
+	}
+	return nil
+}
+
+func (r *Registry) subject(name string) *subject {
+	sub := r.subjects[name]
+	if sub == nil {
+		sub = &subject{}
+		r.subjects[name] = sub
+	}
+	return sub
+}
+
+// Append a record to the log and apply it.
+func (r *Registry) record(name string, rec record) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := r.log.Append(log.NewMessage(log.Timestamp(time.Now()), []byte(name), payload)); err != nil {
+		return err
+	}
+	r.log.Sync()
+	return r.apply(name, rec)
+}
+
+// Register a schema as the next version of a subject, returning its id.
+// Registering the latest version again returns its id without adding a version.
+func (r *Registry) Register(name string, t Type, text string) (uint32, error) {
+	s, err := Parse(t, text)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sub := r.subjects[name]
+	if sub != nil && len(sub.versions) != 0 {
+		latestID := sub.versions[len(sub.versions)-1]
+		latest := r.schemas[latestID]
+		if latest.Type() == t && latest.Text() == text {
+			return latestID, nil
+		}
+		if err := CheckCompatibility(r.compatibilityOf(sub), latest, s); err != nil {
+			return 0, err
+		}
+	}
+
+	id, ok := r.ids[t][text]
+	if !ok {
+		id = r.nextID
+	}
+	if err := r.record(name, record{Kind: "schema", ID: id, Type: t, Schema: text}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r *Registry) compatibilityOf(sub *subject) Compatibility {
+	if sub != nil && sub.compatibility != "" {
+		return sub.compatibility
+	}
+	return r.compatibility
+}
+
+// Set the compatibility of new versions of a subject, or of all the subjects without their own
+// when the subject is empty.
+func (r *Registry) SetCompatibility(name string, mode Compatibility) error {
+	if !validCompatibility(mode) {
+		return fmt.Errorf("invalid compatibility: %q", mode)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.record(name, record{Kind: "config", Compatibility: mode})
+}
+
+// The compatibility of new versions of a subject.
+func (r *Registry) Compatibility(name string) Compatibility {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.compatibilityOf(r.subjects[name])
+}
+
+// The schema with the given id.
+func (r *Registry) Schema(id uint32) (Schema, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	s := r.schemas[id]
+	if s == nil {
+		return nil, fmt.Errorf("%v: %d", UnknownSchema, id)
+	}
+	return s, nil
+}
+
+// The ids of the versions of a subject, oldest first.
+func (r *Registry) Versions(name string) []uint32 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sub := r.subjects[name]
+	if sub == nil {
+		return nil
+	}
+	return append([]uint32{}, sub.versions...)
+}
+
+// The latest version of a subject's schema, and its id.
+func (r *Registry) Latest(name string) (uint32, Schema, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sub := r.subjects[name]
+	if sub == nil || len(sub.versions) == 0 {
+		return 0, nil, fmt.Errorf("%v: %q", UnknownSubject, name)
+	}
+	id := sub.versions[len(sub.versions)-1]
+	return id, r.schemas[id], nil
+}
+
+// The names of the subjects with at least a version.
+func (r *Registry) Subjects() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.subjects))
+	for name, sub := range r.subjects {
+		if len(sub.versions) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Validate data against the latest version of a subject and encode it with its schema id.
+func (r *Registry) Encode(name string, data []byte) ([]byte, error) {
+	id, s, err := r.Latest(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Validate(data); err != nil {
+		return nil, err
+	}
+	return Encode(id, data), nil
+}
+
+// Decode a payload encoded with its schema id, returning its schema and data.
+func (r *Registry) Decode(payload []byte) (Schema, []byte, error) {
+	id, data, err := Decode(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := r.Schema(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, data, nil
+}
+
+// A validation of the payloads appended to a log (see log.Config.Validate): they must be encoded
+// with the schema of a version of the subject and be valid for it.
+func (r *Registry) Validator(name string) func(msg *log.Message) error {
+	return func(msg *log.Message) error {
+		id, data, err := Decode(msg.Payload)
+		if err != nil {
+			return err
+		}
+
+		r.mutex.RLock()
+		sub := r.subjects[name]
+		s := r.schemas[id]
+		isVersion := false
+		if sub != nil {
+			for _, version := range sub.versions {
+				isVersion = isVersion || version == id
+			}
+		}
+		r.mutex.RUnlock()
+
+		if !isVersion {
+			return fmt.Errorf("%v: schema %d is not a version of subject %q", InvalidPayload, id, name)
+		}
+		return s.Validate(data)
+	}
+}
@@ -0,0 +1,117 @@
+package schema
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+const userV1 = `{"type": "record", "name": "User", "fields": [
+	{"name": "name", "type": "string"}
+]}`
+
+const userV2 = `{"type": "record", "name": "User", "fields": [
+	{"name": "name", "type": "string"},
+	{"name": "age", "type": "int", "default": 0}
+]}`
+
+// no default for the new field: can't read data written with v1
+const userV2NoDefault = `{"type": "record", "name": "User", "fields": [
+	{"name": "name", "type": "string"},
+	{"name": "age", "type": "int"}
+]}`
+
+func openLog(t *testing.T, dir string) *log.Log {
+	l, err := log.Open(log.Config{MaxSegmentSize: 1 << 20, MaxSyncLag: -1}, kafka.Open(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := openLog(t, filepath.Join(dir, "schemas"))
+	r, err := NewRegistry(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id1, err := r.Register("users", Avro, userV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := r.Register("users", Avro, userV1); id != id1 {
+		t.Error("registering the same schema again gave a new id: ", id)
+	}
+	if _, err := r.Register("users", Avro, userV2NoDefault); err == nil {
+		t.Error("incompatible schema registered")
+	}
+	id2, err := r.Register("users", Avro, userV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2 == id1 {
+		t.Error("same id for two schemas")
+	}
+	if err := r.SetCompatibility("users", None); err != nil {
+		t.Fatal(err)
+	}
+	state.Close()
+
+	// reload the registry from its log
+	state = openLog(t, filepath.Join(dir, "schemas"))
+	defer state.Close()
+	if r, err = NewRegistry(state); err != nil {
+		t.Fatal(err)
+	}
+	if versions := r.Versions("users"); len(versions) != 2 || versions[0] != id1 || versions[1] != id2 {
+		t.Error("bad versions: ", versions)
+	}
+	if c := r.Compatibility("users"); c != None {
+		t.Error("bad compatibility: ", c)
+	}
+
+	users, err := log.Open(log.Config{
+		MaxSegmentSize: 1 << 20,
+		MaxSyncLag:     -1,
+		Validate:       r.Validator("users"),
+	}, kafka.Open(filepath.Join(dir, "users"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer users.Close()
+
+	// name "bob", age 42
+	data := []byte{6, 'b', 'o', 'b', 84}
+	payload, err := r.Encode("users", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Append(log.NewMessage(0, nil, payload)); err != nil {
+		t.Error("valid payload rejected: ", err)
+	}
+	if _, err := users.Append(log.NewMessage(0, nil, Encode(id2, data[:4]))); err == nil {
+		t.Error("invalid payload appended")
+	}
+	if _, err := users.Append(log.NewMessage(0, nil, data)); err == nil {
+		t.Error("payload without schema id appended")
+	}
+
+	s, decoded, err := r.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Text() != userV2 || string(decoded) != string(data) {
+		t.Errorf("bad decoded payload: %q", decoded)
+	}
+}
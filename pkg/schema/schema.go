@@ -0,0 +1,104 @@
+// Package schema registers the schemas of the payloads of logs and validates payloads against them.
+//
+// Schemas are Avro, Protobuf or JSON Schema documents registered under a subject, usually the
+// name of a log. Each registration of a new schema adds a version to the subject, identified by
+// a schema id unique in the registry. Payloads are prefixed by the id of their schema (see
+// Encode), so consumers can decode them without knowing their schema in advance.
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	UnknownType    = errors.New("unknown schema type")
+	UnknownSchema  = errors.New("unknown schema")
+	UnknownSubject = errors.New("unknown subject")
+	InvalidSchema  = errors.New("invalid schema")
+	InvalidPayload = errors.New("invalid payload")
+	Incompatible   = errors.New("incompatible schema")
+)
+
+// The language of a schema.
+type Type string
+
+const (
+	Avro       Type = "AVRO"
+	Protobuf   Type = "PROTOBUF"
+	JSONSchema Type = "JSON"
+)
+
+// How a new version of a subject's schema must relate to the previous one.
+type Compatibility string
+
+const (
+	// Any schema is accepted.
+	None Compatibility = "NONE"
+	// The new schema can read data written with the previous one.
+	Backward Compatibility = "BACKWARD"
+	// The previous schema can read data written with the new one.
+	Forward Compatibility = "FORWARD"
+	// Both backward and forward.
+	Full Compatibility = "FULL"
+)
+
+// A parsed schema.
+type Schema interface {
+	Type() Type
+	// The text of the schema, as registered.
+	Text() string
+	// Check that data is valid for this schema.
+	Validate(data []byte) error
+	// Check that this schema can read data written with the writer schema, of the same type.
+	canRead(writer Schema) error
+}
+
+// Parse a schema.
+func Parse(t Type, text string) (Schema, error) {
+	var s Schema
+	var err error
+	switch t {
+	case Avro:
+		s, err = parseAvro(text)
+	case Protobuf:
+		s, err = parseProtobuf(text)
+	case JSONSchema:
+		s, err = parseJSONSchema(text)
+	default:
+		return nil, fmt.Errorf("%v: %q", UnknownType, t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", InvalidSchema, err)
+	}
+	return s, nil
+}
+
+// Check that a new schema respects the compatibility mode with the previous one.
+func CheckCompatibility(mode Compatibility, previous, next Schema) error {
+	if mode == None {
+		return nil
+	}
+	if previous.Type() != next.Type() {
+		return fmt.Errorf("%v: type changed from %s to %s", Incompatible, previous.Type(), next.Type())
+	}
+	if mode == Backward || mode == Full {
+		if err := next.canRead(previous); err != nil {
+			return fmt.Errorf("%v: new schema can't read data of the previous one: %v", Incompatible, err)
+		}
+	}
+	if mode == Forward || mode == Full {
+		if err := previous.canRead(next); err != nil {
+			return fmt.Errorf("%v: previous schema can't read data of the new one: %v", Incompatible, err)
+		}
+	}
+	return nil
+}
+
+func validCompatibility(mode Compatibility) bool {
+	switch mode {
+	case None, Backward, Forward, Full:
+		return true
+	}
+	return false
+}
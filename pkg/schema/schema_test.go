@@ -0,0 +1,124 @@
+package schema
+
+import (
+	"testing"
+)
+
+type schemaTest struct {
+	data  string
+	valid bool
+}
+
+func checkValidate(t *testing.T, typ Type, text string, tests []schemaTest) {
+	s, err := Parse(typ, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if err := s.Validate([]byte(test.data)); (err == nil) != test.valid {
+			t.Errorf("%s: %q: valid should be %t, got error %v", typ, test.data, test.valid, err)
+		}
+	}
+}
+
+func checkCompatibility(t *testing.T, typ Type, previous, next string, mode Compatibility, compatible bool) {
+	p, err := Parse(typ, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Parse(typ, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCompatibility(mode, p, n); (err == nil) != compatible {
+		t.Errorf("%s: %s compatibility of %s after %s should be %t, got error %v", typ, mode, next, previous, compatible, err)
+	}
+}
+
+func TestAvro(t *testing.T) {
+	checkValidate(t, Avro, `{"type": "record", "name": "R", "fields": [
+		{"name": "id", "type": "long"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "next", "type": ["null", "R"]}
+	]}`, []schemaTest{
+		{"\x02\x00\x00", true},
+		{"\x02\x02\x02a\x00\x02\x04\x00\x00", true},
+		{"\x02\x00\x04", false},
+		{"\x02\x00", false},
+		{"\x02\x00\x00\x00", false},
+	})
+
+	checkCompatibility(t, Avro, userV1, userV2, Full, true)
+	checkCompatibility(t, Avro, userV1, userV2NoDefault, Backward, false)
+	checkCompatibility(t, Avro, userV1, userV2NoDefault, Forward, true)
+	checkCompatibility(t, Avro, `"int"`, `"long"`, Backward, true)
+	checkCompatibility(t, Avro, `"int"`, `"long"`, Forward, false)
+	checkCompatibility(t, Avro, `"int"`, `["null", "long"]`, Backward, true)
+}
+
+func TestJSONSchema(t *testing.T) {
+	checkValidate(t, JSONSchema, `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`, []schemaTest{
+		{`{"name": "bob", "age": 42}`, true},
+		{`{"name": "bob"}`, true},
+		{`{"age": 42}`, false},
+		{`{"name": ""}`, false},
+		{`{"name": "bob", "age": -1}`, false},
+		{`{"name": "bob", "age": 4.2}`, false},
+		{`{"name": "bob", "email": "bob@example.com"}`, false},
+		{`[]`, false},
+	})
+
+	v1 := `{"type": "object", "properties": {"name": {"type": "string"}}, "additionalProperties": false}`
+	v2 := `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "additionalProperties": false}`
+	v3 := `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "required": ["age"], "additionalProperties": false}`
+	checkCompatibility(t, JSONSchema, v1, v2, Backward, true)
+	checkCompatibility(t, JSONSchema, v1, v2, Forward, false)
+	checkCompatibility(t, JSONSchema, v2, v3, Backward, false)
+	checkCompatibility(t, JSONSchema, v2, v3, Forward, true)
+}
+
+const protoV1 = `
+syntax = "proto3";
+package test;
+
+message User {
+	string name = 1;
+	repeated int64 ids = 2;
+	Address address = 3;
+	map<string, Address> others = 4;
+
+	message Address {
+		string city = 1;
+	}
+}
+`
+
+func TestProtobuf(t *testing.T) {
+	checkValidate(t, Protobuf, protoV1, []schemaTest{
+		{"", true},
+		{"\x0a\x03bob", true},
+		// packed ids
+		{"\x12\x02\x01\x02", true},
+		{"\x1a\x05\x0a\x03Nice", false},
+		{"\x1a\x06\x0a\x04Nice", true},
+		{"\x22\x0b\x0a\x01a\x12\x06\x0a\x04Nice", true},
+		// unknown field
+		{"\x28\x01", true},
+		// name as a varint
+		{"\x08\x01", false},
+		{"\x0a\x03\xff\xfe\xfd", false},
+	})
+
+	v2 := `syntax = "proto3"; message User { string name = 1; int32 age = 5; }`
+	v3 := `syntax = "proto3"; message User { bytes name = 1; string age = 5; }`
+	checkCompatibility(t, Protobuf, protoV1, v2, Full, true)
+	checkCompatibility(t, Protobuf, v2, v3, Backward, false)
+}
@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// First byte of encoded payloads.
+const magicByte byte = 0
+
+// Prefix data with the id of its schema.
+//
+// Format:
+//
+//	magic byte : 1 byte (0)
+//	schema id  : 4 bytes
+//	data       : N bytes
+func Encode(id uint32, data []byte) []byte {
+	payload := make([]byte, 5+len(data))
+	payload[0] = magicByte
+	binary.BigEndian.PutUint32(payload[1:], id)
+	copy(payload[5:], data)
+	return payload
+}
+
+// Split an encoded payload into the id of its schema and its data.
+func Decode(payload []byte) (uint32, []byte, error) {
+	if len(payload) < 5 || payload[0] != magicByte {
+		return 0, nil, fmt.Errorf("%v: no schema id", InvalidPayload)
+	}
+	return binary.BigEndian.Uint32(payload[1:]), payload[5:], nil
+}
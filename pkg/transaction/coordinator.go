@@ -0,0 +1,279 @@
+// Package transaction atomically publishes groups of messages to one or more logs.
+//
+// The coordinator writes begin, commit and abort control messages in the logs taking part in a
+// transaction, and records its decisions in its own state log so transactions interrupted by a
+// crash are completed (or aborted) when the coordinator is created again.
+package transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+var (
+	UnknownLog        = errors.New("unknown log")
+	TransactionClosed = errors.New("transaction already committed or aborted")
+)
+
+// Producer ids of transactions have this bit set, to not collide with the ids of other producers.
+const producerIDBit uint64 = 1 << 63
+
+type status byte
+
+const (
+	ongoing status = iota
+	prepareCommit
+	prepareAbort
+	completeCommit
+	completeAbort
+)
+
+type Coordinator struct {
+	mutex sync.Mutex
+	state *log.Log
+	logs  map[string]*log.Log
+}
+
+type Transaction struct {
+	coordinator *Coordinator
+	producerID  uint64
+
+	mutex        sync.Mutex
+	participants []string
+	sequences    map[string]uint32
+	closed       bool
+}
+
+// Create a coordinator of transactions over the given logs, which should be transactional.
+// Transactions recorded in the state log but not completed are completed, or aborted if they
+// were not being committed.
+func NewCoordinator(state *log.Log, logs map[string]*log.Log) (*Coordinator, error) {
+	c := &Coordinator{
+		state: state,
+		logs:  logs,
+	}
+	if err := c.recover(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Begin a new transaction.
+func (c *Coordinator) Begin() (*Transaction, error) {
+	// the transaction's producer id is the offset of its first record
+	offset, err := c.record(0, ongoing, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{
+		coordinator: c,
+		producerID:  producerIDBit | offset,
+		sequences:   map[string]uint32{},
+	}, nil
+}
+
+// The producer id of the transaction's messages.
+func (t *Transaction) ProducerID() uint64 {
+	return t.producerID
+}
+
+// Append a message to a log as part of this transaction.
+func (t *Transaction) Append(logName string, msg *log.Message) (uint64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return 0, TransactionClosed
+	}
+
+	l := t.coordinator.logs[logName]
+	if l == nil {
+		return 0, fmt.Errorf("%v: %q", UnknownLog, logName)
+	}
+
+	sequence, ok := t.sequences[logName]
+	if !ok {
+		// the participant must be known before the log has an open transaction
+		participants := append(t.participants, logName)
+		if _, err := t.coordinator.record(t.producerID, ongoing, participants); err != nil {
+			return 0, err
+		}
+		t.participants = participants
+
+		if _, err := l.Append(log.NewControlMessage(log.Timestamp(time.Now()), t.producerID, log.BeginMarker)); err != nil {
+			return 0, err
+		}
+	}
+
+	msg.SetTransactional(t.producerID, sequence)
+	offset, err := l.Append(msg)
+	if err != nil {
+		return 0, err
+	}
+	t.sequences[logName] = sequence + 1
+	return offset, nil
+}
+
+// Commit the transaction: its messages become visible to read committed consumers.
+func (t *Transaction) Commit() error {
+	return t.end(prepareCommit)
+}
+
+// Abort the transaction: its messages are skipped by read committed consumers.
+func (t *Transaction) Abort() error {
+	return t.end(prepareAbort)
+}
+
+func (t *Transaction) end(decision status) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return TransactionClosed
+	}
+	t.closed = true
+
+	return t.coordinator.complete(t.producerID, decision, t.participants)
+}
+
+// Record the decision, write the markers in the participants, and record the completion.
+func (c *Coordinator) complete(producerID uint64, decision status, participants []string) error {
+	if _, err := c.record(producerID, decision, participants); err != nil {
+		return err
+	}
+
+	marker, completed := log.CommitMarker, completeCommit
+	if decision == prepareAbort {
+		marker, completed = log.AbortMarker, completeAbort
+	}
+
+	for _, name := range participants {
+		l := c.logs[name]
+		if l == nil {
+			return fmt.Errorf("%v: %q", UnknownLog, name)
+		}
+		if _, err := l.Append(log.NewControlMessage(log.Timestamp(time.Now()), producerID, marker)); err != nil {
+			return err
+		}
+		// the marker must be durable before the transaction is recorded as completed
+		l.Sync()
+	}
+
+	_, err := c.record(producerID, completed, nil)
+	return err
+}
+
+// Record the status of a transaction in the state log, and sync it.
+//
+// Record format:
+//
+//	key              : 8 bytes producer id (nil when beginning a transaction, its offset giving the id)
+//	payload:
+//	  status         : 1 byte
+//	  participants   : 4 bytes
+//	  for each participant:
+//	    name length  : 4 bytes
+//	    name         : N bytes
+func (c *Coordinator) record(producerID uint64, s status, participants []string) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var key []byte
+	if producerID != 0 {
+		key = make([]byte, 8)
+		binary.BigEndian.PutUint64(key, producerID)
+	}
+
+	buf := &bytes.Buffer{}
+	w := log.NewBinaryWriter(buf)
+	w.WriteByte(byte(s))
+	w.WriteUint32(uint32(len(participants)))
+	for _, name := range participants {
+		w.WriteBytes([]byte(name))
+	}
+
+	offset, err := c.state.Append(log.NewMessage(log.Timestamp(time.Now()), key, buf.Bytes()))
+	if err != nil {
+		return 0, err
+	}
+	c.state.Sync()
+	return offset, nil
+}
+
+type transactionState struct {
+	status       status
+	participants []string
+}
+
+// Complete the transactions left open in the state log.
+func (c *Coordinator) recover() error {
+	start, end := c.state.StartOffset(), c.state.NextOffset()
+	if start >= end {
+		return nil
+	}
+
+	consumer, err := c.state.Consumer(start)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	transactions := map[uint64]*transactionState{}
+	order := make([]uint64, 0)
+
+	for offset := uint64(0); offset < end-1; {
+		var msg *log.Message
+		if offset, msg, err = consumer.Next(); err != nil {
+			return err
+		}
+
+		producerID := producerIDBit | offset
+		if len(msg.Key) == 8 {
+			producerID = binary.BigEndian.Uint64(msg.Key)
+		}
+
+		r := &log.BinaryReader{Reader: bytes.NewReader(msg.Payload)}
+		s := status(r.ReadByte())
+		// the count isn't trusted, the participants are read until the payload ends
+		var participants []string
+		count := r.ReadUint32()
+		for i := uint32(0); i < count && r.Err() == nil; i++ {
+			participants = append(participants, string(r.ReadBytes()))
+		}
+		if err := r.Err(); err != nil {
+			return fmt.Errorf("invalid transaction record at offset %d: %v", offset, err)
+		}
+
+		t := transactions[producerID]
+		if t == nil {
+			t = &transactionState{}
+			transactions[producerID] = t
+			order = append(order, producerID)
+		}
+		t.status = s
+		if len(participants) != 0 {
+			t.participants = participants
+		}
+	}
+
+	for _, producerID := range order {
+		t := transactions[producerID]
+		switch t.status {
+		case ongoing, prepareAbort:
+			if err := c.complete(producerID, prepareAbort, t.participants); err != nil {
+				return err
+			}
+		case prepareCommit:
+			if err := c.complete(producerID, prepareCommit, t.participants); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
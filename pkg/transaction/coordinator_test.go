@@ -0,0 +1,128 @@
+package transaction
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+)
+
+func openLog(t *testing.T, dir string) *log.Log {
+	l, err := log.Open(log.Config{
+		MaxSegmentSize: 1 << 20,
+		MaxSyncLag:     -1,
+		Transactional:  true,
+	}, kafka.Open(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// Read the committed values, up to an "end" message appended now.
+func readCommitted(t *testing.T, l *log.Log) []string {
+	if _, err := l.Append(log.NewMessage(0, nil, []byte("end"))); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := l.Consumer(l.StartOffset(), log.ReadCommitted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	values := []string{}
+	for {
+		_, msg, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Payload) == "end" {
+			return values
+		}
+		values = append(values, string(msg.Payload))
+	}
+}
+
+func TestCommitAndAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transaction-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := openLog(t, filepath.Join(dir, "state"))
+	a := openLog(t, filepath.Join(dir, "a"))
+	b := openLog(t, filepath.Join(dir, "b"))
+	logs := map[string]*log.Log{"a": a, "b": b}
+
+	c, err := NewCoordinator(state, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := func(v string) *log.Message { return log.NewMessage(0, nil, []byte(v)) }
+
+	committed, _ := c.Begin()
+	committed.Append("a", msg("a1"))
+	committed.Append("b", msg("b1"))
+
+	aborted, _ := c.Begin()
+	aborted.Append("a", msg("aborted"))
+
+	a.Append(msg("a2"))
+	if lso := a.LastStableOffset(); lso != 1 {
+		t.Error("bad last stable offset: ", lso)
+	}
+
+	if err := committed.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aborted.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aborted.Abort(); err != TransactionClosed {
+		t.Error("expected a closed transaction, got ", err)
+	}
+
+	// left open, aborted by the next coordinator
+	interrupted, _ := c.Begin()
+	interrupted.Append("b", msg("interrupted"))
+
+	if lso := a.LastStableOffset(); lso != a.NextOffset() {
+		t.Errorf("bad last stable offset: %d != %d", lso, a.NextOffset())
+	}
+	if values := readCommitted(t, a); len(values) != 2 || values[0] != "a1" || values[1] != "a2" {
+		t.Errorf("bad committed values in a: %q", values)
+	}
+
+	if _, err := NewCoordinator(state, logs); err != nil {
+		t.Fatal(err)
+	}
+	if lso := b.LastStableOffset(); lso != b.NextOffset() {
+		t.Errorf("bad last stable offset: %d != %d", lso, b.NextOffset())
+	}
+	if values := readCommitted(t, b); len(values) != 1 || values[0] != "b1" {
+		t.Errorf("bad committed values in b: %q", values)
+	}
+}
+
+func TestInvalidRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transaction-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a record claiming 2^32-1 participants
+	state := openLog(t, filepath.Join(dir, "state"))
+	state.Append(log.NewMessage(0, nil, []byte{byte(ongoing), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1, 'a'}))
+
+	if _, err := NewCoordinator(state, map[string]*log.Log{}); err == nil || !strings.Contains(err.Error(), "invalid transaction record") {
+		t.Error("expected an invalid record, got ", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+type headerFlags []log.Header
+
+func (h *headerFlags) String() string {
+	return formatHeaders(*h)
+}
+
+func (h *headerFlags) Set(value string) error {
+	idx := strings.IndexByte(value, '=')
+	if idx < 0 {
+		return fmt.Errorf("invalid header %q, expected key=value", value)
+	}
+	*h = append(*h, log.Header{Key: value[:idx], Value: []byte(value[idx+1:])})
+	return nil
+}
+
+func produce(args []string) error {
+	flags := flag.NewFlagSet("produce", flag.ExitOnError)
+	delimiter := flags.String("delimiter", "newline", "record delimiter: newline or length (4 bytes big endian length prefix)")
+	withKey := flags.Bool("key", false, "records have a key (key<TAB>value when newline delimited)")
+	segmentSize := flags.Int64("segment-size", 100<<20, "maximum size of a segment")
+	syncLag := flags.Int("sync-lag", -1, "sync when this many messages are not synced (-1: only on exit)")
+	printOffsets := flags.Bool("print-offsets", false, "print the offset of each appended record")
+	producerID := flags.Uint64("producer-id", 0, "producer id for idempotent appends (0: none)")
+	sequence := flags.Uint("sequence", 0, "sequence of the first record when a producer id is given")
+	keyFile := flags.String("keys", "", "key file to encrypt the records with, if any")
+	auditKeyFile := flags.String("audit-key", "", "chain the messages with hashes, and sign checkpoints with this key (see audit-keygen)")
+	checkpointInterval := flags.Int("checkpoint-interval", 0, "also sign a checkpoint every this many messages of a segment (0: only when sealed or closed)")
+	headers := headerFlags{}
+	flags.Var(&headers, "header", "header added to each record, as key=value (can be repeated)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: produce [flags] <log dir>")
+		fmt.Fprintln(os.Stderr, "reads records from stdin and appends them to the log.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("exactly one log directory expected")
+	}
+
+	readRecord, err := newRecordReader(*delimiter, *withKey, bufio.NewReaderSize(os.Stdin, 64<<10))
+	if err != nil {
+		return err
+	}
+
+	keys, err := openKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	auditKey, err := readAuditKey(*auditKeyFile)
+	if err != nil {
+		return err
+	}
+	l, err := log.Open(log.Config{
+		MaxSegmentSize:     *segmentSize,
+		MaxSyncLag:         *syncLag,
+		Idempotent:         *producerID != 0,
+		HashChain:          auditKey != nil,
+		CheckpointKey:      auditKey,
+		CheckpointInterval: *checkpointInterval,
+	}, openStore(flags.Arg(0), keys, false))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	for {
+		key, value, err := readRecord()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var msg *log.Message
+		if len(headers) == 0 {
+			msg = log.NewMessage(log.Timestamp(time.Now()), key, value)
+		} else {
+			msg = log.NewMessageWithHeaders(log.Timestamp(time.Now()), key, value, headers)
+		}
+
+		if *producerID != 0 {
+			msg.SetProducer(*producerID, uint32(*sequence))
+			*sequence++
+		}
+
+		offset, err := l.Append(msg)
+		if err != nil {
+			return err
+		}
+		if *printOffsets {
+			fmt.Fprintln(out, offset)
+		}
+	}
+}
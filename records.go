@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+type jsonHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func jsonHeaders(headers []log.Header) []jsonHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+	h := make([]jsonHeader, len(headers))
+	for i, header := range headers {
+		h[i] = jsonHeader{header.Key, header.Value}
+	}
+	return h
+}
+
+// Format headers as `[a="x" b="y"]`.
+func formatHeaders(headers []log.Header) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('[')
+	for i, h := range headers {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%s=%q", h.Key, h.Value)
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// Reads the next record from the input. Returns io.EOF when there's no more records.
+type recordReader func() (key, value []byte, err error)
+
+// Writes a record to the output.
+type recordWriter func(key, value []byte) error
+
+// Records are either newline delimited (key<TAB>value when withKey is set),
+// or length delimited using the log's byte encoding (4 bytes big endian length,
+// then the bytes; the key comes first when withKey is set).
+func newRecordReader(delimiter string, withKey bool, in *bufio.Reader) (recordReader, error) {
+	switch delimiter {
+	case "newline":
+		return func() ([]byte, []byte, error) {
+			line, err := in.ReadBytes('\n')
+			if err == io.EOF && len(line) != 0 {
+				err = nil
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			line = bytes.TrimSuffix(line, []byte{'\n'})
+			if !withKey {
+				return nil, line, nil
+			}
+			idx := bytes.IndexByte(line, '\t')
+			if idx < 0 {
+				return nil, line, nil
+			}
+			return line[:idx], line[idx+1:], nil
+		}, nil
+
+	case "length":
+		return func() ([]byte, []byte, error) {
+			r := &log.BinaryReader{Reader: in}
+			var key []byte
+			if withKey {
+				if key = r.ReadBytes(); r.Err() != nil {
+					return nil, nil, r.Err()
+				}
+			}
+			value := r.ReadBytes()
+			if err := r.Err(); err == io.EOF && withKey {
+				return nil, nil, log.UnexpectedEOF
+			} else if err != nil {
+				return nil, nil, err
+			}
+			return key, value, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown record delimiter: %q", delimiter)
+}
+
+func newRecordWriter(delimiter string, withKey bool, out *bufio.Writer) (recordWriter, error) {
+	switch delimiter {
+	case "newline":
+		return func(key, value []byte) error {
+			if withKey {
+				out.Write(key)
+				out.WriteByte('\t')
+			}
+			out.Write(value)
+			return out.WriteByte('\n')
+		}, nil
+
+	case "length":
+		return func(key, value []byte) error {
+			w := log.NewBinaryWriter(out)
+			if withKey {
+				w.WriteBytes(key)
+			}
+			w.WriteBytes(value)
+			return w.Err()
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown record delimiter: %q", delimiter)
+}
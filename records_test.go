@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+)
+
+type testRecord struct {
+	key, value string
+}
+
+func TestRecordsRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		delimiter string
+		withKey   bool
+		records   []testRecord
+	}{
+		{"newline", false, []testRecord{{"", "a"}, {"", ""}, {"", "b\tc"}}},
+		{"newline", true, []testRecord{{"k1", "a"}, {"", ""}, {"k2", "b\tc"}}},
+		{"length", false, []testRecord{{"", "a"}, {"", ""}, {"", "b\nc"}}},
+		{"length", true, []testRecord{{"k1", "a"}, {"", ""}, {"k\n2", "b\tc\n"}}},
+	} {
+		buf := &bytes.Buffer{}
+		out := bufio.NewWriter(buf)
+		writeRecord, err := newRecordWriter(c.delimiter, c.withKey, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range c.records {
+			if err := writeRecord([]byte(r.key), []byte(r.value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out.Flush()
+
+		readRecord, err := newRecordReader(c.delimiter, c.withKey, bufio.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read := []testRecord{}
+		for {
+			key, value, err := readRecord()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s (key: %t): %v", c.delimiter, c.withKey, err)
+			}
+			read = append(read, testRecord{string(key), string(value)})
+		}
+		if len(read) != len(c.records) {
+			t.Errorf("%s (key: %t): expected %q, got %q", c.delimiter, c.withKey, c.records, read)
+			continue
+		}
+		for i := range read {
+			if read[i] != c.records[i] {
+				t.Errorf("%s (key: %t): expected %q, got %q", c.delimiter, c.withKey, c.records, read)
+				break
+			}
+		}
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	// the last line may have no newline
+	readRecord, _ := newRecordReader("newline", true, bufio.NewReader(strings.NewReader("k\tv\nno key")))
+	if key, value, err := readRecord(); err != nil || string(key) != "k" || string(value) != "v" {
+		t.Errorf("unexpected record: %q %q %v", key, value, err)
+	}
+	if key, value, err := readRecord(); err != nil || key != nil || string(value) != "no key" {
+		t.Errorf("unexpected record: %q %q %v", key, value, err)
+	}
+	if _, _, err := readRecord(); err != io.EOF {
+		t.Error("expected EOF, got ", err)
+	}
+
+	// a key without its value
+	readRecord, _ = newRecordReader("length", true, bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 1, 'k'})))
+	if _, _, err := readRecord(); err != log.UnexpectedEOF {
+		t.Error("expected an unexpected EOF, got ", err)
+	}
+
+	if _, err := newRecordReader("comma", false, nil); err == nil {
+		t.Error("unknown delimiter accepted")
+	}
+	if _, err := newRecordWriter("comma", false, nil); err == nil {
+		t.Error("unknown delimiter accepted")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	golog "log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"google.golang.org/grpc"
+
+	"github.com/MikaelCluseau/webaka/pkg/log"
+	"github.com/MikaelCluseau/webaka/pkg/log/stores/kafka"
+	"github.com/MikaelCluseau/webaka/pkg/metrics"
+	"github.com/MikaelCluseau/webaka/pkg/quota"
+	"github.com/MikaelCluseau/webaka/pkg/rest"
+	"github.com/MikaelCluseau/webaka/pkg/rpc"
+)
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "address to listen on")
+	segmentSize := flags.Int64("segment-size", 100<<20, "maximum size of a segment")
+	segmentAge := flags.Duration("segment-age", 0, "roll segments older than this, with up to 10% jitter (0: no limit)")
+	preallocate := flags.Bool("preallocate", false, "preallocate the space of new segments")
+	syncLag := flags.Int("sync-lag", 0, "sync when this many messages are not synced")
+	grpcListen := flags.String("grpc-listen", "", "address to serve the gRPC API on, if any")
+	withMetrics := flags.Bool("metrics", true, "expose Prometheus metrics on /metrics")
+	keyFile := flags.String("keys", "", "key file to encrypt the logs with, if any (reloaded on SIGHUP)")
+	auditKeyFile := flags.String("audit-key", "", "chain the messages with hashes, and sign checkpoints with this key (see audit-keygen)")
+	checkpointInterval := flags.Int("checkpoint-interval", 0, "also sign a checkpoint every this many messages of a segment (0: only when sealed or closed)")
+	logAppendTime := flags.Bool("log-append-time", false, "timestamp the messages with the time they're appended at, instead of the producers' time")
+	maxTimestampDelta := flags.Duration("max-timestamp-delta", 0, "reject the messages with a producer's timestamp further than this from now (0: no limit)")
+	quotaFile := flags.String("quotas", "", "JSON file of the producer and consumer quotas, if any (reloaded on SIGHUP)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: serve [flags] <log dir>...")
+		fmt.Fprintln(os.Stderr, "serves the logs over HTTP (and gRPC), each log being named after its directory.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no log directory given")
+	}
+
+	mux := http.NewServeMux()
+	var registry metrics.Registry = metrics.Discard
+	if *withMetrics {
+		prometheus := metrics.NewPrometheus()
+		registry = prometheus
+		mux.Handle("/metrics", prometheus)
+	}
+
+	keys, err := openKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	auditKey, err := readAuditKey(*auditKeyFile)
+	if err != nil {
+		return err
+	}
+
+	logs := map[string]*log.Log{}
+	defer func() {
+		for _, l := range logs {
+			l.Close()
+		}
+	}()
+	timestampType := log.CreateTime
+	if *logAppendTime {
+		timestampType = log.LogAppendTime
+	}
+
+	for _, dir := range flags.Args() {
+		name := filepath.Base(filepath.Clean(dir))
+		if logs[name] != nil {
+			return fmt.Errorf("two logs named %q", name)
+		}
+		labels := metrics.Labels{"log": name}
+		store := kafka.Open(dir, 0)
+		store.SetMetrics(registry, labels)
+		l, err := log.Open(log.Config{
+			MaxSegmentSize:      *segmentSize,
+			MaxSegmentAge:       *segmentAge,
+			MaxSegmentAgeJitter: *segmentAge / 10,
+			PreallocateSegments: *preallocate,
+			MaxSyncLag:          *syncLag,
+			Metrics:             registry,
+			MetricsLabels:       labels,
+			HashChain:           auditKey != nil,
+			CheckpointKey:       auditKey,
+			CheckpointInterval:  *checkpointInterval,
+			TimestampType:       timestampType,
+			MaxTimestampDelta:   *maxTimestampDelta,
+		}, encryptStore(store, keys))
+		if err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+		logs[name] = l
+	}
+
+	var quotas *quota.Quotas
+	if *quotaFile != "" {
+		config, err := readQuotas(*quotaFile)
+		if err != nil {
+			return err
+		}
+		quotas = quota.New(config)
+	}
+
+	server := rest.NewServer(logs)
+	if quotas != nil {
+		server.SetQuotas(quotas)
+	}
+	mux.Handle("/logs", server)
+	mux.Handle("/logs/", server)
+
+	errs := make(chan error, 2)
+	go func() {
+		golog.Print("listening on ", *listen)
+		errs <- http.ListenAndServe(*listen, mux)
+	}()
+
+	if *grpcListen != "" {
+		listener, err := net.Listen("tcp", *grpcListen)
+		if err != nil {
+			return err
+		}
+		grpcServer := grpc.NewServer(grpc.WaitForHandlers(true))
+		rpcServer := rpc.NewServer(logs)
+		if quotas != nil {
+			rpcServer.SetQuotas(quotas)
+		}
+		rpcServer.Register(grpcServer)
+		// end the subscriptions before the logs are closed
+		defer grpcServer.Stop()
+		go func() {
+			golog.Print("serving gRPC on ", *grpcListen)
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+
+	// close the logs properly on termination
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				// new messages are encrypted with the key made active by a rotation
+				if keys != nil {
+					if err := keys.Reload(); err != nil {
+						golog.Print("failed to reload the keys: ", err)
+					}
+				}
+				if quotas != nil {
+					if config, err := readQuotas(*quotaFile); err != nil {
+						golog.Print("failed to reload the quotas: ", err)
+					} else {
+						quotas.SetConfig(config)
+					}
+				}
+				continue
+			}
+			golog.Print("stopping on ", sig)
+			return nil
+		}
+	}
+}
+
+func readQuotas(path string) (quota.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return quota.Config{}, err
+	}
+	defer f.Close()
+	config, err := quota.ReadConfig(f)
+	if err != nil {
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}